@@ -0,0 +1,60 @@
+package main
+
+import netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+
+// NetworkBackend is the set of operations the state machine needs from the network stack.
+// Keeping these behind an interface lets the state machine be run against a fake in tests.
+type NetworkBackend interface {
+	// WifiRadioEnabled returns true if the wifi radio is on.
+	WifiRadioEnabled() (bool, error)
+	// SetWifiRadio turns the wifi radio on or off.
+	SetWifiRadio(enabled bool) error
+	// ActiveConnections lists the currently active connections.
+	ActiveConnections() ([]ActiveConnection, error)
+	// ConnectionIP4Address returns the IPv4 address of an active connection, or "" if it doesn't have one yet.
+	ConnectionIP4Address(id string) (string, error)
+	// ConnectionIP6Address returns the first global IPv6 address of an active connection, or "" if it doesn't have one yet.
+	// Link-local addresses are ignored as they are added before the connection is up.
+	ConnectionIP6Address(id string) (string, error)
+	// ConnectionUp activates a saved connection.
+	ConnectionUp(id string) error
+	// ConnectionDown deactivates an active connection.
+	ConnectionDown(id string) error
+	// ModifyConnection will create the connection if it doesn't exist, then apply the given config to it.
+	// Config keys use the nmcli property names, e.g. "wifi-sec.psk".
+	ModifyConnection(id string, config map[string]string) error
+	// DeleteConnection removes a saved connection profile.
+	DeleteConnection(id string) error
+	// SavedWifiConnections returns the IDs of the saved wifi connection profiles.
+	SavedWifiConnections() ([]string, error)
+	// HiddenWifiSSIDs returns the SSIDs of the saved wifi connections that are for hidden networks.
+	HiddenWifiSSIDs() ([]string, error)
+	// RequestWifiScan starts a scan on the interface, probing for the given SSIDs so hidden networks are found.
+	RequestWifiScan(ifname string, ssids []string) error
+	// WifiAccessPoints returns the access points found by the scans on the interface, without starting a new scan.
+	WifiAccessPoints(ifname string) ([]netmanagerclient.AccessPoint, error)
+	// ActiveBSSID returns the BSSID of the access point the interface is associated with.
+	ActiveBSSID(ifname string) (string, error)
+	// ActiveSignalStrength returns the signal strength, in percent, of the access point the interface is associated with.
+	ActiveSignalStrength(ifname string) (int, error)
+	// ConnectionFailures returns a channel that gets each failed attempt to activate a connection.
+	ConnectionFailures() <-chan ConnectionFailure
+}
+
+// ActiveConnection is a connection that NetworkManager currently has active.
+type ActiveConnection struct {
+	Type string
+	Name string
+}
+
+// ConnectionFailure is a failed attempt to activate a connection.
+type ConnectionFailure struct {
+	ID     string
+	Reason netmanagerclient.ConnectionFailureReason
+}
+
+// dhcpServer hands out addresses to devices connected to the hotspot.
+type dhcpServer interface {
+	Start(hotspot Hotspot) error
+	Stop() error
+}
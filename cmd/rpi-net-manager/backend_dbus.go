@@ -0,0 +1,791 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	nmDest                = "org.freedesktop.NetworkManager"
+	nmPath                = "/org/freedesktop/NetworkManager"
+	nmSettingsPath        = "/org/freedesktop/NetworkManager/Settings"
+	nmSettingsIface       = nmDest + ".Settings"
+	nmSettingsConnIface   = nmDest + ".Settings.Connection"
+	nmActiveConnIface     = nmDest + ".Connection.Active"
+	nmDeviceIface         = nmDest + ".Device"
+	nmIP4ConfigIface      = nmDest + ".IP4Config"
+	nmIP6ConfigIface      = nmDest + ".IP6Config"
+	nmDeviceWirelessIface = nmDest + ".Device.Wireless"
+	nmAccessPointIface    = nmDest + ".AccessPoint"
+
+	nmActiveConnectionStateActivating  = 1
+	nmActiveConnectionStateActivated   = 2
+	nmActiveConnectionStateDeactivated = 4
+
+	nmDeviceStatePrepare   = 40
+	nmDeviceStateActivated = 100
+	nmDeviceStateFailed    = 120
+)
+
+// nmDbusBackend implements NetworkBackend by talking to NetworkManager over D-Bus.
+type nmDbusBackend struct {
+	conn *dbus.Conn
+}
+
+// nmSettings is the a{sa{sv}} settings format NetworkManager uses for connection profiles.
+type nmSettings map[string]map[string]dbus.Variant
+
+func newNMDbusBackend() (*nmDbusBackend, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return &nmDbusBackend{conn: conn}, nil
+}
+
+func (b *nmDbusBackend) object(path dbus.ObjectPath) dbus.BusObject {
+	return b.conn.Object(nmDest, path)
+}
+
+func (b *nmDbusBackend) getProperty(path dbus.ObjectPath, iface, name string, v interface{}) error {
+	variant, err := b.object(path).GetProperty(iface + "." + name)
+	if err != nil {
+		return fmt.Errorf("failed to get %s.%s of %s: %v", iface, name, path, err)
+	}
+	return variant.Store(v)
+}
+
+func (b *nmDbusBackend) WifiRadioEnabled() (bool, error) {
+	var enabled bool
+	err := b.getProperty(nmPath, nmDest, "WirelessEnabled", &enabled)
+	return enabled, err
+}
+
+func (b *nmDbusBackend) SetWifiRadio(enabled bool) error {
+	if err := b.object(nmPath).SetProperty(nmDest+".WirelessEnabled", dbus.MakeVariant(enabled)); err != nil {
+		return fmt.Errorf("failed to set wifi radio: %v", err)
+	}
+	return nil
+}
+
+// nmActiveConnection is the information read from an active connection object.
+type nmActiveConnection struct {
+	path      dbus.ObjectPath
+	id        string
+	connType  string
+	state     uint32
+	ip4Config dbus.ObjectPath
+	ip6Config dbus.ObjectPath
+}
+
+func (b *nmDbusBackend) activeConnections() ([]nmActiveConnection, error) {
+	var paths []dbus.ObjectPath
+	if err := b.getProperty(nmPath, nmDest, "ActiveConnections", &paths); err != nil {
+		return nil, err
+	}
+	conns := []nmActiveConnection{}
+	for _, path := range paths {
+		props := map[string]dbus.Variant{}
+		if err := b.object(path).Call("org.freedesktop.DBus.Properties.GetAll", 0, nmActiveConnIface).Store(&props); err != nil {
+			// The connection can be deactivated while iterating.
+			log.Debugf("failed to read active connection %s: %v", path, err)
+			continue
+		}
+		conn := nmActiveConnection{path: path}
+		_ = props["Id"].Store(&conn.id)
+		_ = props["Type"].Store(&conn.connType)
+		_ = props["State"].Store(&conn.state)
+		_ = props["Ip4Config"].Store(&conn.ip4Config)
+		if v, ok := props["Ip6Config"]; ok {
+			_ = v.Store(&conn.ip6Config)
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+func (b *nmDbusBackend) findActiveConnection(id string) (nmActiveConnection, bool, error) {
+	conns, err := b.activeConnections()
+	if err != nil {
+		return nmActiveConnection{}, false, err
+	}
+	for _, conn := range conns {
+		if conn.id == id {
+			return conn, true, nil
+		}
+	}
+	return nmActiveConnection{}, false, nil
+}
+
+func (b *nmDbusBackend) ActiveConnections() ([]ActiveConnection, error) {
+	conns, err := b.activeConnections()
+	if err != nil {
+		return nil, err
+	}
+	active := []ActiveConnection{}
+	for _, conn := range conns {
+		active = append(active, ActiveConnection{Type: conn.connType, Name: conn.id})
+	}
+	return active, nil
+}
+
+// ConnectionIP4Address returns the first address of the connection once it has been activated.
+func (b *nmDbusBackend) ConnectionIP4Address(id string) (string, error) {
+	return b.connectionAddress(id, false)
+}
+
+// ConnectionIP6Address returns the first global IPv6 address of the connection once it has been activated.
+func (b *nmDbusBackend) ConnectionIP6Address(id string) (string, error) {
+	return b.connectionAddress(id, true)
+}
+
+func (b *nmDbusBackend) connectionAddress(id string, ipv6 bool) (string, error) {
+	conn, found, err := b.findActiveConnection(id)
+	if err != nil {
+		return "", err
+	}
+	config, iface := conn.ip4Config, nmIP4ConfigIface
+	if ipv6 {
+		config, iface = conn.ip6Config, nmIP6ConfigIface
+	}
+	if !found || conn.state != nmActiveConnectionStateActivated || config == "/" || config == "" {
+		return "", nil
+	}
+	var addressData []map[string]dbus.Variant
+	if err := b.getProperty(config, iface, "AddressData", &addressData); err != nil {
+		return "", err
+	}
+	for _, data := range addressData {
+		var address string
+		var prefix uint32
+		if err := data["address"].Store(&address); err != nil {
+			continue
+		}
+		if ip := net.ParseIP(address); ipv6 && (ip == nil || ip.IsLinkLocalUnicast()) {
+			continue
+		}
+		_ = data["prefix"].Store(&prefix)
+		return fmt.Sprintf("%s/%d", address, prefix), nil
+	}
+	return "", nil
+}
+
+func (b *nmDbusBackend) ConnectionUp(id string) error {
+	path, _, found, err := b.findConnection(id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no connection named '%s'", id)
+	}
+	var active dbus.ObjectPath
+	call := b.object(nmPath).Call(nmDest+".ActivateConnection", 0, path, dbus.ObjectPath("/"), dbus.ObjectPath("/"))
+	if err := call.Store(&active); err != nil {
+		return fmt.Errorf("failed to activate connection '%s': %v", id, err)
+	}
+	return nil
+}
+
+func (b *nmDbusBackend) ConnectionDown(id string) error {
+	conn, found, err := b.findActiveConnection(id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("connection '%s' is not active", id)
+	}
+	if err := b.object(nmPath).Call(nmDest+".DeactivateConnection", 0, conn.path).Err; err != nil {
+		return fmt.Errorf("failed to deactivate connection '%s': %v", id, err)
+	}
+	return nil
+}
+
+// nmConnection is a saved connection profile.
+type nmConnection struct {
+	path     dbus.ObjectPath
+	id       string
+	connType string
+	settings nmSettings
+}
+
+// connections reads all the saved connection profiles.
+func (b *nmDbusBackend) connections() ([]nmConnection, error) {
+	var paths []dbus.ObjectPath
+	if err := b.object(nmSettingsPath).Call(nmSettingsIface+".ListConnections", 0).Store(&paths); err != nil {
+		return nil, fmt.Errorf("failed to list connections: %v", err)
+	}
+	conns := []nmConnection{}
+	for _, path := range paths {
+		settings := nmSettings{}
+		if err := b.object(path).Call(nmSettingsConnIface+".GetSettings", 0).Store(&settings); err != nil {
+			log.Debugf("failed to read connection %s: %v", path, err)
+			continue
+		}
+		conn := nmConnection{path: path, settings: settings}
+		if v, ok := settings["connection"]["id"]; ok {
+			_ = v.Store(&conn.id)
+		}
+		if v, ok := settings["connection"]["type"]; ok {
+			_ = v.Store(&conn.connType)
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// findConnection finds the saved connection profile with the given ID.
+func (b *nmDbusBackend) findConnection(id string) (dbus.ObjectPath, nmSettings, bool, error) {
+	conns, err := b.connections()
+	if err != nil {
+		return "", nil, false, err
+	}
+	for _, conn := range conns {
+		if conn.id == id {
+			return conn.path, conn.settings, true, nil
+		}
+	}
+	return "", nil, false, nil
+}
+
+func (b *nmDbusBackend) SavedWifiConnections() ([]string, error) {
+	conns, err := b.connections()
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, conn := range conns {
+		if conn.connType == "802-11-wireless" {
+			ids = append(ids, conn.id)
+		}
+	}
+	return ids, nil
+}
+
+func (b *nmDbusBackend) HiddenWifiSSIDs() ([]string, error) {
+	conns, err := b.connections()
+	if err != nil {
+		return nil, err
+	}
+	ssids := []string{}
+	for _, conn := range conns {
+		if conn.connType != "802-11-wireless" {
+			continue
+		}
+		wireless := conn.settings["802-11-wireless"]
+		var hidden bool
+		var mode string
+		var ssid []byte
+		if v, ok := wireless["hidden"]; ok {
+			_ = v.Store(&hidden)
+		}
+		if v, ok := wireless["mode"]; ok {
+			_ = v.Store(&mode)
+		}
+		if v, ok := wireless["ssid"]; ok {
+			_ = v.Store(&ssid)
+		}
+		// The hotspot is hosted by the device so isn't probed for.
+		if hidden && mode != "ap" && len(ssid) > 0 {
+			ssids = append(ssids, string(ssid))
+		}
+	}
+	return ssids, nil
+}
+
+func (b *nmDbusBackend) RequestWifiScan(ifname string, ssids []string) error {
+	var device dbus.ObjectPath
+	if err := b.object(nmPath).Call(nmDest+".GetDeviceByIpIface", 0, ifname).Store(&device); err != nil {
+		return fmt.Errorf("failed to find device '%s': %v", ifname, err)
+	}
+	options := map[string]dbus.Variant{}
+	if len(ssids) > 0 {
+		probe := [][]byte{}
+		for _, ssid := range ssids {
+			probe = append(probe, []byte(ssid))
+		}
+		options["ssids"] = dbus.MakeVariant(probe)
+	}
+	if err := b.object(device).Call(nmDeviceWirelessIface+".RequestScan", 0, options).Err; err != nil {
+		return fmt.Errorf("failed to request scan: %v", err)
+	}
+	return nil
+}
+
+// Security flags of an access point, from NM80211ApFlags and NM80211ApSecurityFlags.
+const (
+	nmAPFlagsPrivacy       = 0x1
+	nmAPSecKeyMgmtPSK      = 0x100
+	nmAPSecKeyMgmt8021X    = 0x200
+	nmAPSecKeyMgmtSAE      = 0x400
+	nmAPSecKeyMgmtOWE      = 0x800
+	nmAPSecKeyMgmtOWETM    = 0x1000
+	nmAPSecKeyMgmtEAPSuite = 0x2000
+)
+
+func (b *nmDbusBackend) WifiAccessPoints(ifname string) ([]netmanagerclient.AccessPoint, error) {
+	var device dbus.ObjectPath
+	if err := b.object(nmPath).Call(nmDest+".GetDeviceByIpIface", 0, ifname).Store(&device); err != nil {
+		return nil, fmt.Errorf("failed to find device '%s': %v", ifname, err)
+	}
+	var paths []dbus.ObjectPath
+	if err := b.object(device).Call(nmDeviceWirelessIface+".GetAllAccessPoints", 0).Store(&paths); err != nil {
+		return nil, fmt.Errorf("failed to list access points: %v", err)
+	}
+	var active dbus.ObjectPath
+	if err := b.getProperty(device, nmDeviceWirelessIface, "ActiveAccessPoint", &active); err != nil {
+		return nil, err
+	}
+	aps := []netmanagerclient.AccessPoint{}
+	for _, path := range paths {
+		var props map[string]dbus.Variant
+		if err := b.object(path).Call("org.freedesktop.DBus.Properties.GetAll", 0, nmAccessPointIface).Store(&props); err != nil {
+			// The access point can go away between listing and reading it.
+			continue
+		}
+		var ssid []byte
+		var bssid string
+		var freq, maxBitrate, flags, wpaFlags, rsnFlags uint32
+		var strength byte
+		for name, v := range map[string]interface{}{
+			"Ssid": &ssid, "HwAddress": &bssid, "Frequency": &freq, "MaxBitrate": &maxBitrate,
+			"Flags": &flags, "WpaFlags": &wpaFlags, "RsnFlags": &rsnFlags, "Strength": &strength,
+		} {
+			if variant, ok := props[name]; ok {
+				if err := variant.Store(v); err != nil {
+					return nil, fmt.Errorf("failed to read %s of access point: %v", name, err)
+				}
+			}
+		}
+		securityFlags := apSecurityFlags(flags, wpaFlags, rsnFlags)
+		aps = append(aps, netmanagerclient.AccessPoint{
+			BSSID:         bssid,
+			SSID:          netmanagerclient.SSID(ssid).String(),
+			RawSSID:       ssid,
+			Channel:       channelFromFrequency(int(freq)),
+			Band:          netmanagerclient.BandFromFrequency(int(freq)),
+			Frequency:     int(freq),
+			Security:      netmanagerclient.SecurityFromScan(strings.Join(securityFlags, " ")),
+			SecurityFlags: securityFlags,
+			MaxBitrate:    int(maxBitrate / 1000),
+			Signal:        int(strength),
+			InUse:         path == active,
+		})
+	}
+	return aps, nil
+}
+
+// apSecurityFlags gets the security flags of an access point the same way nmcli shows them.
+func apSecurityFlags(flags, wpaFlags, rsnFlags uint32) []string {
+	var security []string
+	if flags&nmAPFlagsPrivacy != 0 && wpaFlags == 0 && rsnFlags == 0 {
+		security = append(security, "WEP")
+	}
+	if wpaFlags != 0 {
+		security = append(security, "WPA1")
+	}
+	if rsnFlags&(nmAPSecKeyMgmtPSK|nmAPSecKeyMgmt8021X) != 0 {
+		security = append(security, "WPA2")
+	}
+	if rsnFlags&(nmAPSecKeyMgmtSAE|nmAPSecKeyMgmtEAPSuite) != 0 {
+		security = append(security, "WPA3")
+	}
+	if rsnFlags&(nmAPSecKeyMgmtOWE|nmAPSecKeyMgmtOWETM) != 0 {
+		security = append(security, "OWE")
+	}
+	if (wpaFlags|rsnFlags)&nmAPSecKeyMgmt8021X != 0 {
+		security = append(security, "802.1X")
+	}
+	return security
+}
+
+func channelFromFrequency(freq int) int {
+	switch {
+	case freq == 2484:
+		return 14
+	case freq >= 2412 && freq < 2484:
+		return (freq - 2407) / 5
+	case freq >= 5950 && freq <= 7125:
+		return (freq - 5950) / 5
+	case freq >= 5000 && freq < 5950:
+		return (freq - 5000) / 5
+	default:
+		return 0
+	}
+}
+
+func (b *nmDbusBackend) ModifyConnection(id string, config map[string]string) error {
+	path, settings, found, err := b.findConnection(id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		settings = nmSettings{"connection": {
+			"id":   dbus.MakeVariant(id),
+			"uuid": dbus.MakeVariant(newUUID()),
+		}}
+	} else {
+		// GetSettings doesn't include secrets and Update replaces the whole profile, so add them back in.
+		for setting := range settings {
+			secrets := nmSettings{}
+			if err := b.object(path).Call(nmSettingsConnIface+".GetSecrets", 0, setting).Store(&secrets); err != nil {
+				continue
+			}
+			for k, v := range secrets[setting] {
+				settings[setting][k] = v
+			}
+		}
+		// NetworkManager will ignore the newer address-data and route-data if these are sent.
+		for _, setting := range []string{"ipv4", "ipv6"} {
+			delete(settings[setting], "addresses")
+			delete(settings[setting], "routes")
+		}
+	}
+
+	if err := applyNMCliConfig(settings, config); err != nil {
+		return err
+	}
+
+	if !found {
+		var newPath dbus.ObjectPath
+		if err := b.object(nmSettingsPath).Call(nmSettingsIface+".AddConnection", 0, settings).Store(&newPath); err != nil {
+			return fmt.Errorf("failed to create network: %v", err)
+		}
+		return nil
+	}
+	if err := b.object(path).Call(nmSettingsConnIface+".Update", 0, settings).Err; err != nil {
+		return fmt.Errorf("failed to modify network: %v", err)
+	}
+	return nil
+}
+
+func (b *nmDbusBackend) DeleteConnection(id string) error {
+	path, _, found, err := b.findConnection(id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no connection named '%s'", id)
+	}
+	if err := b.object(path).Call(nmSettingsConnIface+".Delete", 0).Err; err != nil {
+		return fmt.Errorf("failed to delete connection '%s': %v", id, err)
+	}
+	return nil
+}
+
+func (b *nmDbusBackend) activeAccessPoint(ifname string) (dbus.ObjectPath, error) {
+	var device dbus.ObjectPath
+	if err := b.object(nmPath).Call(nmDest+".GetDeviceByIpIface", 0, ifname).Store(&device); err != nil {
+		return "", fmt.Errorf("failed to find device '%s': %v", ifname, err)
+	}
+	var ap dbus.ObjectPath
+	if err := b.getProperty(device, nmDeviceWirelessIface, "ActiveAccessPoint", &ap); err != nil {
+		return "", err
+	}
+	if ap == "/" || ap == "" {
+		return "", errors.New("no active AP found")
+	}
+	return ap, nil
+}
+
+func (b *nmDbusBackend) ActiveBSSID(ifname string) (string, error) {
+	ap, err := b.activeAccessPoint(ifname)
+	if err != nil {
+		return "", err
+	}
+	var bssid string
+	err = b.getProperty(ap, nmAccessPointIface, "HwAddress", &bssid)
+	return bssid, err
+}
+
+func (b *nmDbusBackend) ActiveSignalStrength(ifname string) (int, error) {
+	ap, err := b.activeAccessPoint(ifname)
+	if err != nil {
+		return 0, err
+	}
+	var strength byte
+	err = b.getProperty(ap, nmAccessPointIface, "Strength", &strength)
+	return int(strength), err
+}
+
+// ConnectionFailures watches the state changes of devices and active connections for failed connections.
+func (b *nmDbusBackend) ConnectionFailures() <-chan ConnectionFailure {
+	failures := make(chan ConnectionFailure, 10)
+	signals := make(chan *dbus.Signal, 10)
+	for _, iface := range []string{nmDeviceIface, nmActiveConnIface} {
+		err := b.conn.AddMatchSignal(dbus.WithMatchSender(nmDest), dbus.WithMatchInterface(iface), dbus.WithMatchMember("StateChanged"))
+		if err != nil {
+			log.Printf("Failed to watch for connection failures: %v", err)
+		}
+	}
+	b.conn.Signal(signals)
+	w := &failureWatcher{
+		backend:     b,
+		deviceConns: map[dbus.ObjectPath]string{},
+		activeConns: map[dbus.ObjectPath]string{},
+		reported:    map[string]bool{},
+		failures:    failures,
+	}
+	go w.run(signals)
+	return failures
+}
+
+// failureWatcher finds failed connections from the StateChanged signals. A device that fails to activate a
+// connection gives the most detailed reason, but the active connection is also watched for failures that
+// don't fail the device, such as a timeout. Only the first failure of each attempt is reported.
+type failureWatcher struct {
+	backend     *nmDbusBackend
+	deviceConns map[dbus.ObjectPath]string // Device path to the ID of the connection it is activating.
+	activeConns map[dbus.ObjectPath]string // Active connection path to its ID, while activating.
+	reported    map[string]bool            // Connections that have had their failure reported for this attempt.
+	failures    chan<- ConnectionFailure
+}
+
+func (w *failureWatcher) run(signals <-chan *dbus.Signal) {
+	for sig := range signals {
+		if len(sig.Body) < 2 {
+			continue
+		}
+		switch sig.Name {
+		case nmDeviceIface + ".StateChanged":
+			newState, _ := sig.Body[0].(uint32)
+			reason, _ := sig.Body[len(sig.Body)-1].(uint32)
+			w.deviceStateChanged(sig.Path, newState, reason)
+		case nmActiveConnIface + ".StateChanged":
+			state, _ := sig.Body[0].(uint32)
+			reason, _ := sig.Body[1].(uint32)
+			w.activeConnectionStateChanged(sig.Path, state, reason)
+		}
+	}
+}
+
+func (w *failureWatcher) deviceStateChanged(device dbus.ObjectPath, state, reason uint32) {
+	switch {
+	case state == nmDeviceStateFailed:
+		id, ok := w.deviceConns[device]
+		delete(w.deviceConns, device)
+		if ok {
+			w.report(id, deviceFailureReason(reason))
+		}
+	case state >= nmDeviceStatePrepare && state < nmDeviceStateActivated:
+		if _, ok := w.deviceConns[device]; ok {
+			return
+		}
+		// The active connection is cleared by the time the device has failed, so read it while activating.
+		var active dbus.ObjectPath
+		if err := w.backend.getProperty(device, nmDeviceIface, "ActiveConnection", &active); err != nil || active == "/" {
+			return
+		}
+		var id string
+		if err := w.backend.getProperty(active, nmActiveConnIface, "Id", &id); err != nil {
+			log.Debugf("failed to read connection being activated on %s: %v", device, err)
+			return
+		}
+		w.deviceConns[device] = id
+		delete(w.reported, id)
+	default:
+		delete(w.deviceConns, device)
+	}
+}
+
+func (w *failureWatcher) activeConnectionStateChanged(path dbus.ObjectPath, state, reason uint32) {
+	switch state {
+	case nmActiveConnectionStateActivating:
+		var id string
+		if err := w.backend.getProperty(path, nmActiveConnIface, "Id", &id); err != nil {
+			log.Debugf("failed to read active connection %s: %v", path, err)
+			return
+		}
+		w.activeConns[path] = id
+		delete(w.reported, id)
+	case nmActiveConnectionStateDeactivated:
+		id, ok := w.activeConns[path]
+		delete(w.activeConns, path)
+		if failureReason, failed := activeConnectionFailureReason(reason); ok && failed {
+			w.report(id, failureReason)
+		}
+	default:
+		delete(w.activeConns, path)
+	}
+}
+
+func (w *failureWatcher) report(id string, reason netmanagerclient.ConnectionFailureReason) {
+	if w.reported[id] {
+		return
+	}
+	w.reported[id] = true
+	sendConnectionFailure(w.failures, ConnectionFailure{ID: id, Reason: reason})
+}
+
+// nmcliSettingAliases maps the setting names nmcli accepts to the names NetworkManager uses over D-Bus.
+var nmcliSettingAliases = map[string]string{
+	"wifi":     "802-11-wireless",
+	"wifi-sec": "802-11-wireless-security",
+	"ethernet": "802-3-ethernet",
+}
+
+// nmcliPropertyAliases maps the bare property names nmcli accepts to their setting and property.
+var nmcliPropertyAliases = map[string]string{
+	"con-name":    "connection.id",
+	"type":        "connection.type",
+	"ifname":      "connection.interface-name",
+	"autoconnect": "connection.autoconnect",
+	"ssid":        "802-11-wireless.ssid",
+}
+
+// applyNMCliConfig converts nmcli style properties into NetworkManager settings.
+// An empty value will remove the property so NetworkManager uses the default.
+func applyNMCliConfig(settings nmSettings, config map[string]string) error {
+	for key, value := range config {
+		if alias, ok := nmcliPropertyAliases[key]; ok {
+			key = alias
+		}
+		setting, property, ok := strings.Cut(key, ".")
+		if !ok {
+			return fmt.Errorf("invalid property '%s'", key)
+		}
+		if alias, ok := nmcliSettingAliases[setting]; ok {
+			setting = alias
+		}
+		// nmcli uses 'addresses' for what is 'address-data' over D-Bus.
+		if (setting == "ipv4" || setting == "ipv6") && property == "addresses" {
+			property = "address-data"
+		}
+		if settings[setting] == nil {
+			settings[setting] = map[string]dbus.Variant{}
+		}
+		if value == "" {
+			delete(settings[setting], property)
+			continue
+		}
+		v, err := nmSettingValue(setting, property, value)
+		if err != nil {
+			return fmt.Errorf("invalid value '%s' for '%s.%s': %v", value, setting, property, err)
+		}
+		settings[setting][property] = v
+	}
+	return nil
+}
+
+// nmSettingValue converts a nmcli property value into the type NetworkManager expects for it.
+func nmSettingValue(setting, property, value string) (dbus.Variant, error) {
+	switch setting + "." + property {
+	case "802-11-wireless.ssid":
+		return dbus.MakeVariant([]byte(value)), nil
+	case "connection.autoconnect", "802-11-wireless.hidden",
+		"ipv4.ignore-auto-dns", "ipv6.ignore-auto-dns", "ipv4.never-default", "ipv6.never-default":
+		b, err := parseNMBool(value)
+		return dbus.MakeVariant(b), err
+	case "connection.auth-retries", "connection.autoconnect-priority", "connection.autoconnect-retries":
+		i, err := strconv.ParseInt(value, 10, 32)
+		return dbus.MakeVariant(int32(i)), err
+	case "802-11-wireless-security.pmf":
+		pmf, err := parseNMPMF(value)
+		return dbus.MakeVariant(pmf), err
+	case "ipv4.route-metric", "ipv6.route-metric":
+		i, err := strconv.ParseInt(value, 10, 64)
+		return dbus.MakeVariant(i), err
+	case "ipv4.address-data", "ipv6.address-data":
+		data, err := parseNMAddresses(value)
+		return dbus.MakeVariant(data), err
+	case "ipv4.dns":
+		dns, err := parseNMIPv4DNS(value)
+		return dbus.MakeVariant(dns), err
+	case "ipv6.dns":
+		dns, err := parseNMIPv6DNS(value)
+		return dbus.MakeVariant(dns), err
+	case "802-1x.eap":
+		return dbus.MakeVariant(splitNMList(value)), nil
+	case "802-1x.ca-cert":
+		// Certificates are given as a path, which NetworkManager takes as a null terminated file URI.
+		return dbus.MakeVariant([]byte("file://" + value + "\x00")), nil
+	default:
+		return dbus.MakeVariant(value), nil
+	}
+}
+
+func parseNMBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "true", "on", "1":
+		return true, nil
+	case "no", "false", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("not a boolean")
+}
+
+func parseNMPMF(value string) (int32, error) {
+	switch value {
+	case "default":
+		return 0, nil
+	case "disable":
+		return 1, nil
+	case "optional":
+		return 2, nil
+	case "required":
+		return 3, nil
+	}
+	i, err := strconv.ParseInt(value, 10, 32)
+	return int32(i), err
+}
+
+// splitNMList splits a nmcli list value, these can be separated by commas or spaces.
+func splitNMList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+func parseNMAddresses(value string) ([]map[string]dbus.Variant, error) {
+	data := []map[string]dbus.Variant{}
+	for _, addr := range splitNMList(value) {
+		ip, ipNet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, err
+		}
+		prefix, _ := ipNet.Mask.Size()
+		data = append(data, map[string]dbus.Variant{
+			"address": dbus.MakeVariant(ip.String()),
+			"prefix":  dbus.MakeVariant(uint32(prefix)),
+		})
+	}
+	return data, nil
+}
+
+// parseNMIPv4DNS converts the DNS servers to the in_addr_t values NetworkManager uses.
+func parseNMIPv4DNS(value string) ([]uint32, error) {
+	dns := []uint32{}
+	for _, s := range splitNMList(value) {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("'%s' is not an IPv4 address", s)
+		}
+		dns = append(dns, binary.LittleEndian.Uint32(ip))
+	}
+	return dns, nil
+}
+
+func parseNMIPv6DNS(value string) ([][]byte, error) {
+	dns := [][]byte{}
+	for _, s := range splitNMList(value) {
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("'%s' is not an IPv6 address", s)
+		}
+		dns = append(dns, []byte(ip.To16()))
+	}
+	return dns, nil
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const privateBusConfig = `<busconfig>
+  <type>session</type>
+  <listen>unix:dir=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>`
+
+// startPrivateBus starts a dbus-daemon for the test and returns its address.
+// The test is skipped if dbus-daemon isn't installed.
+func startPrivateBus(t *testing.T) string {
+	t.Helper()
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "bus.conf")
+	require.NoError(t, os.WriteFile(configFile, []byte(fmt.Sprintf(privateBusConfig, dir)), 0644))
+
+	cmd := exec.Command(daemon, "--config-file="+configFile, "--print-address", "--nofork")
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	require.NoError(t, err)
+	return strings.TrimSpace(address)
+}
+
+func connectPrivateBus(t *testing.T, address string) *dbus.Conn {
+	t.Helper()
+	conn, err := dbus.Connect(address)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+const (
+	fakeNMDevice      = dbus.ObjectPath("/org/freedesktop/NetworkManager/Devices/1")
+	fakeNMAccessPoint = dbus.ObjectPath("/org/freedesktop/NetworkManager/AccessPoint/1")
+	fakeNMOpenAP      = dbus.ObjectPath("/org/freedesktop/NetworkManager/AccessPoint/2")
+)
+
+// fakeNMObjects is how many connection, active connection and IP4Config objects the fake exports.
+// These are all exported up front as exporting objects from a method call races in godbus.
+const fakeNMObjects = 8
+
+// fakeNM exports a minimal NetworkManager on a private bus.
+type fakeNM struct {
+	mu          sync.Mutex
+	conn        *dbus.Conn
+	props       *prop.Properties
+	deviceProps *prop.Properties
+	connections map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+	active      map[dbus.ObjectPath]dbus.ObjectPath // Active connection path to connection path.
+	activeProps map[dbus.ObjectPath]*prop.Properties
+	ip4Props    map[dbus.ObjectPath]*prop.Properties
+	ip6Props    map[dbus.ObjectPath]*prop.Properties
+	nextConn    int
+	nextActive  int
+	deviceIP    string
+	deviceIP6   string
+	scans       [][][]byte // SSIDs probed for by each scan.
+}
+
+func startFakeNM(t *testing.T, address string) *fakeNM {
+	t.Helper()
+	nm := &fakeNM{
+		conn:        connectPrivateBus(t, address),
+		connections: map[dbus.ObjectPath]map[string]map[string]dbus.Variant{},
+		active:      map[dbus.ObjectPath]dbus.ObjectPath{},
+		activeProps: map[dbus.ObjectPath]*prop.Properties{},
+		ip4Props:    map[dbus.ObjectPath]*prop.Properties{},
+		ip6Props:    map[dbus.ObjectPath]*prop.Properties{},
+		deviceIP:    "192.168.1.20",
+	}
+	reply, err := nm.conn.RequestName(nmDest, dbus.NameFlagDoNotQueue)
+	require.NoError(t, err)
+	require.Equal(t, dbus.RequestNameReplyPrimaryOwner, reply)
+
+	nm.props, err = prop.Export(nm.conn, nmPath, prop.Map{
+		nmDest: {
+			"WirelessEnabled":   {Value: true, Writable: true, Emit: prop.EmitTrue},
+			"ActiveConnections": {Value: []dbus.ObjectPath{}, Emit: prop.EmitTrue},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, nm.conn.Export(fakeNMRoot{nm}, nmPath, nmDest))
+	require.NoError(t, nm.conn.Export(fakeNMSettings{nm}, nmSettingsPath, nmSettingsIface))
+	nm.deviceProps, err = prop.Export(nm.conn, fakeNMDevice, prop.Map{
+		nmDeviceIface:         {"ActiveConnection": {Value: dbus.ObjectPath("/")}},
+		nmDeviceWirelessIface: {"ActiveAccessPoint": {Value: fakeNMAccessPoint}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, nm.conn.Export(fakeNMWireless{nm}, fakeNMDevice, nmDeviceWirelessIface))
+	_, err = prop.Export(nm.conn, fakeNMAccessPoint, prop.Map{
+		nmAccessPointIface: {
+			"Ssid":       {Value: []byte("home")},
+			"HwAddress":  {Value: "70:A7:41:DC:64:21"},
+			"Frequency":  {Value: uint32(5180)},
+			"MaxBitrate": {Value: uint32(540000)},
+			"Flags":      {Value: uint32(nmAPFlagsPrivacy)},
+			"WpaFlags":   {Value: uint32(0)},
+			"RsnFlags":   {Value: uint32(0x188 | nmAPSecKeyMgmtPSK | nmAPSecKeyMgmtSAE)},
+			"Strength":   {Value: byte(67)},
+		},
+	})
+	require.NoError(t, err)
+	_, err = prop.Export(nm.conn, fakeNMOpenAP, prop.Map{
+		nmAccessPointIface: {
+			"Ssid":       {Value: []byte("Caf\xe9")},
+			"HwAddress":  {Value: "70:A7:41:DC:64:22"},
+			"Frequency":  {Value: uint32(2412)},
+			"MaxBitrate": {Value: uint32(54000)},
+			"Flags":      {Value: uint32(0)},
+			"WpaFlags":   {Value: uint32(0)},
+			"RsnFlags":   {Value: uint32(0)},
+			"Strength":   {Value: byte(80)},
+		},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < fakeNMObjects; i++ {
+		path := fakeNMPath("Settings", i)
+		require.NoError(t, nm.conn.Export(fakeNMConnection{nm, path}, path, nmSettingsConnIface))
+		path = fakeNMPath("ActiveConnection", i)
+		nm.activeProps[path], err = prop.Export(nm.conn, path, prop.Map{
+			nmActiveConnIface: {
+				"Id":        {Value: ""},
+				"Type":      {Value: ""},
+				"State":     {Value: uint32(0)},
+				"Ip4Config": {Value: dbus.ObjectPath("/")},
+				"Ip6Config": {Value: dbus.ObjectPath("/")},
+			},
+		})
+		require.NoError(t, err)
+		path = fakeNMPath("IP4Config", i)
+		nm.ip4Props[path], err = prop.Export(nm.conn, path, prop.Map{
+			nmIP4ConfigIface: {"AddressData": {Value: []map[string]dbus.Variant{}}},
+		})
+		require.NoError(t, err)
+		path = fakeNMPath("IP6Config", i)
+		nm.ip6Props[path], err = prop.Export(nm.conn, path, prop.Map{
+			nmIP6ConfigIface: {"AddressData": {Value: []map[string]dbus.Variant{}}},
+		})
+		require.NoError(t, err)
+	}
+	return nm
+}
+
+func fakeNMPath(kind string, i int) dbus.ObjectPath {
+	return dbus.ObjectPath(fmt.Sprintf("%s/%s/%d", nmPath, kind, i))
+}
+
+func (nm *fakeNM) settings(id string) map[string]map[string]dbus.Variant {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	for _, s := range nm.connections {
+		if s["connection"]["id"].Value() == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func (nm *fakeNM) getScans() [][][]byte {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	return append([][][]byte{}, nm.scans...)
+}
+
+func (nm *fakeNM) activePaths() []dbus.ObjectPath {
+	paths := []dbus.ObjectPath{}
+	for path := range nm.active {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+type fakeNMRoot struct{ nm *fakeNM }
+
+func (r fakeNMRoot) ActivateConnection(conn, device, specific dbus.ObjectPath) (dbus.ObjectPath, *dbus.Error) {
+	nm := r.nm
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	settings, ok := nm.connections[conn]
+	if !ok {
+		return "", dbus.MakeFailedError(fmt.Errorf("unknown connection %s", conn))
+	}
+	activePath := fakeNMPath("ActiveConnection", nm.nextActive)
+	ip4Path := fakeNMPath("IP4Config", nm.nextActive)
+	ip6Path := fakeNMPath("IP6Config", nm.nextActive)
+	nm.nextActive = (nm.nextActive + 1) % fakeNMObjects
+	nm.ip4Props[ip4Path].SetMust(nmIP4ConfigIface, "AddressData", []map[string]dbus.Variant{{
+		"address": dbus.MakeVariant(nm.deviceIP),
+		"prefix":  dbus.MakeVariant(uint32(24)),
+	}})
+	// The link-local address is always there, so isn't a sign of being connected.
+	ip6Addresses := []map[string]dbus.Variant{{
+		"address": dbus.MakeVariant("fe80::1"),
+		"prefix":  dbus.MakeVariant(uint32(64)),
+	}}
+	if nm.deviceIP6 != "" {
+		ip6Addresses = append(ip6Addresses, map[string]dbus.Variant{
+			"address": dbus.MakeVariant(nm.deviceIP6),
+			"prefix":  dbus.MakeVariant(uint32(64)),
+		})
+	}
+	nm.ip6Props[ip6Path].SetMust(nmIP6ConfigIface, "AddressData", ip6Addresses)
+	props := nm.activeProps[activePath]
+	props.SetMust(nmActiveConnIface, "Id", settings["connection"]["id"].Value())
+	props.SetMust(nmActiveConnIface, "Type", settings["connection"]["type"].Value())
+	props.SetMust(nmActiveConnIface, "State", uint32(nmActiveConnectionStateActivated))
+	props.SetMust(nmActiveConnIface, "Ip4Config", ip4Path)
+	props.SetMust(nmActiveConnIface, "Ip6Config", ip6Path)
+	nm.active[activePath] = conn
+	nm.props.SetMust(nmDest, "ActiveConnections", nm.activePaths())
+	return activePath, nil
+}
+
+func (r fakeNMRoot) DeactivateConnection(active dbus.ObjectPath) *dbus.Error {
+	nm := r.nm
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if _, ok := nm.active[active]; !ok {
+		return dbus.MakeFailedError(fmt.Errorf("not active"))
+	}
+	delete(nm.active, active)
+	nm.props.SetMust(nmDest, "ActiveConnections", nm.activePaths())
+	return nil
+}
+
+func (r fakeNMRoot) GetDeviceByIpIface(iface string) (dbus.ObjectPath, *dbus.Error) {
+	if iface != "wlan0" {
+		return "", dbus.MakeFailedError(fmt.Errorf("no device %s", iface))
+	}
+	return fakeNMDevice, nil
+}
+
+type fakeNMWireless struct{ nm *fakeNM }
+
+func (w fakeNMWireless) RequestScan(options map[string]dbus.Variant) *dbus.Error {
+	w.nm.mu.Lock()
+	defer w.nm.mu.Unlock()
+	var ssids [][]byte
+	if v, ok := options["ssids"]; ok {
+		if err := v.Store(&ssids); err != nil {
+			return dbus.MakeFailedError(err)
+		}
+	}
+	w.nm.scans = append(w.nm.scans, ssids)
+	return nil
+}
+
+func (w fakeNMWireless) GetAllAccessPoints() ([]dbus.ObjectPath, *dbus.Error) {
+	return []dbus.ObjectPath{fakeNMAccessPoint, fakeNMOpenAP}, nil
+}
+
+type fakeNMSettings struct{ nm *fakeNM }
+
+func (s fakeNMSettings) ListConnections() ([]dbus.ObjectPath, *dbus.Error) {
+	s.nm.mu.Lock()
+	defer s.nm.mu.Unlock()
+	paths := []dbus.ObjectPath{}
+	for path := range s.nm.connections {
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func (s fakeNMSettings) AddConnection(settings map[string]map[string]dbus.Variant) (dbus.ObjectPath, *dbus.Error) {
+	nm := s.nm
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if _, ok := settings["connection"]["uuid"]; !ok {
+		return "", dbus.MakeFailedError(fmt.Errorf("connection.uuid: property is missing"))
+	}
+	if nm.nextConn >= fakeNMObjects {
+		return "", dbus.MakeFailedError(fmt.Errorf("too many connections"))
+	}
+	path := fakeNMPath("Settings", nm.nextConn)
+	nm.nextConn++
+	nm.connections[path] = settings
+	return path, nil
+}
+
+type fakeNMConnection struct {
+	nm   *fakeNM
+	path dbus.ObjectPath
+}
+
+func (c fakeNMConnection) GetSettings() (map[string]map[string]dbus.Variant, *dbus.Error) {
+	c.nm.mu.Lock()
+	defer c.nm.mu.Unlock()
+	settings := map[string]map[string]dbus.Variant{}
+	for setting, props := range c.nm.connections[c.path] {
+		settings[setting] = map[string]dbus.Variant{}
+		for k, v := range props {
+			if k != "psk" {
+				settings[setting][k] = v
+			}
+		}
+	}
+	return settings, nil
+}
+
+func (c fakeNMConnection) GetSecrets(setting string) (map[string]map[string]dbus.Variant, *dbus.Error) {
+	c.nm.mu.Lock()
+	defer c.nm.mu.Unlock()
+	secrets := map[string]map[string]dbus.Variant{setting: {}}
+	if psk, ok := c.nm.connections[c.path][setting]["psk"]; ok {
+		secrets[setting]["psk"] = psk
+	}
+	return secrets, nil
+}
+
+func (c fakeNMConnection) Update(settings map[string]map[string]dbus.Variant) *dbus.Error {
+	c.nm.mu.Lock()
+	defer c.nm.mu.Unlock()
+	c.nm.connections[c.path] = settings
+	return nil
+}
+
+func (c fakeNMConnection) Delete() *dbus.Error {
+	c.nm.mu.Lock()
+	defer c.nm.mu.Unlock()
+	delete(c.nm.connections, c.path)
+	return nil
+}
+
+func TestNMDbusBackend(t *testing.T) {
+	address := startPrivateBus(t)
+	nm := startFakeNM(t, address)
+	b := &nmDbusBackend{conn: connectPrivateBus(t, address)}
+
+	// Creating a new connection.
+	require.NoError(t, b.ModifyConnection("home", map[string]string{
+		"connection.type":                 "802-11-wireless",
+		"connection.autoconnect-priority": "5",
+		"wifi.ssid":                       "home",
+		"wifi-sec.key-mgmt":               "wpa-psk",
+		"wifi-sec.psk":                    "password",
+		"ipv4.route-metric":               "10",
+	}))
+	settings := nm.settings("home")
+	require.NotNil(t, settings)
+	assert.Equal(t, []byte("home"), settings["802-11-wireless"]["ssid"].Value())
+	assert.Equal(t, "password", settings["802-11-wireless-security"]["psk"].Value())
+	assert.Equal(t, int32(5), settings["connection"]["autoconnect-priority"].Value())
+	assert.Equal(t, int64(10), settings["ipv4"]["route-metric"].Value())
+
+	// Modifying it keeps the secrets and the other settings.
+	require.NoError(t, b.ModifyConnection("home", map[string]string{"connection.auth-retries": "1"}))
+	settings = nm.settings("home")
+	assert.Equal(t, int32(1), settings["connection"]["auth-retries"].Value())
+	assert.Equal(t, "password", settings["802-11-wireless-security"]["psk"].Value())
+	assert.Equal(t, []byte("home"), settings["802-11-wireless"]["ssid"].Value())
+
+	ids, err := b.SavedWifiConnections()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"home"}, ids)
+
+	// Hidden networks.
+	ssids, err := b.HiddenWifiSSIDs()
+	require.NoError(t, err)
+	assert.Empty(t, ssids)
+	require.NoError(t, b.ModifyConnection("home", map[string]string{"802-11-wireless.hidden": "yes"}))
+	ssids, err = b.HiddenWifiSSIDs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"home"}, ssids)
+	require.NoError(t, b.RequestWifiScan("wlan0", ssids))
+	assert.Equal(t, [][][]byte{{[]byte("home")}}, nm.getScans())
+	assert.Error(t, b.RequestWifiScan("eth0", ssids))
+
+	// Radio.
+	enabled, err := b.WifiRadioEnabled()
+	require.NoError(t, err)
+	assert.True(t, enabled)
+	require.NoError(t, b.SetWifiRadio(false))
+	enabled, err = b.WifiRadioEnabled()
+	require.NoError(t, err)
+	assert.False(t, enabled)
+
+	// Activating and deactivating.
+	assert.Error(t, b.ConnectionUp("unknown"))
+	require.NoError(t, b.ConnectionUp("home"))
+	conns, err := b.ActiveConnections()
+	require.NoError(t, err)
+	assert.Equal(t, []ActiveConnection{{Type: "802-11-wireless", Name: "home"}}, conns)
+	ip, err := b.ConnectionIP4Address("home")
+	require.NoError(t, err)
+	assert.Equal(t, "192.168.1.20/24", ip)
+
+	bssid, err := b.ActiveBSSID("wlan0")
+	require.NoError(t, err)
+	assert.Equal(t, "70:A7:41:DC:64:21", bssid)
+	signal, err := b.ActiveSignalStrength("wlan0")
+	require.NoError(t, err)
+	assert.Equal(t, 67, signal)
+
+	aps, err := b.WifiAccessPoints("wlan0")
+	require.NoError(t, err)
+	assert.Equal(t, []netmanagerclient.AccessPoint{
+		{
+			BSSID:         "70:A7:41:DC:64:21",
+			SSID:          "home",
+			RawSSID:       netmanagerclient.SSID("home"),
+			Channel:       36,
+			Band:          netmanagerclient.BAND_5GHZ,
+			Frequency:     5180,
+			Security:      netmanagerclient.SECURITY_WPA2_WPA3,
+			SecurityFlags: []string{"WPA2", "WPA3"},
+			MaxBitrate:    540,
+			Signal:        67,
+			InUse:         true,
+		},
+		{
+			BSSID:      "70:A7:41:DC:64:22",
+			SSID:       `Caf\xe9`,
+			RawSSID:    netmanagerclient.SSID("Caf\xe9"),
+			Channel:    1,
+			Band:       netmanagerclient.BAND_2_4GHZ,
+			Frequency:  2412,
+			Security:   netmanagerclient.SECURITY_OPEN,
+			MaxBitrate: 54,
+			Signal:     80,
+		},
+	}, aps)
+
+	require.NoError(t, b.ConnectionDown("home"))
+	conns, err = b.ActiveConnections()
+	require.NoError(t, err)
+	assert.Empty(t, conns)
+	ip, err = b.ConnectionIP4Address("home")
+	require.NoError(t, err)
+	assert.Equal(t, "", ip)
+	assert.Error(t, b.ConnectionDown("home"))
+
+	// Only global IPv6 addresses are used.
+	require.NoError(t, b.ConnectionUp("home"))
+	ip, err = b.ConnectionIP6Address("home")
+	require.NoError(t, err)
+	assert.Equal(t, "", ip)
+	require.NoError(t, b.ConnectionDown("home"))
+	nm.mu.Lock()
+	nm.deviceIP6 = "2001:db8::5"
+	nm.mu.Unlock()
+	require.NoError(t, b.ConnectionUp("home"))
+	ip, err = b.ConnectionIP6Address("home")
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::5/64", ip)
+
+	// Deleting.
+	require.NoError(t, b.ModifyConnection("old", map[string]string{"connection.type": "802-11-wireless", "wifi.ssid": "old"}))
+	require.NoError(t, b.DeleteConnection("old"))
+	ids, err = b.SavedWifiConnections()
+	require.NoError(t, err)
+	assert.NotContains(t, ids, "old")
+	assert.Contains(t, ids, "home")
+	assert.Error(t, b.DeleteConnection("old"))
+}
+
+func TestNMDbusBackendConnectionFailures(t *testing.T) {
+	address := startPrivateBus(t)
+	nm := startFakeNM(t, address)
+	b := &nmDbusBackend{conn: connectPrivateBus(t, address)}
+	failures := b.ConnectionFailures()
+
+	active := fakeNMPath("ActiveConnection", 0)
+	nm.activeProps[active].SetMust(nmActiveConnIface, "Id", "home")
+	nm.deviceProps.SetMust(nmDeviceIface, "ActiveConnection", active)
+	emit := func(path dbus.ObjectPath, name string, args ...interface{}) {
+		require.NoError(t, nm.conn.Emit(path, name, args...))
+	}
+	nextFailure := func() ConnectionFailure {
+		select {
+		case f := <-failures:
+			return f
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for connection failure")
+			return ConnectionFailure{}
+		}
+	}
+
+	// The device failing gives the reason, the connection then being deactivated isn't reported again.
+	emit(active, nmActiveConnIface+".StateChanged", uint32(nmActiveConnectionStateActivating), uint32(0))
+	emit(fakeNMDevice, nmDeviceIface+".StateChanged", uint32(nmDeviceStatePrepare), uint32(30), uint32(0))
+	emit(fakeNMDevice, nmDeviceIface+".StateChanged", uint32(60), uint32(nmDeviceStatePrepare), uint32(0))
+	emit(fakeNMDevice, nmDeviceIface+".StateChanged", uint32(nmDeviceStateFailed), uint32(60), uint32(nmDeviceReasonNoSecrets))
+	emit(active, nmActiveConnIface+".StateChanged", uint32(nmActiveConnectionStateDeactivated), uint32(nmActiveReasonNoSecrets))
+	assert.Equal(t, ConnectionFailure{ID: "home", Reason: netmanagerclient.FAILURE_BAD_SECRETS}, nextFailure())
+
+	// A failure that doesn't fail the device.
+	emit(active, nmActiveConnIface+".StateChanged", uint32(nmActiveConnectionStateActivating), uint32(0))
+	emit(active, nmActiveConnIface+".StateChanged", uint32(nmActiveConnectionStateDeactivated), uint32(nmActiveReasonConnectTimeout))
+	assert.Equal(t, ConnectionFailure{ID: "home", Reason: netmanagerclient.FAILURE_SUPPLICANT_TIMEOUT}, nextFailure())
+
+	// Disconnecting an activated connection isn't a failure.
+	emit(active, nmActiveConnIface+".StateChanged", uint32(nmActiveConnectionStateActivating), uint32(0))
+	emit(active, nmActiveConnIface+".StateChanged", uint32(nmActiveConnectionStateActivated), uint32(0))
+	emit(active, nmActiveConnIface+".StateChanged", uint32(nmActiveConnectionStateDeactivated), uint32(nmActiveReasonNoSecrets))
+	emit(fakeNMDevice, nmDeviceIface+".StateChanged", uint32(nmDeviceStateFailed), uint32(nmDeviceStateActivated), uint32(nmDeviceReasonSSIDNotFound))
+	select {
+	case f := <-failures:
+		t.Fatalf("unexpected failure %+v", f)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestApplyNMCliConfig(t *testing.T) {
+	settings := nmSettings{}
+	require.NoError(t, applyNMCliConfig(settings, map[string]string{
+		"ifname":                       "wlan0",
+		"autoconnect":                  "no",
+		"ssid":                         "bushnet",
+		"802-11-wireless-security.pmf": "disable",
+		"ipv4.addresses":               "192.168.4.1/24",
+		"ipv4.dns":                     "1.1.1.1,8.8.8.8",
+		"802-1x.eap":                   "peap",
+		"802-1x.ca-cert":               "/var/lib/rpi-net-manager/certs/ca.pem",
+	}))
+	assert.Equal(t, "wlan0", settings["connection"]["interface-name"].Value())
+	assert.Equal(t, false, settings["connection"]["autoconnect"].Value())
+	assert.Equal(t, []byte("bushnet"), settings["802-11-wireless"]["ssid"].Value())
+	assert.Equal(t, int32(1), settings["802-11-wireless-security"]["pmf"].Value())
+	assert.Equal(t, []map[string]dbus.Variant{{
+		"address": dbus.MakeVariant("192.168.4.1"),
+		"prefix":  dbus.MakeVariant(uint32(24)),
+	}}, settings["ipv4"]["address-data"].Value())
+	assert.Equal(t, []uint32{0x01010101, 0x08080808}, settings["ipv4"]["dns"].Value())
+	assert.Equal(t, []string{"peap"}, settings["802-1x"]["eap"].Value())
+	assert.Equal(t, []byte("file:///var/lib/rpi-net-manager/certs/ca.pem\x00"), settings["802-1x"]["ca-cert"].Value())
+
+	// Empty values reset the property.
+	require.NoError(t, applyNMCliConfig(settings, map[string]string{"autoconnect": ""}))
+	assert.NotContains(t, settings["connection"], "autoconnect")
+
+	assert.Error(t, applyNMCliConfig(settings, map[string]string{"autoconnect": "maybe"}))
+	assert.Error(t, applyNMCliConfig(settings, map[string]string{"ipv4.addresses": "192.168.4.1"}))
+	assert.Error(t, applyNMCliConfig(settings, map[string]string{"noproperty": "1"}))
+}
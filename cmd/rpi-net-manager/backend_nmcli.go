@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+	"github.com/TheCacophonyProject/rpi-net-manager/nmcli"
+)
+
+// nmcliBackend implements NetworkBackend by running nmcli.
+type nmcliBackend struct{}
+
+func (nmcliBackend) WifiRadioEnabled() (bool, error) {
+	out, err := exec.Command("nmcli", "radio", "wifi").CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("error getting wifi radio state %s, err: %s", out, err)
+	}
+	radioState := strings.TrimSpace(string(out))
+	switch radioState {
+	case "enabled":
+		return true, nil
+	case "disabled":
+		return false, nil
+	default:
+		return false, fmt.Errorf("unknown radio state '%s'", radioState)
+	}
+}
+
+func (nmcliBackend) SetWifiRadio(enabled bool) error {
+	if enabled {
+		return runNMCli("radio", "wifi", "on")
+	}
+	return runNMCli("radio", "wifi", "off")
+}
+
+func (nmcliBackend) ActiveConnections() ([]ActiveConnection, error) {
+	out, err := exec.Command("nmcli", "--terse", "--fields", "TYPE,NAME", "connection", "show", "--active").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("error running list of active connections %s, err: %s", out, err)
+	}
+	rows, err := nmcli.ParseRows(string(out), 2)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse active connections: %v", err)
+	}
+	conns := []ActiveConnection{}
+	for _, row := range rows {
+		conns = append(conns, ActiveConnection{Type: row[0], Name: row[1]})
+	}
+	return conns, nil
+}
+
+func (nmcliBackend) ConnectionIP4Address(id string) (string, error) {
+	out, err := exec.Command("nmcli", "--terse", "--fields", "IP4.ADDRESS", "connection", "show", id).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("error checking ip address of connection: %s, err: %s", out, err)
+	}
+	return getAddressFromOutput(string(out), false)
+}
+
+func (nmcliBackend) ConnectionIP6Address(id string) (string, error) {
+	out, err := exec.Command("nmcli", "--terse", "--fields", "IP6.ADDRESS", "connection", "show", id).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("error checking ip address of connection: %s, err: %s", out, err)
+	}
+	return getAddressFromOutput(string(out), true)
+}
+
+// getAddressFromOutput gets the first address from the IP4.ADDRESS or IP6.ADDRESS output of 'nmcli connection show'.
+// A connection with static addresses has a line for each, e.g. 'IP4.ADDRESS[2]:10.0.0.5/8'.
+func getAddressFromOutput(output string, ipv6 bool) (string, error) {
+	fields, err := nmcli.ParseMultiline(output)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse ip address of connection: %v", err)
+	}
+	for _, field := range fields {
+		address := strings.TrimSpace(field.Value)
+		if address == "" {
+			continue
+		}
+		if ip, _, err := net.ParseCIDR(address); ipv6 && (err != nil || ip.IsLinkLocalUnicast()) {
+			continue
+		}
+		return address, nil
+	}
+	return "", nil
+}
+
+func (nmcliBackend) ConnectionUp(id string) error {
+	return runNMCli("connection", "up", id)
+}
+
+func (nmcliBackend) ConnectionDown(id string) error {
+	return runNMCli("connection", "down", id)
+}
+
+func (nmcliBackend) ModifyConnection(id string, config map[string]string) error {
+	return netmanagerclient.ModifyNetworkConfig(id, config)
+}
+
+func (nmcliBackend) DeleteConnection(id string) error {
+	return runNMCli("connection", "delete", id)
+}
+
+func (nmcliBackend) SavedWifiConnections() ([]string, error) {
+	out, err := exec.Command("nmcli", "--terse", "--fields", "TYPE,NAME", "connection", "show").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list saved connections: %v, output: %s", err, out)
+	}
+	rows, err := nmcli.ParseRows(string(out), 2)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse saved connections: %v", err)
+	}
+	ids := []string{}
+	for _, row := range rows {
+		if row[0] == "802-11-wireless" {
+			ids = append(ids, row[1])
+		}
+	}
+	return ids, nil
+}
+
+func (b nmcliBackend) HiddenWifiSSIDs() ([]string, error) {
+	ids, err := b.SavedWifiConnections()
+	if err != nil {
+		return nil, err
+	}
+	ssids := []string{}
+	for _, id := range ids {
+		out, err := exec.Command("nmcli", "--terse", "--get-values",
+			"802-11-wireless.hidden,802-11-wireless.mode,802-11-wireless.ssid", "connection", "show", id).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read connection '%s': %v, output: %s", id, err, out)
+		}
+		values := nmcli.ParseValues(string(out))
+		if len(values) == 3 && values[0] == "yes" && values[1] != "ap" && values[2] != "" {
+			ssids = append(ssids, values[2])
+		}
+	}
+	return ssids, nil
+}
+
+func (nmcliBackend) RequestWifiScan(ifname string, ssids []string) error {
+	args := []string{"device", "wifi", "rescan", "ifname", ifname}
+	for _, ssid := range ssids {
+		args = append(args, "ssid", ssid)
+	}
+	return runNMCli(args...)
+}
+
+func (nmcliBackend) WifiAccessPoints(ifname string) ([]netmanagerclient.AccessPoint, error) {
+	return netmanagerclient.NmcliAccessPoints(ifname, false)
+}
+
+func (nmcliBackend) ActiveBSSID(ifname string) (string, error) {
+	out, err := exec.Command("nmcli", "--terse", "--fields", "AP.BSSID,AP.IN-USE", "device", "show", ifname).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to run nmcli: %v, output: %s", err, out)
+	}
+	return getActiveBSSIDFromOutput(string(out))
+}
+
+func (nmcliBackend) ActiveSignalStrength(ifname string) (int, error) {
+	out, err := exec.Command("nmcli", "--terse", "--fields", "AP.SIGNAL,AP.IN-USE", "device", "show", ifname).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("failed to run nmcli: %v, output: %s", err, out)
+	}
+	signal, err := getActiveAPFieldFromOutput(string(out), "SIGNAL")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(signal)
+}
+
+// ConnectionFailures watches NetworkManager over D-Bus, as nmcli doesn't report why a connection failed.
+func (nmcliBackend) ConnectionFailures() <-chan ConnectionFailure {
+	b, err := newNMDbusBackend()
+	if err != nil {
+		log.Printf("Failed to connect to System Bus, connection failures won't be detected: %v", err)
+		return make(chan ConnectionFailure)
+	}
+	return b.ConnectionFailures()
+}
+
+func getActiveBSSIDFromOutput(output string) (string, error) {
+	return getActiveAPFieldFromOutput(output, "BSSID")
+}
+
+// getActiveAPFieldFromOutput finds the field of the access point that is in use from the output of 'nmcli device show'.
+func getActiveAPFieldFromOutput(output, field string) (string, error) {
+	fields, err := nmcli.ParseMultiline(output)
+	if err != nil {
+		return "", err
+	}
+	inUseAPID := ""
+	for _, f := range fields {
+		if strings.HasSuffix(f.Name, ".IN-USE") && f.Value == "*" {
+			inUseAPID, _, _ = strings.Cut(f.Name, ".")
+			break
+		}
+	}
+
+	if inUseAPID == "" {
+		return "", fmt.Errorf("no active AP found")
+	}
+
+	for _, f := range fields {
+		if f.Name == inUseAPID+"."+field {
+			return f.Value, nil
+		}
+	}
+
+	return "", fmt.Errorf("no %s found", field)
+}
+
+func runNMCli(args ...string) error {
+	out, err := exec.Command("nmcli", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to run nmcli: %v, output: %s", err, out)
+	}
+	return nil
+}
+
+// dnsmasq implements dhcpServer by writing /etc/dnsmasq.conf and managing the dnsmasq service.
+type dnsmasq struct{}
+
+func (dnsmasq) Start(hotspot Hotspot) error {
+	if err := createDNSConfig(hotspot); err != nil {
+		return err
+	}
+	log.Printf("Starting DNS...")
+	return exec.Command("systemctl", "restart", "dnsmasq").Run()
+}
+
+func (dnsmasq) Stop() error {
+	log.Println("Stopping dnsmasq")
+	return exec.Command("systemctl", "stop", "dnsmasq").Run()
+}
+
+func createDNSConfig(hotspot Hotspot) error {
+	file_name := "/etc/dnsmasq.conf"
+	return createConfigFile(file_name, dnsmasqConfigLines(hotspot))
+}
+
+func dnsmasqConfigLines(hotspot Hotspot) []string {
+	config_lines := []string{
+		"interface=wlan0",
+		"dhcp-range=" + hotspot.DHCPRangeStart + "," + hotspot.DHCPRangeEnd + ",12h",
+		"domain=wlan",
+	}
+	for _, server := range hotspot.DNSServers {
+		config_lines = append(config_lines, "server="+server)
+	}
+	return config_lines
+}
+
+func createConfigFile(name string, config []string) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	for _, line := range config {
+		_, err = fmt.Fprintln(w, line)
+		if err != nil {
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+)
+
+const HotspotKey = "hotspot"
+
+// Hotspot is the configuration for the hotspot the device hosts.
+type Hotspot struct {
+	SSID           string   `mapstructure:"ssid"`
+	PSK            string   `mapstructure:"psk"`
+	RouterIP       string   `mapstructure:"router-ip"`
+	PrefixLength   int      `mapstructure:"prefix-length"`
+	DHCPRangeStart string   `mapstructure:"dhcp-range-start"`
+	DHCPRangeEnd   string   `mapstructure:"dhcp-range-end"`
+	DNSServers     []string `mapstructure:"dns-servers"`
+}
+
+func DefaultHotspot() Hotspot {
+	return Hotspot{
+		SSID:           "bushnet",
+		PSK:            "feathers",
+		RouterIP:       "192.168.4.1",
+		PrefixLength:   24,
+		DHCPRangeStart: "192.168.4.2",
+		DHCPRangeEnd:   "192.168.4.20",
+		DNSServers:     []string{"1.1.1.1", "8.8.8.8"},
+	}
+}
+
+func (h Hotspot) Validate() error {
+	if err := validateSSID(h.SSID); err != nil {
+		return err
+	}
+	if err := validatePSK(h.PSK); err != nil {
+		return err
+	}
+	if h.PrefixLength < 8 || h.PrefixLength > 30 {
+		return fmt.Errorf("prefix-length must be between 8 and 30, got %d", h.PrefixLength)
+	}
+	routerIP := net.ParseIP(h.RouterIP).To4()
+	if routerIP == nil {
+		return fmt.Errorf("router-ip '%s' is not an IPv4 address", h.RouterIP)
+	}
+	subnet := net.IPNet{IP: routerIP.Mask(net.CIDRMask(h.PrefixLength, 32)), Mask: net.CIDRMask(h.PrefixLength, 32)}
+	start := net.ParseIP(h.DHCPRangeStart).To4()
+	end := net.ParseIP(h.DHCPRangeEnd).To4()
+	if start == nil || !subnet.Contains(start) {
+		return fmt.Errorf("dhcp-range-start '%s' is not an address in %s", h.DHCPRangeStart, subnet.String())
+	}
+	if end == nil || !subnet.Contains(end) {
+		return fmt.Errorf("dhcp-range-end '%s' is not an address in %s", h.DHCPRangeEnd, subnet.String())
+	}
+	if bytes.Compare(start, end) > 0 {
+		return errors.New("dhcp-range-start is after dhcp-range-end")
+	}
+	if bytes.Compare(start, routerIP) <= 0 && bytes.Compare(routerIP, end) <= 0 {
+		return errors.New("router-ip is inside the DHCP range")
+	}
+	if start.Equal(subnet.IP) || end.Equal(broadcastAddress(subnet)) {
+		return errors.New("DHCP range can't include the network or broadcast address")
+	}
+	for _, dns := range h.DNSServers {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("dns server '%s' is not an IP address", dns)
+		}
+	}
+	return nil
+}
+
+// RouterAddress returns the router IP with the prefix length, e.g. 192.168.4.1/24
+func (h Hotspot) RouterAddress() string {
+	return fmt.Sprintf("%s/%d", h.RouterIP, h.PrefixLength)
+}
+
+// QR is the Wi-Fi QR code for joining the hotspot.
+func (h Hotspot) QR() netmanagerclient.WifiQR {
+	return netmanagerclient.WifiQR{SSID: h.SSID, Security: netmanagerclient.SECURITY_WPA2_PSK, PSK: h.PSK}
+}
+
+const BushnetKey = "bushnet"
+
+// Bushnet is the configuration for the networks the device will connect to when a field phone hosts a hotspot.
+type Bushnet struct {
+	SSIDs []string `mapstructure:"ssids"`
+	PSK   string   `mapstructure:"psk"`
+}
+
+func DefaultBushnet() Bushnet {
+	return Bushnet{
+		SSIDs: []string{"bushnet", "Bushnet"},
+		PSK:   "feathers",
+	}
+}
+
+func (b Bushnet) Validate() error {
+	for _, ssid := range b.SSIDs {
+		if err := validateSSID(ssid); err != nil {
+			return err
+		}
+	}
+	return validatePSK(b.PSK)
+}
+
+const PolicyKey = "network-policy"
+
+// Policy is the timing and fallback policy of the state machine.
+// A duration of 0 disables that timeout.
+type Policy struct {
+	// How long to scan for and try connecting to networks before turning the wifi radio off.
+	ScanConnectTimeout time.Duration `mapstructure:"scan-connect-timeout" json:"scanConnectTimeout"`
+	// If the hotspot should be started when no network is found.
+	HotspotFallback bool `mapstructure:"hotspot-fallback" json:"hotspotFallback"`
+	// How long to scan for before falling back to the hotspot.
+	HotspotFallbackDelay time.Duration `mapstructure:"hotspot-fallback-delay" json:"hotspotFallbackDelay"`
+	// How long the hotspot stays on for.
+	HotspotTimeout time.Duration `mapstructure:"hotspot-timeout" json:"hotspotTimeout"`
+	// Don't fall back to the hotspot if there hasn't been a human interaction for this long.
+	HumanInteractionCutoff time.Duration `mapstructure:"human-interaction-cutoff" json:"humanInteractionCutoff"`
+	// What to do with the network when the service stops.
+	OnShutdown string `mapstructure:"on-shutdown" json:"onShutdown"`
+}
+
+// Actions that can be taken on the network when the service stops.
+const (
+	ShutdownLeave       = "leave"        // Leave the network as it is.
+	ShutdownStopHotspot = "stop-hotspot" // Stop the hotspot and DHCP server if they are running.
+)
+
+func DefaultPolicy() Policy {
+	return Policy{
+		ScanConnectTimeout:     10 * time.Minute,
+		HotspotFallback:        true,
+		HotspotFallbackDelay:   10 * time.Second,
+		HotspotTimeout:         5 * time.Minute,
+		HumanInteractionCutoff: 60 * time.Minute,
+		OnShutdown:             ShutdownLeave,
+	}
+}
+
+func (p Policy) Validate() error {
+	if p.ScanConnectTimeout < 0 || p.HotspotFallbackDelay < 0 || p.HotspotTimeout < 0 || p.HumanInteractionCutoff < 0 {
+		return errors.New("durations can't be negative")
+	}
+	if p.HotspotFallback && p.HotspotFallbackDelay == 0 {
+		return errors.New("hotspot-fallback-delay must be set when hotspot-fallback is enabled")
+	}
+	if p.HotspotFallback && p.ScanConnectTimeout != 0 && p.HotspotFallbackDelay >= p.ScanConnectTimeout {
+		return errors.New("hotspot-fallback-delay must be shorter than scan-connect-timeout")
+	}
+	// The ATtiny reports the minutes since a human interaction as a uint8.
+	if p.HumanInteractionCutoff%time.Minute != 0 || p.HumanInteractionCutoff > 255*time.Minute {
+		return errors.New("human-interaction-cutoff must be a whole number of minutes, up to 255m")
+	}
+	if p.OnShutdown != ShutdownLeave && p.OnShutdown != ShutdownStopHotspot {
+		return fmt.Errorf("on-shutdown must be '%s' or '%s', got '%s'", ShutdownLeave, ShutdownStopHotspot, p.OnShutdown)
+	}
+	return nil
+}
+
+const ProvisioningKey = "provisioning"
+
+// Provisioning is where to look for wifi networks dropped onto the boot partition or a USB drive.
+// Changes to it are used the next time the service starts.
+type Provisioning struct {
+	// Directories checked when the service starts, such as the boot partition.
+	BootDirs []string `mapstructure:"boot-dirs"`
+	// Drives mounted under these directories are checked when the service starts and when they are plugged in.
+	MountRoots []string `mapstructure:"mount-roots"`
+	// What to do with a file once its networks have been added.
+	OnApplied string `mapstructure:"on-applied"`
+}
+
+// What can be done with a provisioning file once it has been applied.
+const (
+	AppliedDelete = "delete" // Overwrite the file then remove it.
+	AppliedRename = "rename" // Rename it with an '.applied' extension. This leaves the credentials on the drive.
+)
+
+func DefaultProvisioning() Provisioning {
+	return Provisioning{
+		BootDirs:   []string{"/boot/firmware", "/boot"},
+		MountRoots: []string{"/media", "/mnt"},
+		OnApplied:  AppliedDelete,
+	}
+}
+
+func (p Provisioning) Validate() error {
+	for _, dir := range append(slices.Clone(p.BootDirs), p.MountRoots...) {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("'%s' is not an absolute path", dir)
+		}
+	}
+	if p.OnApplied != AppliedDelete && p.OnApplied != AppliedRename {
+		return fmt.Errorf("on-applied must be '%s' or '%s', got '%s'", AppliedDelete, AppliedRename, p.OnApplied)
+	}
+	return nil
+}
+
+// serviceConfig is all the configuration used by the service.
+type serviceConfig struct {
+	Hotspot      Hotspot
+	Bushnet      Bushnet
+	Policy       Policy
+	Provisioning Provisioning
+}
+
+func defaultServiceConfig() *serviceConfig {
+	return &serviceConfig{
+		Hotspot:      DefaultHotspot(),
+		Bushnet:      DefaultBushnet(),
+		Policy:       DefaultPolicy(),
+		Provisioning: DefaultProvisioning(),
+	}
+}
+
+func (c *serviceConfig) Validate() error {
+	if err := c.Hotspot.Validate(); err != nil {
+		return fmt.Errorf("invalid %s config: %v", HotspotKey, err)
+	}
+	if err := c.Bushnet.Validate(); err != nil {
+		return fmt.Errorf("invalid %s config: %v", BushnetKey, err)
+	}
+	if err := c.Policy.Validate(); err != nil {
+		return fmt.Errorf("invalid %s config: %v", PolicyKey, err)
+	}
+	if err := c.Provisioning.Validate(); err != nil {
+		return fmt.Errorf("invalid %s config: %v", ProvisioningKey, err)
+	}
+	return nil
+}
+
+// loadConfig reads the config file from the directory with go-config, the same as the other Cacophony services.
+// Anything not set in the file will use the defaults, which is also what is used if there is no config file.
+func loadConfig(configDir string) (*serviceConfig, error) {
+	conf := defaultServiceConfig()
+	path := filepath.Join(configDir, goconfig.ConfigFileName)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		log.Printf("No config file at '%s', using defaults", path)
+		return conf, nil
+	}
+	rawConfig, err := goconfig.New(configDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file '%s': %v", path, err)
+	}
+	// Lists set in the file replace the defaults, instead of only overwriting the first items.
+	lists := map[string]*[]string{
+		HotspotKey + ".dns-servers":      &conf.Hotspot.DNSServers,
+		BushnetKey + ".ssids":            &conf.Bushnet.SSIDs,
+		ProvisioningKey + ".boot-dirs":   &conf.Provisioning.BootDirs,
+		ProvisioningKey + ".mount-roots": &conf.Provisioning.MountRoots,
+	}
+	for key, list := range lists {
+		if rawConfig.Get(key) != nil {
+			*list = nil
+		}
+	}
+	sections := map[string]interface{}{
+		HotspotKey:      &conf.Hotspot,
+		BushnetKey:      &conf.Bushnet,
+		PolicyKey:       &conf.Policy,
+		ProvisioningKey: &conf.Provisioning,
+	}
+	for key, section := range sections {
+		if err := rawConfig.Unmarshal(key, section); err != nil {
+			return nil, fmt.Errorf("failed to read %s config: %v", key, err)
+		}
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func validateSSID(ssid string) error {
+	if len(ssid) == 0 || len(ssid) > netmanagerclient.MaxSSIDLength {
+		return fmt.Errorf("SSID '%s' must be between 1 and %d bytes long", ssid, netmanagerclient.MaxSSIDLength)
+	}
+	return nil
+}
+
+func validatePSK(psk string) error {
+	if len(psk) < 8 || len(psk) > 63 {
+		return errors.New("PSK must be between 8 and 63 characters long")
+	}
+	return nil
+}
+
+func broadcastAddress(n net.IPNet) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(n.IP.To4())|^binary.BigEndian.Uint32(net.IP(n.Mask).To4()))
+	return ip
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	goconfig "github.com/TheCacophonyProject/go-config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, goconfig.ConfigFileName), []byte(content), 0644))
+	return dir
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	conf, err := loadConfig(t.TempDir())
+	require.NoError(t, err)
+	assert.Equal(t, defaultServiceConfig(), conf)
+	assert.NoError(t, conf.Validate())
+
+	// Defaults match what was used before the config file.
+	assert.Equal(t, "192.168.4.1/24", conf.Hotspot.RouterAddress())
+	assert.Equal(t, []string{
+		"interface=wlan0",
+		"dhcp-range=192.168.4.2,192.168.4.20,12h",
+		"domain=wlan",
+		"server=1.1.1.1",
+		"server=8.8.8.8",
+	}, dnsmasqConfigLines(conf.Hotspot))
+	payload, err := conf.Hotspot.QR().Payload()
+	require.NoError(t, err)
+	assert.Equal(t, "WIFI:S:bushnet;T:WPA;P:feathers;;", payload)
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := writeConfig(t, `
+[location]
+latitude = -43.5
+
+[hotspot]
+ssid = "camera-42"
+psk = "a better password"
+router-ip = "10.20.0.1"
+prefix-length = 16
+dhcp-range-start = "10.20.1.1"
+dhcp-range-end = "10.20.1.254"
+
+[bushnet]
+ssids = ["fieldnet"]
+
+[network-policy]
+scan-connect-timeout = "30m"
+hotspot-timeout = "0s"
+human-interaction-cutoff = "2h"
+on-shutdown = "stop-hotspot"
+
+[provisioning]
+mount-roots = ["/media/usb"]
+on-applied = "rename"
+`)
+	conf, err := loadConfig(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "camera-42", conf.Hotspot.SSID)
+	assert.Equal(t, "a better password", conf.Hotspot.PSK)
+	assert.Equal(t, "10.20.0.1/16", conf.Hotspot.RouterAddress())
+	assert.Equal(t, []string{"1.1.1.1", "8.8.8.8"}, conf.Hotspot.DNSServers)
+	assert.Equal(t, []string{"fieldnet"}, conf.Bushnet.SSIDs)
+	assert.Equal(t, "feathers", conf.Bushnet.PSK)
+	assert.Equal(t, Policy{
+		ScanConnectTimeout:     30 * time.Minute,
+		HotspotFallback:        true,
+		HotspotFallbackDelay:   10 * time.Second,
+		HotspotTimeout:         0,
+		HumanInteractionCutoff: 2 * time.Hour,
+		OnShutdown:             ShutdownStopHotspot,
+	}, conf.Policy)
+	assert.Equal(t, Provisioning{
+		BootDirs:   []string{"/boot/firmware", "/boot"},
+		MountRoots: []string{"/media/usb"},
+		OnApplied:  AppliedRename,
+	}, conf.Provisioning)
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"bad toml":           "[hotspot",
+		"not a section":      `hotspot = "bushnet"`,
+		"short psk":          "[hotspot]\npsk = \"short\"",
+		"long ssid":          "[hotspot]\nssid = \"123456789012345678901234567890123\"",
+		"bad router":         "[hotspot]\nrouter-ip = \"192.168.4\"",
+		"range outside":      "[hotspot]\ndhcp-range-end = \"192.168.5.20\"",
+		"range backwards":    "[hotspot]\ndhcp-range-start = \"192.168.4.30\"",
+		"router in range":    "[hotspot]\nrouter-ip = \"192.168.4.10\"",
+		"bad dns":            "[hotspot]\ndns-servers = [\"one.one.one.one\"]",
+		"bad prefix":         "[hotspot]\nprefix-length = 31",
+		"bad bushnet psk":    "[bushnet]\npsk = \"\"",
+		"includes broadcast": "[hotspot]\ndhcp-range-end = \"192.168.4.255\"",
+		"bad duration":       "[network-policy]\nhotspot-timeout = \"5 minutes\"",
+		"negative duration":  "[network-policy]\nhotspot-timeout = \"-5m\"",
+		"no fallback delay":  "[network-policy]\nhotspot-fallback-delay = \"0s\"",
+		"delay after off":    "[network-policy]\nscan-connect-timeout = \"10s\"",
+		"cutoff too long":    "[network-policy]\nhuman-interaction-cutoff = \"5h\"",
+		"cutoff in seconds":  "[network-policy]\nhuman-interaction-cutoff = \"90s\"",
+		"bad shutdown":       "[network-policy]\non-shutdown = \"turn-off\"",
+		"relative boot dir":  "[provisioning]\nboot-dirs = [\"boot\"]",
+		"bad on-applied":     "[provisioning]\non-applied = \"shred\"",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadConfig(writeConfig(t, content))
+			assert.Error(t, err)
+		})
+	}
+}
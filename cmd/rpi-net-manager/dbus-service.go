@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"runtime"
 	"strings"
 	"time"
@@ -12,15 +14,12 @@ import (
 )
 
 type service struct {
-	nsm *networkStateMachine
+	nsm       *networkStateMachine
+	configDir string
 }
 
-func startDBusService(nsm *networkStateMachine) error {
+func startDBusService(conn *dbus.Conn, nsm *networkStateMachine, configDir string) error {
 	log.Println("Starting RPiNetManager service")
-	conn, err := dbus.SystemBus()
-	if err != nil {
-		return err
-	}
 	reply, err := conn.RequestName(netmanagerclient.DbusInterface, dbus.NameFlagDoNotQueue)
 	if err != nil {
 		return err
@@ -30,7 +29,8 @@ func startDBusService(nsm *networkStateMachine) error {
 	}
 
 	s := &service{
-		nsm: nsm,
+		nsm:       nsm,
+		configDir: configDir,
 	}
 	if err := conn.Export(s, netmanagerclient.DbusPath, netmanagerclient.DbusInterface); err != nil {
 		return err
@@ -45,6 +45,20 @@ func startDBusService(nsm *networkStateMachine) error {
 	return nil
 }
 
+// stopDBusService removes the service from D-Bus and releases its name.
+func stopDBusService(conn *dbus.Conn) error {
+	log.Println("Stopping RPiNetManager service")
+	for _, iface := range []string{netmanagerclient.DbusInterface, "org.freedesktop.DBus.Introspectable", "org.freedesktop.DBus.Peer"} {
+		if err := conn.Export(nil, netmanagerclient.DbusPath, iface); err != nil {
+			return err
+		}
+	}
+	if _, err := conn.ReleaseName(netmanagerclient.DbusInterface); err != nil {
+		return fmt.Errorf("failed to release D-Bus name: %v", err)
+	}
+	return nil
+}
+
 func genIntrospectable(v interface{}) introspect.Introspectable {
 	node := &introspect.Node{
 		Interfaces: []introspect.Interface{{
@@ -59,6 +73,14 @@ func sendNewNetworkState(state netmanagerclient.NetworkState) error {
 	return sendBroadcast("NewNetworkState", []interface{}{string(state)})
 }
 
+func sendServiceError(op string, err error) error {
+	return sendBroadcast("ServiceError", []interface{}{op, err.Error()})
+}
+
+func sendScanResultsUpdated() error {
+	return sendBroadcast("ScanResultsUpdated", nil)
+}
+
 func sendBroadcast(signal string, payload []interface{}) error {
 	conn, err := dbus.ConnectSystemBus()
 	if err != nil {
@@ -75,15 +97,39 @@ func (s service) ReadState() (string, *dbus.Error) {
 func (s service) EnableWifi(force bool) *dbus.Error {
 	s.nsm.mux.Lock()
 	defer s.nsm.mux.Unlock()
-	s.nsm.hotspotFallback = true
-	runFuncLogErr(s.nsm.setupWifi)
+	defer s.nsm.saveState()
+	s.nsm.hotspotFallback = s.nsm.config.Policy.HotspotFallback
+	s.nsm.setTrigger(netmanagerclient.TRIGGER_DBUS_CALL, "EnableWifi")
+	var err error
+	if s.nsm.state == netmanagerclient.NS_ERROR {
+		// Recovering will enable the wifi.
+		err = s.nsm.recover()
+	} else {
+		err = opErr(opStartWifi, s.nsm.setupWifi())
+	}
+	if err != nil {
+		s.nsm.handleError(err)
+		return dbusErr(err)
+	}
 	return nil
 }
 
 func (s service) EnableHotspot(force bool) *dbus.Error {
 	s.nsm.mux.Lock()
 	defer s.nsm.mux.Unlock()
-	runFuncLogErr(s.nsm.setupHotspot)
+	defer s.nsm.saveState()
+	s.nsm.setTrigger(netmanagerclient.TRIGGER_DBUS_CALL, "EnableHotspot")
+	var err error
+	if s.nsm.state == netmanagerclient.NS_ERROR {
+		err = s.nsm.recover()
+	}
+	if err == nil {
+		err = opErr(opStartHotspot, s.nsm.setupHotspot())
+	}
+	if err != nil {
+		s.nsm.handleError(err)
+		return dbusErr(err)
+	}
 	return nil
 }
 
@@ -94,18 +140,133 @@ func (s service) KeepHotspotOnFor(seconds int) *dbus.Error {
 		return dbusErr(errors.New("hotspot is not enabled"))
 	}
 	s.nsm.keepHotspotOnFor(time.Duration(seconds) * time.Second)
+	s.nsm.saveState()
 	return nil
 }
 
 func (s service) CheckState() *dbus.Error {
-	_, _, _ = detectState()
+	s.nsm.mux.Lock()
+	defer s.nsm.mux.Unlock()
+	_, _, _ = s.nsm.detectState()
+	return nil
+}
+
+// GetPolicy returns the timing and fallback policy the state machine is using, as JSON.
+func (s service) GetPolicy() (string, *dbus.Error) {
+	s.nsm.mux.Lock()
+	policy := s.nsm.config.Policy
+	s.nsm.mux.Unlock()
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return string(data), nil
+}
+
+// GetBushnetNetworks returns the IDs of the saved networks the service manages, so can't be changed by the user.
+func (s service) GetBushnetNetworks() ([]string, *dbus.Error) {
+	s.nsm.mux.Lock()
+	defer s.nsm.mux.Unlock()
+	return s.nsm.bushnetConnections(), nil
+}
+
+// GetHotspotQRPayload returns the Wi-Fi QR code payload for joining the hotspot.
+func (s service) GetHotspotQRPayload() (string, *dbus.Error) {
+	s.nsm.mux.Lock()
+	hotspot := s.nsm.config.Hotspot
+	s.nsm.mux.Unlock()
+	payload, err := hotspot.QR().Payload()
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return payload, nil
+}
+
+// GetScanResults returns the access points found by the last scan as JSON. If the results are older than
+// maxAgeSeconds a new scan is started, and ScanResultsUpdated is sent when it has finished.
+func (s service) GetScanResults(maxAgeSeconds int) (string, *dbus.Error) {
+	s.nsm.mux.Lock()
+	results := s.nsm.scanResultsFor(time.Duration(maxAgeSeconds) * time.Second)
+	s.nsm.mux.Unlock()
+	data, err := json.Marshal(results)
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return string(data), nil
+}
+
+// GetStateHistory returns the recent state transitions, oldest first, as JSON.
+func (s service) GetStateHistory() (string, *dbus.Error) {
+	s.nsm.mux.Lock()
+	data, err := json.Marshal(s.nsm.history)
+	s.nsm.mux.Unlock()
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return string(data), nil
+}
+
+// GetNetworkFailures returns the failed connection attempts of each saved network as JSON.
+func (s service) GetNetworkFailures() (string, *dbus.Error) {
+	s.nsm.mux.Lock()
+	data, err := json.Marshal(s.nsm.networkFailures)
+	s.nsm.mux.Unlock()
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return string(data), nil
+}
+
+// GetNetworkStats returns the connection statistics of each saved network as JSON.
+func (s service) GetNetworkStats() (string, *dbus.Error) {
+	s.nsm.mux.Lock()
+	data, err := json.Marshal(s.nsm.currentNetworkStats())
+	s.nsm.mux.Unlock()
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return string(data), nil
+}
+
+// GetErrors returns the errors the service has had as JSON.
+func (s service) GetErrors() (string, *dbus.Error) {
+	s.nsm.mux.Lock()
+	data, err := json.Marshal(s.nsm.serviceErrors())
+	s.nsm.mux.Unlock()
+	if err != nil {
+		return "", dbusErr(err)
+	}
+	return string(data), nil
+}
+
+// SetWifiNetworkPriority sets the priority of a saved wifi network, higher priority networks are connected to first.
+func (s service) SetWifiNetworkPriority(id string, priority int32) *dbus.Error {
+	s.nsm.mux.Lock()
+	defer s.nsm.mux.Unlock()
+	if err := s.nsm.setWifiNetworkPriority(id, int(priority)); err != nil {
+		return dbusErr(err)
+	}
 	return nil
 }
 
-func runFuncLogErr(f func() error) {
-	if err := f(); err != nil {
-		log.Println("Error: ", err)
+// ReorderWifiNetworks sets the priorities of the saved wifi networks so they are connected to in the given order.
+func (s service) ReorderWifiNetworks(ids []string) *dbus.Error {
+	s.nsm.mux.Lock()
+	defer s.nsm.mux.Unlock()
+	if err := s.nsm.reorderWifiNetworks(ids); err != nil {
+		return dbusErr(err)
 	}
+	return nil
+}
+
+// ReloadConfig reads the config file again and applies it to the running service.
+// An invalid config is rejected and the service keeps using the current config.
+func (s service) ReloadConfig() *dbus.Error {
+	if err := s.nsm.reloadConfig(s.configDir); err != nil {
+		log.Errorf("Failed to reload config: %v", err)
+		return dbusErr(err)
+	}
+	return nil
 }
 
 func dbusErr(err error) *dbus.Error {
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartStopDBusService(t *testing.T) {
+	address := startPrivateBus(t)
+	conn := connectPrivateBus(t, address)
+	client := connectPrivateBus(t, address)
+	nsm := newTestStateMachine(newFakeBackend(), &fakeDHCP{})
+	nsm.state = netmanagerclient.NS_WIFI_SCANNING
+
+	hasOwner := func() bool {
+		var owned bool
+		require.NoError(t, client.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, netmanagerclient.DbusInterface).Store(&owned))
+		return owned
+	}
+
+	require.NoError(t, startDBusService(conn, nsm, t.TempDir()))
+	assert.True(t, hasOwner())
+	var state string
+	obj := client.Object(netmanagerclient.DbusInterface, netmanagerclient.DbusPath)
+	require.NoError(t, obj.Call(netmanagerclient.DbusInterface+".ReadState", 0).Store(&state))
+	assert.Equal(t, string(netmanagerclient.NS_WIFI_SCANNING), state)
+
+	// Another instance can't take the name while it is running.
+	other := connectPrivateBus(t, address)
+	assert.Error(t, startDBusService(other, nsm, t.TempDir()))
+
+	require.NoError(t, stopDBusService(conn))
+	assert.False(t, hasOwner())
+	// The methods are no longer exported on the connection.
+	var dbusErr dbus.Error
+	call := client.Object(conn.Names()[0], netmanagerclient.DbusPath).Call(netmanagerclient.DbusInterface+".ReadState", 0)
+	require.ErrorAs(t, call.Err, &dbusErr)
+	assert.Equal(t, "org.freedesktop.DBus.Error.UnknownInterface", dbusErr.Name)
+
+	// The name is free to be taken again.
+	require.NoError(t, startDBusService(other, nsm, t.TempDir()))
+	assert.True(t, hasOwner())
+}
@@ -0,0 +1,66 @@
+package main
+
+import netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+
+// NetworkManager device state reasons, from NMDeviceStateReason.
+const (
+	nmDeviceReasonIPConfigUnavailable  = 5
+	nmDeviceReasonIPConfigExpired      = 6
+	nmDeviceReasonNoSecrets            = 7
+	nmDeviceReasonSupplicantDisconnect = 8
+	nmDeviceReasonSupplicantTimeout    = 11
+	nmDeviceReasonDHCPStartFailed      = 15
+	nmDeviceReasonDHCPError            = 16
+	nmDeviceReasonDHCPFailed           = 17
+	nmDeviceReasonSSIDNotFound         = 53
+)
+
+// NetworkManager active connection state reasons, from NMActiveConnectionStateReason.
+const (
+	nmActiveReasonIPConfigInvalid = 5
+	nmActiveReasonConnectTimeout  = 6
+	nmActiveReasonNoSecrets       = 9
+	nmActiveReasonLoginFailed     = 10
+)
+
+// deviceFailureReason converts the reason a device failed to activate a connection into a failure reason.
+func deviceFailureReason(reason uint32) netmanagerclient.ConnectionFailureReason {
+	switch reason {
+	case nmDeviceReasonNoSecrets, nmDeviceReasonSupplicantDisconnect:
+		// A wrong WPA-PSK shows up as the supplicant disconnecting during the 4-way handshake.
+		return netmanagerclient.FAILURE_BAD_SECRETS
+	case nmDeviceReasonSSIDNotFound:
+		return netmanagerclient.FAILURE_NO_AP
+	case nmDeviceReasonIPConfigUnavailable, nmDeviceReasonIPConfigExpired,
+		nmDeviceReasonDHCPStartFailed, nmDeviceReasonDHCPError, nmDeviceReasonDHCPFailed:
+		return netmanagerclient.FAILURE_DHCP_TIMEOUT
+	case nmDeviceReasonSupplicantTimeout:
+		return netmanagerclient.FAILURE_SUPPLICANT_TIMEOUT
+	default:
+		return netmanagerclient.FAILURE_OTHER
+	}
+}
+
+// activeConnectionFailureReason converts the reason an active connection was deactivated into a failure reason.
+// Returns false if the connection was deactivated for a reason other than failing, such as a user disconnecting it.
+func activeConnectionFailureReason(reason uint32) (netmanagerclient.ConnectionFailureReason, bool) {
+	switch reason {
+	case nmActiveReasonNoSecrets, nmActiveReasonLoginFailed:
+		return netmanagerclient.FAILURE_BAD_SECRETS, true
+	case nmActiveReasonIPConfigInvalid:
+		return netmanagerclient.FAILURE_DHCP_TIMEOUT, true
+	case nmActiveReasonConnectTimeout:
+		return netmanagerclient.FAILURE_SUPPLICANT_TIMEOUT, true
+	default:
+		return "", false
+	}
+}
+
+// sendConnectionFailure sends the failure without blocking, dropping it if the state machine isn't keeping up.
+func sendConnectionFailure(failures chan<- ConnectionFailure, failure ConnectionFailure) {
+	select {
+	case failures <- failure:
+	default:
+		log.Printf("Dropped connection failure for '%s'", failure.ID)
+	}
+}
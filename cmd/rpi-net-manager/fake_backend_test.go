@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+)
+
+// fakeBackend is an in-memory NetworkBackend that tests can script.
+// Changes made through the backend, or by the test, are signalled on the updates channel
+// the same way NetworkManager signals changes to the real service.
+type fakeBackend struct {
+	mu       sync.Mutex
+	radioOn  bool
+	active   []ActiveConnection
+	ip4      map[string]string            // IP address of active connections.
+	ip6      map[string]string            // Global IPv6 address of active connections.
+	dhcpIPs  map[string]string            // IP address a connection will get when it is brought up.
+	profiles map[string]map[string]string // Saved connection profiles.
+	bssid    string
+	scans    [][]string // SSIDs probed for by each scan.
+	aps      []netmanagerclient.AccessPoint
+	signal   int
+	errs     map[string]error
+	calls    []string
+	updates  chan struct{}
+	failures chan ConnectionFailure
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		ip4:      map[string]string{},
+		ip6:      map[string]string{},
+		dhcpIPs:  map[string]string{},
+		profiles: map[string]map[string]string{},
+		errs:     map[string]error{},
+		updates:  make(chan struct{}, 10),
+		failures: make(chan ConnectionFailure, 10),
+	}
+}
+
+// notify signals a network update without blocking.
+func (b *fakeBackend) notify() {
+	select {
+	case b.updates <- struct{}{}:
+	default:
+	}
+}
+
+// call records the call and returns the error that the test has set for the operation.
+func (b *fakeBackend) call(op string, args ...interface{}) error {
+	b.calls = append(b.calls, strings.TrimSpace(fmt.Sprintln(append([]interface{}{op}, args...)...)))
+	return b.errs[op]
+}
+
+func (b *fakeBackend) setErr(op string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.errs[op] = err
+}
+
+func (b *fakeBackend) getCalls() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string{}, b.calls...)
+}
+
+// connect makes a connection active, with an IPv4 or IPv6 address if ip is not empty.
+func (b *fakeBackend) connect(connType, id, ip string) {
+	b.mu.Lock()
+	b.removeActive(id)
+	b.active = append(b.active, ActiveConnection{Type: connType, Name: id})
+	if strings.Contains(ip, ":") {
+		b.ip6[id] = ip
+	} else if ip != "" {
+		b.ip4[id] = ip
+	}
+	b.mu.Unlock()
+	b.notify()
+}
+
+// disconnect drops an active connection, failing it with the wrong password if needed.
+func (b *fakeBackend) disconnect(id string, failed bool) {
+	if failed {
+		b.fail(id, netmanagerclient.FAILURE_BAD_SECRETS)
+		return
+	}
+	b.mu.Lock()
+	b.removeActive(id)
+	b.mu.Unlock()
+	b.notify()
+}
+
+// fail drops an active connection and reports that it failed to activate, the same way NetworkManager
+// signals the failure before the connection goes away.
+func (b *fakeBackend) fail(id string, reason netmanagerclient.ConnectionFailureReason) {
+	b.mu.Lock()
+	b.removeActive(id)
+	b.mu.Unlock()
+	b.failures <- ConnectionFailure{ID: id, Reason: reason}
+	b.notify()
+}
+
+func (b *fakeBackend) removeActive(id string) {
+	active := []ActiveConnection{}
+	for _, c := range b.active {
+		if c.Name != id {
+			active = append(active, c)
+		}
+	}
+	b.active = active
+	delete(b.ip4, id)
+	delete(b.ip6, id)
+}
+
+func (b *fakeBackend) WifiRadioEnabled() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.errs["WifiRadioEnabled"]; err != nil {
+		return false, err
+	}
+	return b.radioOn, nil
+}
+
+func (b *fakeBackend) SetWifiRadio(enabled bool) error {
+	b.mu.Lock()
+	if err := b.call("SetWifiRadio", enabled); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	b.radioOn = enabled
+	if !enabled {
+		b.active = nil
+		b.ip4 = map[string]string{}
+		b.ip6 = map[string]string{}
+	}
+	b.mu.Unlock()
+	b.notify()
+	return nil
+}
+
+func (b *fakeBackend) ActiveConnections() ([]ActiveConnection, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.errs["ActiveConnections"]; err != nil {
+		return nil, err
+	}
+	return append([]ActiveConnection{}, b.active...), nil
+}
+
+func (b *fakeBackend) ConnectionIP4Address(id string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.errs["ConnectionIP4Address"]; err != nil {
+		return "", err
+	}
+	return b.ip4[id], nil
+}
+
+func (b *fakeBackend) ConnectionIP6Address(id string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ip6[id], nil
+}
+
+func (b *fakeBackend) ConnectionUp(id string) error {
+	b.mu.Lock()
+	if err := b.call("ConnectionUp", id); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	if _, ok := b.profiles[id]; !ok {
+		b.mu.Unlock()
+		return fmt.Errorf("unknown connection '%s'", id)
+	}
+	b.removeActive(id)
+	b.active = append(b.active, ActiveConnection{Type: "802-11-wireless", Name: id})
+	if ip, ok := b.dhcpIPs[id]; ok {
+		b.ip4[id] = ip
+	}
+	b.mu.Unlock()
+	b.notify()
+	return nil
+}
+
+func (b *fakeBackend) ConnectionDown(id string) error {
+	b.mu.Lock()
+	if err := b.call("ConnectionDown", id); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	b.removeActive(id)
+	b.mu.Unlock()
+	b.notify()
+	return nil
+}
+
+func (b *fakeBackend) ModifyConnection(id string, config map[string]string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.call("ModifyConnection", id); err != nil {
+		return err
+	}
+	profile, ok := b.profiles[id]
+	if !ok {
+		profile = map[string]string{}
+		b.profiles[id] = profile
+	}
+	for k, v := range config {
+		profile[k] = v
+	}
+	return nil
+}
+
+func (b *fakeBackend) DeleteConnection(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.call("DeleteConnection", id); err != nil {
+		return err
+	}
+	if _, ok := b.profiles[id]; !ok {
+		return fmt.Errorf("unknown connection '%s'", id)
+	}
+	delete(b.profiles, id)
+	return nil
+}
+
+func (b *fakeBackend) SavedWifiConnections() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return sortedKeys(b.profiles), nil
+}
+
+func sortedKeys(profiles map[string]map[string]string) []string {
+	ids := []string{}
+	for id := range profiles {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (b *fakeBackend) HiddenWifiSSIDs() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ssids := []string{}
+	for _, id := range sortedKeys(b.profiles) {
+		profile := b.profiles[id]
+		if profile["802-11-wireless.hidden"] == "yes" {
+			ssids = append(ssids, profile["wifi.ssid"])
+		}
+	}
+	return ssids, nil
+}
+
+func (b *fakeBackend) RequestWifiScan(ifname string, ssids []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.call("RequestWifiScan", ssids); err != nil {
+		return err
+	}
+	b.scans = append(b.scans, ssids)
+	return nil
+}
+
+func (b *fakeBackend) getScans() [][]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([][]string{}, b.scans...)
+}
+
+func (b *fakeBackend) WifiAccessPoints(ifname string) ([]netmanagerclient.AccessPoint, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.call("WifiAccessPoints"); err != nil {
+		return nil, err
+	}
+	return append([]netmanagerclient.AccessPoint{}, b.aps...), nil
+}
+
+func (b *fakeBackend) ActiveBSSID(ifname string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.bssid == "" {
+		return "", fmt.Errorf("no active AP found")
+	}
+	return b.bssid, nil
+}
+
+func (b *fakeBackend) ActiveSignalStrength(ifname string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.bssid == "" {
+		return 0, fmt.Errorf("no active AP found")
+	}
+	return b.signal, nil
+}
+
+func (b *fakeBackend) ConnectionFailures() <-chan ConnectionFailure {
+	return b.failures
+}
+
+func (b *fakeBackend) profile(id string) map[string]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.profiles[id]
+}
+
+// fakeDHCP records if the DHCP server is running.
+type fakeDHCP struct {
+	mu      sync.Mutex
+	running bool
+	hotspot Hotspot
+}
+
+func (d *fakeDHCP) Start(hotspot Hotspot) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.running = true
+	d.hotspot = hotspot
+	return nil
+}
+
+func (d *fakeDHCP) Stop() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.running = false
+	return nil
+}
+
+func (d *fakeDHCP) isRunning() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.running
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/TheCacophonyProject/go-utils/logging"
@@ -17,11 +25,53 @@ var (
 )
 
 type AddNetwork struct {
-	SSID string `arg:"required" help:"the SSID of the network"`
-	Pass string `arg:"required" help:"the password of the network"`
+	SSID     string `help:"the SSID of the network"`
+	SSIDHex  string `arg:"--ssid-hex" help:"the SSID of the network as hex, for SSIDs that aren't UTF-8"`
+	Pass     string `help:"the password of the network, not needed for open networks"`
+	Security string `default:"wpa2-psk" help:"the security of the network (open, wpa2-psk, wpa3-sae, wpa2-wpa3)"`
+	Hidden   bool   `help:"the network doesn't broadcast its SSID"`
+}
+type AddNetworkQR struct {
+	Payload string `arg:"positional,required" help:"the text of a Wi-Fi QR code, e.g. 'WIFI:S:home;T:WPA;P:password;;'"`
+}
+type AddEnterpriseNetwork struct {
+	SSID              string `help:"the SSID of the network"`
+	SSIDHex           string `arg:"--ssid-hex" help:"the SSID of the network as hex, for SSIDs that aren't UTF-8"`
+	Identity          string `arg:"required" help:"the identity (username) to log in with"`
+	Pass              string `arg:"required" help:"the password to log in with"`
+	EAP               string `default:"peap" help:"the EAP method (peap, ttls)"`
+	Phase2            string `default:"mschapv2" help:"the phase 2 authentication (peap: mschapv2, gtc, md5, ttls: pap, chap, mschap, mschapv2)"`
+	AnonymousIdentity string `help:"the identity to send outside of the encrypted tunnel"`
+	CACert            string `help:"path to a PEM encoded CA certificate to check the authentication server with"`
+	Security          string `default:"wpa2-eap" help:"the security of the network (wpa2-eap, wpa3-eap)"`
+	Hidden            bool   `help:"the network doesn't broadcast its SSID"`
+}
+type SetNetworkHidden struct {
+	ID     string `arg:"required" help:"the ID of the saved network"`
+	Hidden bool   `help:"mark the network as hidden, leave out to mark it as broadcasting its SSID"`
+}
+type SetNetworkIP struct {
+	ID        string   `arg:"required" help:"the ID of the saved network"`
+	IPv6      bool     `arg:"--ipv6" help:"set the IPv6 config instead of the IPv4 config"`
+	Method    string   `default:"auto" help:"how to get addresses (auto, manual, disabled)"`
+	Addresses []string `help:"static addresses with their prefix length, e.g. 192.168.1.10/24"`
+	Gateway   string   `help:"the gateway to use with the static addresses"`
+	DNS       []string `arg:"--dns" help:"DNS servers to use instead of any from DHCP"`
+}
+type ExportNetworks struct {
+	Output string `arg:"-o,--output" help:"file to write the networks to, instead of printing them"`
+}
+type ImportNetworks struct {
+	Input    string `arg:"positional,required" help:"file with the networks to import"`
+	Conflict string `default:"skip" help:"what to do with a network that is already saved (skip, overwrite, rename)"`
+	DryRun   bool   `arg:"--dry-run" help:"show what would be imported without changing any networks"`
 }
 type RemoveNetwork struct {
-	SSID string `arg:"required" help:"the SSID of the network"`
+	SSID    string `help:"the SSID or ID of the network"`
+	SSIDHex string `arg:"--ssid-hex" help:"the SSID of the network as hex, removes every network saved with that SSID"`
+}
+type ReorderNetworks struct {
+	IDs []string `arg:"positional,required" help:"the IDs of the saved networks, in the order to connect to them"`
 }
 type EnableHotspot struct {
 	Force bool `arg:"--force" help:"force enable hotspot"`
@@ -29,23 +79,49 @@ type EnableHotspot struct {
 type EnableWifi struct {
 	Force bool `arg:"--force" help:"force enable wifi"`
 }
+type ScanNetwork struct {
+	Sort         string `default:"signal" help:"how to order the networks (signal, ssid, channel)"`
+	SSID         string `help:"only show networks with this text in their SSID"`
+	Band         string `help:"only show access points on this band (2.4GHz, 5GHz, 6GHz)"`
+	MinSignal    int    `help:"only show access points with at least this signal (0-100)"`
+	Saved        bool   `help:"only show networks that are saved"`
+	AccessPoints bool   `arg:"--access-points" help:"show each access point of the networks"`
+	JSON         bool   `arg:"--json" help:"print the networks and their access points as JSON"`
+}
 type ReadState struct {
 	FollowUpdates bool `arg:"--follow-updates" help:"keep on reading the state as it updates instead of just once"`
 }
+type Service struct {
+	Backend   string `arg:"--backend" default:"dbus" help:"how to control NetworkManager (dbus, nmcli)"`
+	ConfigDir string `arg:"-c,--config-dir" default:"/etc/cacophony" help:"path to configuration directory"`
+	StateFile string `arg:"--state-file" default:"/var/lib/rpi-net-manager/state.json" help:"file to save the state to so it can be restored after a restart"`
+}
 type subcommand struct{}
 
 type Args struct {
-	Service              *subcommand    `arg:"subcommand:service" help:"start service"`
-	ReadState            *ReadState     `arg:"subcommand:read-state" help:"read the state of the network"`
-	SavedWifiNetworks    *subcommand    `arg:"subcommand:saved-wifi-networks" help:"show saved wifi networks"`
-	AddWifiNetwork       *AddNetwork    `arg:"subcommand:add-wifi-network" help:"add a network"`
-	RemoveWifiNetwork    *RemoveNetwork `arg:"subcommand:remove-wifi-network" help:"remove a network"`
-	EnableWifi           *EnableWifi    `arg:"subcommand:enable-wifi" help:"enable wifi"`
-	EnableHotspot        *EnableHotspot `arg:"subcommand:enable-hotspot" help:"enable hotspot"`
-	ScanNetwork          *subcommand    `arg:"subcommand:scan-network" help:"show available networks"`
-	ShowConnectedDevices *subcommand    `arg:"subcommand:show-connected-devices" help:"show connected devices on the hotspot //TODO"`
-	ModemStatus          *subcommand    `arg:"subcommand:modem-status" help:"show modem status //TODO"`
-	CheckState           *subcommand    `arg:"subcommand:check-state" help:"check if the state needs to be updated"`
+	Service              *Service              `arg:"subcommand:service" help:"start service"`
+	ReadState            *ReadState            `arg:"subcommand:read-state" help:"read the state of the network"`
+	SavedWifiNetworks    *subcommand           `arg:"subcommand:saved-wifi-networks" help:"show saved wifi networks"`
+	AddWifiNetwork       *AddNetwork           `arg:"subcommand:add-wifi-network" help:"add a network"`
+	AddWifiNetworkQR     *AddNetworkQR         `arg:"subcommand:add-wifi-network-qr" help:"add a network from a Wi-Fi QR code"`
+	AddEnterpriseNetwork *AddEnterpriseNetwork `arg:"subcommand:add-enterprise-wifi-network" help:"add a WPA2/WPA3-Enterprise network"`
+	SetWifiNetworkHidden *SetNetworkHidden     `arg:"subcommand:set-wifi-network-hidden" help:"set if a saved network is hidden"`
+	SetWifiNetworkIP     *SetNetworkIP         `arg:"subcommand:set-wifi-network-ip" help:"set the IP addresses and DNS servers of a saved network"`
+	ExportNetworks       *ExportNetworks       `arg:"subcommand:export-networks" help:"export the saved networks, with their passwords, as JSON"`
+	ImportNetworks       *ImportNetworks       `arg:"subcommand:import-networks" help:"import networks from an export"`
+	RemoveWifiNetwork    *RemoveNetwork        `arg:"subcommand:remove-wifi-network" help:"remove a network"`
+	ReorderWifiNetworks  *ReorderNetworks      `arg:"subcommand:reorder-wifi-networks" help:"set the order to connect to the saved networks"`
+	EnableWifi           *EnableWifi           `arg:"subcommand:enable-wifi" help:"enable wifi"`
+	EnableHotspot        *EnableHotspot        `arg:"subcommand:enable-hotspot" help:"enable hotspot"`
+	HotspotQR            *subcommand           `arg:"subcommand:hotspot-qr" help:"show the Wi-Fi QR code text for joining the hotspot"`
+	ScanNetwork          *ScanNetwork          `arg:"subcommand:scan-network" help:"show available networks"`
+	ShowConnectedDevices *subcommand           `arg:"subcommand:show-connected-devices" help:"show connected devices on the hotspot //TODO"`
+	ModemStatus          *subcommand           `arg:"subcommand:modem-status" help:"show modem status //TODO"`
+	CheckState           *subcommand           `arg:"subcommand:check-state" help:"check if the state needs to be updated"`
+	ShowPolicy           *subcommand           `arg:"subcommand:show-policy" help:"show the timing and fallback policy of the service"`
+	ReloadConfig         *subcommand           `arg:"subcommand:reload-config" help:"make the service read its config file again"`
+	StateHistory         *subcommand           `arg:"subcommand:state-history" help:"show the recent state transitions of the service"`
+	ShowErrors           *subcommand           `arg:"subcommand:show-errors" help:"show the errors the service has had"`
 	logging.LogArgs
 }
 
@@ -78,52 +154,75 @@ func runMain() error {
 	}
 
 	if args.Service != nil {
-		if err := startService(); err != nil {
-			return err
-		}
-		// Block the goroutine
-		quit := make(chan struct{})
-		<-quit
-		return nil
+		return startService(args.Service)
 	} else if args.ReadState != nil {
 		return readState(args)
 	} else if args.SavedWifiNetworks != nil {
 		return savedWifiNetworks()
 	} else if args.AddWifiNetwork != nil {
-		return addWifiNetwork(args.AddWifiNetwork.SSID, args.AddWifiNetwork.Pass)
+		return addWifiNetwork(args.AddWifiNetwork)
+	} else if args.AddWifiNetworkQR != nil {
+		return addWifiNetworkQR(args.AddWifiNetworkQR)
+	} else if args.AddEnterpriseNetwork != nil {
+		return addEnterpriseWifiNetwork(args.AddEnterpriseNetwork)
+	} else if args.SetWifiNetworkHidden != nil {
+		return setWifiNetworkHidden(args.SetWifiNetworkHidden)
+	} else if args.SetWifiNetworkIP != nil {
+		return setWifiNetworkIP(args.SetWifiNetworkIP)
+	} else if args.ExportNetworks != nil {
+		return exportNetworks(args.ExportNetworks)
+	} else if args.ImportNetworks != nil {
+		return importNetworks(args.ImportNetworks)
 	} else if args.RemoveWifiNetwork != nil {
-		return removeWifiNetwork(args.RemoveWifiNetwork.SSID)
+		return removeWifiNetwork(args.RemoveWifiNetwork)
+	} else if args.ReorderWifiNetworks != nil {
+		return reorderWifiNetworks(args.ReorderWifiNetworks.IDs)
 	} else if args.EnableWifi != nil {
 		return enableWifi(args)
 	} else if args.EnableHotspot != nil {
 		return enableHotspot(args)
+	} else if args.HotspotQR != nil {
+		return hotspotQR()
 	} else if args.ScanNetwork != nil {
-		return scanNetwork()
+		return scanNetwork(args.ScanNetwork)
 	} else if args.CheckState != nil {
 		return checkState()
+	} else if args.ShowPolicy != nil {
+		return showPolicy()
+	} else if args.ReloadConfig != nil {
+		return reloadConfig()
+	} else if args.StateHistory != nil {
+		return stateHistory()
+	} else if args.ShowErrors != nil {
+		return showErrors()
 	} else {
 		return fmt.Errorf("no command given, use --help for usage")
 	}
 }
 
-func startService() error {
-	bushnetConfig := map[string]string{
-		"connection.type":                 "802-11-wireless",
-		"connection.auth-retries":         "2",
-		"connection.autoconnect-priority": "10",
-		"ipv4.route-metric":               "10",
-		"ipv6.route-metric":               "10",
-		"wifi.ssid":                       "bushnet",
-		"wifi-sec.psk":                    "feathers",
-		"wifi-sec.key-mgmt":               "wpa-psk",
-		"802-11-wireless-security.pmf":    "disable", // Android has issues with PMF
+func newBackend(name string) (NetworkBackend, error) {
+	switch name {
+	case "dbus":
+		return newNMDbusBackend()
+	case "nmcli":
+		return nmcliBackend{}, nil
+	default:
+		return nil, fmt.Errorf("unknown backend '%s'", name)
 	}
-	if err := netmanagerclient.ModifyNetworkConfig("bushnet", bushnetConfig); err != nil {
+}
+
+func startService(args *Service) error {
+	conf, err := loadConfig(args.ConfigDir)
+	if err != nil {
 		return err
 	}
 
-	bushnetConfig["wifi.ssid"] = "Bushnet"
-	if err := netmanagerclient.ModifyNetworkConfig("Bushnet", bushnetConfig); err != nil {
+	backend, err := newBackend(args.Backend)
+	if err != nil {
+		return err
+	}
+
+	if err := setupBushnetNetworks(backend, conf.Bushnet); err != nil {
 		return err
 	}
 
@@ -133,26 +232,112 @@ func startService() error {
 	}
 	defer close(done)
 
-	nsm := &networkStateMachine{
-		NetworkUpdateChannel: c,
-		state:                netmanagerclient.NS_INIT,
-		wifiScanConnectTimer: time.NewTimer(10 * time.Minute),
-		wifiScanTimer:        time.NewTimer(10 * time.Second),
-		hotspotTimer:         time.NewTimer(5 * time.Minute),
-		hotspotFallback:      true,
+	nsm := newNetworkStateMachine(backend, dnsmasq{}, c, realClock{}, conf)
+	nsm.store = newStateStore(args.StateFile)
+	nsm.restoreState()
+	nsm.watchdogInterval, err = sdWatchdogInterval()
+	if err != nil {
+		return err
 	}
 
-	if err := startDBusService(nsm); err != nil {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	if err := startDBusService(conn, nsm, args.ConfigDir); err != nil {
 		return err
 	}
 
+	// Networks dropped onto the boot partition or a USB drive are added before the state machine starts,
+	// so they can be connected to straight away.
+	provisioner := newProvisioner(conf.Provisioning, func() []string {
+		nsm.mux.Lock()
+		defer nsm.mux.Unlock()
+		return nsm.bushnetConnections()
+	})
+	provisioner.provisionAll()
+
+	go reloadConfigOnSignal(nsm, args.ConfigDir)
+	go stopOnSignal(nsm)
+	go provisioner.watchMounts(nsm.quit)
+
 	if err := nsm.runStateMachine(); err != nil {
 		return err
 	}
 
+	if err := stopDBusService(conn); err != nil {
+		log.Error(err)
+	}
+	if err := nsm.shutdown(); err != nil {
+		return fmt.Errorf("failed to shut down network: %v", err)
+	}
+	log.Println("Service stopped")
+	return nil
+}
+
+// stopOnSignal stops the state machine when the service gets a SIGTERM or SIGINT.
+func stopOnSignal(nsm *networkStateMachine) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+	log.Printf("Got %s, stopping service", sig)
+	if err := sdNotify("STOPPING=1"); err != nil {
+		log.Println(err)
+	}
+	close(nsm.quit)
+}
+
+// setupBushnetNetworks creates or updates the profiles for the networks hosted by field phones.
+func setupBushnetNetworks(backend NetworkBackend, bushnet Bushnet) error {
+	for _, ssid := range bushnet.SSIDs {
+		bushnetConfig := map[string]string{
+			"connection.type":                 "802-11-wireless",
+			"connection.auth-retries":         "2",
+			"connection.autoconnect-priority": strconv.Itoa(netmanagerclient.BushnetPriority),
+			"ipv4.route-metric":               "10",
+			"ipv6.route-metric":               "10",
+			"wifi.ssid":                       ssid,
+			"wifi-sec.psk":                    bushnet.PSK,
+			"wifi-sec.key-mgmt":               "wpa-psk",
+			"802-11-wireless-security.pmf":    "disable", // Android has issues with PMF
+		}
+		if err := backend.ModifyConnection(ssid, bushnetConfig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeBushnetNetworks removes the profiles for the bushnet networks that are no longer in the config.
+func removeBushnetNetworks(backend NetworkBackend, old, bushnet Bushnet) error {
+	saved, err := backend.SavedWifiConnections()
+	if err != nil {
+		return err
+	}
+	for _, ssid := range old.SSIDs {
+		if slices.Contains(bushnet.SSIDs, ssid) || !slices.Contains(saved, ssid) {
+			continue
+		}
+		log.Printf("Removing bushnet network '%s'", ssid)
+		if err := backend.DeleteConnection(ssid); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// reloadConfigOnSignal reloads the config each time the service gets a SIGHUP.
+func reloadConfigOnSignal(nsm *networkStateMachine, configDir string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		log.Println("Got SIGHUP, reloading config")
+		if err := nsm.reloadConfig(configDir); err != nil {
+			log.Errorf("Failed to reload config: %v", err)
+		}
+	}
+}
+
 func readState(args Args) error {
 	log.Println("Reading state.")
 	state, err := netmanagerclient.ReadState()
@@ -180,19 +365,219 @@ func savedWifiNetworks() error {
 		return err
 	}
 	for _, network := range networks {
-		log.Printf("ID: '%s', SSID: '%s', LastConnectionTime: '%s', AuthFailed: '%t'", network.ID, network.SSID, network.LastConnectionTime, network.AuthFailed)
+		log.Printf("ID: '%s', SSID: '%s', Security: '%s', Hidden: '%t', Priority: %d, LastConnectionTime: '%s', AuthFailed: '%t', FailureReason: '%s'",
+			network.ID, displaySSID(network.RawSSID), network.Security, network.Hidden, network.Priority, network.LastConnectionTime, network.AuthFailed, network.FailureReason)
+		printIPConfig("IPv4", network.IP.IPv4)
+		printIPConfig("IPv6", network.IP.IPv6)
+		stats := network.Stats
+		log.Printf("    Attempts: %d, Successes: %d, ConnectedTime: %s, LastSignal: %d%%",
+			stats.Attempts, stats.Successes, stats.ConnectedTime.Round(time.Second), stats.LastSignal)
+		if !stats.LastFailure.IsZero() {
+			log.Printf("    LastFailure: %s, Reason: '%s'", stats.LastFailure.Local().Format(time.DateTime), stats.LastFailureReason)
+		}
+	}
+	return nil
+}
+
+func printIPConfig(family string, ip netmanagerclient.IPConfig) {
+	log.Printf("    %s: %s, Addresses: %v, Gateway: '%s', DNS: %v", family, ip.Method, ip.Addresses, ip.Gateway, ip.DNS)
+}
+
+// ssidFromArgs gets the SSID given with either --ssid or --ssid-hex.
+func ssidFromArgs(ssid, ssidHex string) (netmanagerclient.SSID, error) {
+	switch {
+	case ssid != "" && ssidHex != "":
+		return nil, errors.New("only one of --ssid and --ssid-hex can be given")
+	case ssidHex != "":
+		return netmanagerclient.ParseSSIDHex(ssidHex)
+	case ssid == "":
+		return nil, errors.New("--ssid or --ssid-hex is required")
+	}
+	return netmanagerclient.SSID(ssid), nil
+}
+
+// displaySSID shows the SSID, with its hex form if it isn't UTF-8 as then the display form doesn't have its bytes.
+func displaySSID(ssid netmanagerclient.SSID) string {
+	if ssid.IsUTF8() {
+		return ssid.String()
+	}
+	return fmt.Sprintf("%s (hex %s)", ssid, ssid.Hex())
+}
+
+func addWifiNetwork(args *AddNetwork) error {
+	ssid, err := ssidFromArgs(args.SSID, args.SSIDHex)
+	if err != nil {
+		return err
+	}
+	log.Println("Adding network. SSID: ", displaySSID(ssid), " Pass: ", args.Pass, " Security: ", args.Security, " Hidden: ", args.Hidden)
+	if args.Hidden {
+		return netmanagerclient.AddHiddenWifiNetwork(string(ssid), args.Pass, netmanagerclient.WifiSecurity(args.Security))
 	}
+	return netmanagerclient.AddWifiNetworkWithSecurity(string(ssid), args.Pass, netmanagerclient.WifiSecurity(args.Security))
+}
+
+func addWifiNetworkQR(args *AddNetworkQR) error {
+	qr, err := netmanagerclient.AddWifiNetworkFromQR(args.Payload)
+	if err != nil {
+		return err
+	}
+	log.Println("Added network. SSID: ", qr.SSID, " Security: ", qr.Security, " Hidden: ", qr.Hidden)
 	return nil
 }
 
-func addWifiNetwork(ssid, pass string) error {
-	log.Println("Adding network. SSID: ", ssid, " Pass: ", pass)
-	return netmanagerclient.AddWifiNetwork(ssid, pass)
+func setWifiNetworkHidden(args *SetNetworkHidden) error {
+	log.Println("Setting network hidden. ID: ", args.ID, " Hidden: ", args.Hidden)
+	return netmanagerclient.SetWifiNetworkHidden(args.ID, args.Hidden)
 }
 
-func removeWifiNetwork(ssid string) error {
-	log.Println("Removing network. SSID: ", ssid)
-	return netmanagerclient.RemoveWifiNetwork(ssid, false, false)
+func addEnterpriseWifiNetwork(args *AddEnterpriseNetwork) error {
+	ssid, err := ssidFromArgs(args.SSID, args.SSIDHex)
+	if err != nil {
+		return err
+	}
+	log.Println("Adding enterprise network. SSID: ", displaySSID(ssid), " Identity: ", args.Identity, " EAP: ", args.EAP, " Phase2: ", args.Phase2)
+	network := netmanagerclient.EnterpriseNetwork{
+		SSID:              string(ssid),
+		Security:          netmanagerclient.WifiSecurity(args.Security),
+		EAPMethod:         netmanagerclient.EAPMethod(args.EAP),
+		Phase2Auth:        args.Phase2,
+		Identity:          args.Identity,
+		AnonymousIdentity: args.AnonymousIdentity,
+		Password:          args.Pass,
+		Hidden:            args.Hidden,
+	}
+	if args.CACert != "" {
+		cert, err := os.ReadFile(args.CACert)
+		if err != nil {
+			return fmt.Errorf("failed to read CA certificate: %v", err)
+		}
+		network.CACert = cert
+	}
+	return netmanagerclient.AddEnterpriseWifiNetwork(network)
+}
+
+// setWifiNetworkIP sets the IPv4 or IPv6 config of the network, keeping the config of the other.
+func setWifiNetworkIP(args *SetNetworkIP) error {
+	config, err := netmanagerclient.GetWifiNetworkIPConfig(args.ID)
+	if err != nil {
+		return err
+	}
+	ipConfig := netmanagerclient.IPConfig{
+		Method:    netmanagerclient.IPMethod(args.Method),
+		Addresses: args.Addresses,
+		Gateway:   args.Gateway,
+		DNS:       args.DNS,
+	}
+	if args.IPv6 {
+		config.IPv6 = ipConfig
+	} else {
+		config.IPv4 = ipConfig
+	}
+	log.Printf("Setting IP config of '%s'. IPv4: %+v, IPv6: %+v", args.ID, config.IPv4, config.IPv6)
+	return netmanagerclient.SetWifiNetworkIPConfig(args.ID, config)
+}
+
+// hotspotQR prints just the payload so it can be piped into a QR code generator.
+func hotspotQR() error {
+	payload, err := netmanagerclient.GetHotspotQRPayload()
+	if err != nil {
+		return err
+	}
+	fmt.Println(payload)
+	return nil
+}
+
+func exportNetworks(args *ExportNetworks) error {
+	bundle, err := netmanagerclient.ExportWifiNetworks()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	if args.Output == "" {
+		fmt.Println(string(data))
+		return nil
+	}
+	// The export has the passwords of the networks so only root can read it.
+	if err := os.WriteFile(args.Output, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write networks: %v", err)
+	}
+	log.Printf("Exported %d networks to '%s'", len(bundle.Networks), args.Output)
+	return nil
+}
+
+func importNetworks(args *ImportNetworks) error {
+	data, err := os.ReadFile(args.Input)
+	if err != nil {
+		return fmt.Errorf("failed to read networks: %v", err)
+	}
+	bundle, err := netmanagerclient.ParseNetworkBundle(data)
+	if err != nil {
+		return err
+	}
+	if args.DryRun {
+		log.Println("Dry run, no networks will be changed.")
+	}
+	results, err := netmanagerclient.ImportWifiNetworks(bundle, netmanagerclient.ImportOptions{
+		Conflict: netmanagerclient.ConflictPolicy(args.Conflict),
+		DryRun:   args.DryRun,
+	})
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, result := range results {
+		switch {
+		case result.NewID != "":
+			log.Printf("'%s': %s as '%s'", result.ID, result.Action, result.NewID)
+		case result.Reason != "":
+			log.Printf("'%s': %s, %s", result.ID, result.Action, result.Reason)
+		default:
+			log.Printf("'%s': %s", result.ID, result.Action)
+		}
+		if result.Action == netmanagerclient.IMPORT_FAILED {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to import %d of %d networks", failed, len(results))
+	}
+	return nil
+}
+
+func removeWifiNetwork(args *RemoveNetwork) error {
+	if args.SSIDHex == "" {
+		if args.SSID == "" {
+			return errors.New("--ssid or --ssid-hex is required")
+		}
+		log.Println("Removing network. SSID: ", args.SSID)
+		return netmanagerclient.RemoveWifiNetwork(args.SSID, false, false)
+	}
+	ssid, err := ssidFromArgs(args.SSID, args.SSIDHex)
+	if err != nil {
+		return err
+	}
+	networks, err := netmanagerclient.FindSavedNetworksBySSID(ssid)
+	if err != nil {
+		return err
+	}
+	if len(networks) == 0 {
+		return fmt.Errorf("no saved network has the SSID '%s'", displaySSID(ssid))
+	}
+	for _, network := range networks {
+		log.Printf("Removing network. ID: '%s', SSID: '%s'", network.ID, displaySSID(ssid))
+		if err := netmanagerclient.RemoveWifiNetwork(network.ID, false, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func reorderWifiNetworks(ids []string) error {
+	log.Println("Reordering networks:", ids)
+	return netmanagerclient.ReorderWifiNetworks(ids)
 }
 
 func enableWifi(args Args) error {
@@ -205,13 +590,47 @@ func enableHotspot(args Args) error {
 	return netmanagerclient.EnableHotspot(args.EnableHotspot.Force)
 }
 
-func scanNetwork() error {
-	networks, err := netmanagerclient.ScanWiFiNetworks()
+func scanNetwork(args *ScanNetwork) error {
+	filter := netmanagerclient.ScanFilter{
+		SSID:      args.SSID,
+		Band:      netmanagerclient.WifiBand(args.Band),
+		MinSignal: args.MinSignal,
+		Saved:     args.Saved,
+	}
+	// Check the filter before waiting for the scan.
+	if err := filter.Validate(); err != nil {
+		return err
+	}
+	networks, err := netmanagerclient.ScanWifiNetworkGroups()
 	if err != nil {
 		return err
 	}
+	networks, err = netmanagerclient.FilterScannedNetworks(networks, filter)
+	if err != nil {
+		return err
+	}
+	if err := netmanagerclient.SortScannedNetworks(networks, netmanagerclient.ScanSort(args.Sort)); err != nil {
+		return err
+	}
+	if args.JSON {
+		data, err := json.MarshalIndent(networks, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
 	for _, network := range networks {
-		log.Printf("SSID: '%s', Quality: '%s', InUse: '%t'", network.SSID, network.Quality, network.InUse)
+		best := network.AccessPoints[0]
+		log.Printf("SSID: '%s', Signal: %d, Security: '%s', Saved: %t, InUse: %t, Access points: %d, Channel: %d (%s)",
+			displaySSID(network.RawSSID), network.Signal, network.Security, network.Saved, network.InUse, len(network.AccessPoints), best.Channel, best.Band)
+		if !args.AccessPoints {
+			continue
+		}
+		for _, ap := range network.AccessPoints {
+			log.Printf("\tBSSID: %s, Signal: %d, Channel: %d, Frequency: %d MHz, Band: %s, Max bitrate: %d Mbit/s, Security flags: '%s', InUse: %t",
+				ap.BSSID, ap.Signal, ap.Channel, ap.Frequency, ap.Band, ap.MaxBitrate, strings.Join(ap.SecurityFlags, " "), ap.InUse)
+		}
 	}
 	return nil
 }
@@ -225,6 +644,67 @@ func checkState() error {
 	return nil
 }
 
+func showPolicy() error {
+	policy, err := netmanagerclient.GetPolicy()
+	if err != nil {
+		return err
+	}
+	log.Printf("Scan and connect timeout: %s", policy.ScanConnectTimeout)
+	log.Printf("Hotspot fallback: %t", policy.HotspotFallback)
+	log.Printf("Hotspot fallback delay: %s", policy.HotspotFallbackDelay)
+	log.Printf("Hotspot timeout: %s", policy.HotspotTimeout)
+	log.Printf("Human interaction cutoff: %s", policy.HumanInteractionCutoff)
+	log.Printf("On shutdown: %s", policy.OnShutdown)
+	return nil
+}
+
+func reloadConfig() error {
+	log.Println("Reloading config.")
+	return netmanagerclient.ReloadConfig()
+}
+
+func stateHistory() error {
+	history, err := netmanagerclient.GetStateHistory()
+	if err != nil {
+		return err
+	}
+	for _, t := range history {
+		trigger := string(t.Trigger)
+		if t.Detail != "" {
+			trigger += " (" + t.Detail + ")"
+		}
+		log.Printf("%s %s -> %s, Connection: '%s', BSSID: '%s', Trigger: %s",
+			t.Time.Local().Format(time.DateTime), t.OldState, t.NewState, t.ConnectionName, t.BSSID, trigger)
+	}
+	return nil
+}
+
+func showErrors() error {
+	errs, err := netmanagerclient.GetErrors()
+	if err != nil {
+		return err
+	}
+	if errs.LastError == "" {
+		log.Println("No errors.")
+		return nil
+	}
+	log.Printf("Last error at %s: %s", errs.LastErrorTime.Local().Format(time.DateTime), errs.LastError)
+	if !errs.RetryAt.IsZero() {
+		log.Printf("In error state after %d errors, will try to recover at %s",
+			errs.ConsecutiveErrors, errs.RetryAt.Local().Format(time.DateTime))
+	}
+	ops := []string{}
+	for op := range errs.Operations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		e := errs.Operations[op]
+		log.Printf("'%s' failed %d times, last at %s: %s", op, e.Count, e.LastTime.Local().Format(time.DateTime), e.LastError)
+	}
+	return nil
+}
+
 // GetStateChanges will start listening for state changes.
 func makeNetworkUpdateChan() (chan struct{}, chan<- struct{}, error) {
 	stateChan := make(chan struct{}, 10)
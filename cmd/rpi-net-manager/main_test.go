@@ -3,7 +3,9 @@ package main
 import (
 	"testing"
 
+	netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDefaults(t *testing.T) {
@@ -43,4 +45,61 @@ AP[6].BSSID:36:A4:3C:4F:0A:E4
 
 	_, err = getActiveBSSIDFromOutput(output2)
 	assert.Error(t, err)
+
+	output3 := `AP[1].SIGNAL:44
+AP[1].IN-USE:
+AP[2].SIGNAL:81
+AP[2].IN-USE:*
+`
+	signal, err := getActiveAPFieldFromOutput(output3, "SIGNAL")
+	assert.NoError(t, err)
+	assert.Equal(t, "81", signal)
+
+	// nmcli escapes the colons in the BSSID.
+	output4 := `AP[1].BSSID:70\:A7\:41\:DC\:5D\:21
+AP[1].IN-USE:
+AP[2].BSSID:70\:A7\:41\:DC\:64\:21
+AP[2].IN-USE:*
+`
+	bssid, err = getActiveBSSIDFromOutput(output4)
+	assert.NoError(t, err)
+	assert.Equal(t, "70:A7:41:DC:64:21", bssid)
+}
+
+func TestAddressFromOutput(t *testing.T) {
+	tests := []struct {
+		output  string
+		ipv6    bool
+		address string
+	}{
+		{"IP4.ADDRESS[1]:192.168.1.5/24\nIP4.ADDRESS[2]:10.0.0.5/8\n", false, "192.168.1.5/24"},
+		{"", false, ""},
+		{"IP6.ADDRESS[1]:fe80::1/64\nIP6.ADDRESS[2]:2001:db8::5/64\n", true, "2001:db8::5/64"},
+		{"IP6.ADDRESS[1]:fe80::1/64\n", true, ""},
+		{`IP6.ADDRESS[1]:fe80\:\:1/64` + "\n" + `IP6.ADDRESS[2]:2001\:db8\:\:5/64` + "\n", true, "2001:db8::5/64"},
+	}
+	for _, tt := range tests {
+		address, err := getAddressFromOutput(tt.output, tt.ipv6)
+		assert.NoError(t, err, tt.output)
+		assert.Equal(t, tt.address, address, tt.output)
+	}
+	_, err := getAddressFromOutput("not nmcli output\n", false)
+	assert.Error(t, err)
+}
+
+func TestSSIDFromArgs(t *testing.T) {
+	ssid, err := ssidFromArgs("home", "")
+	require.NoError(t, err)
+	assert.Equal(t, netmanagerclient.SSID("home"), ssid)
+	ssid, err = ssidFromArgs("", "436166E9")
+	require.NoError(t, err)
+	assert.Equal(t, netmanagerclient.SSID("Caf\xe9"), ssid)
+
+	for _, args := range [][2]string{{"", ""}, {"home", "686F6D65"}, {"", "home"}} {
+		_, err := ssidFromArgs(args[0], args[1])
+		assert.Error(t, err, args)
+	}
+
+	assert.Equal(t, "home", displaySSID(netmanagerclient.SSID("home")))
+	assert.Equal(t, `Caf\xe9 (hex 436166E9)`, displaySSID(netmanagerclient.SSID("Caf\xe9")))
 }
@@ -1,11 +1,8 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"os"
-	"os/exec"
-	"strings"
+	"reflect"
 	"sync"
 	"time"
 
@@ -17,320 +14,682 @@ type networkStateMachine struct {
 	mux                  sync.Mutex
 	state                netmanagerclient.NetworkState
 	connName             string
-	wifiScanConnectTimer *time.Timer
-	wifiScanTimer        *time.Timer
-	hotspotTimer         *time.Timer
+	clock                clock
+	wifiScanConnectTimer timer
+	wifiScanTimer        timer
+	hotspotTimer         timer
+	errorRetryTimer      timer
+	watchdogTimer        timer
+	hiddenProbeTimer     timer
+	scanResultsTimer     timer
+	periodicScanTimer    timer
 	keepHotspotOnUntil   time.Time
 	NetworkUpdateChannel chan struct{}
 	hotspotFallback      bool
+	backend              NetworkBackend
+	dhcp                 dhcpServer
+	config               *serviceConfig
+	// trigger is what caused the last action taken by the service, it is recorded with the next state transition.
+	trigger       netmanagerclient.StateTrigger
+	triggerDetail string
+	history       []netmanagerclient.StateTransition
+	// networkFailures is the failed connection attempts of each saved network since it last connected.
+	networkFailures    map[string]netmanagerclient.NetworkFailure
+	connectionFailures <-chan ConnectionFailure
+	// networkStats is the connection statistics of each saved network.
+	networkStats map[string]netmanagerclient.NetworkStats
+	// attempt is the connection whose current attempt to connect has been counted.
+	attempt string
+	// connectedTo is the network that has been connected since connectedSince, for counting the time connected.
+	connectedTo    string
+	connectedSince time.Time
+	// scanResults is the access points found by the last scan.
+	scanResults netmanagerclient.ScanResults
+	// scanPending is set while waiting for a scan to finish, so scans asked for at the same time share it.
+	scanPending bool
+	// scanWanted is set when a scan has been asked for that couldn't be started in the state at the time.
+	scanWanted bool
+	// store, if set, is used to save the context of the state machine so it can be restored after a restart.
+	store *stateStore
+	// minutesSinceHumanInteraction is used to decide if the hotspot should be started as a fallback.
+	minutesSinceHumanInteraction func() (uint8, error)
+	// notifyState is called whenever the state changes.
+	notifyState func(netmanagerclient.NetworkState) error
+	// notifyError is called whenever an operation fails.
+	notifyError func(op string, err error) error
+	// notifyScanResults is called whenever there are new scan results.
+	notifyScanResults func() error
+	// notifyReady is called once the state has first been detected, even if the state machine then has an error.
+	notifyReady func() error
+	ready       bool
+	// notifyWatchdog is called at least every watchdogInterval while the state machine is running, 0 to disable.
+	notifyWatchdog   func() error
+	watchdogInterval time.Duration
+	// operationErrors are the errors from each operation the service has run.
+	operationErrors   map[string]*netmanagerclient.OperationErrors
+	consecutiveErrors int
+	lastError         error
+	lastErrorTime     time.Time
+	// lastFatalErrorTime is when the state machine last went into the error state.
+	lastFatalErrorTime time.Time
+	errorRetryAt       time.Time
+	// quit will stop the state machine loop when closed.
+	quit chan struct{}
+	// onIdle, if set, is called each time the state machine has finished processing and is about to wait for the next event.
+	onIdle func()
+}
+
+func newNetworkStateMachine(backend NetworkBackend, dhcp dhcpServer, updates chan struct{}, clock clock, config *serviceConfig) *networkStateMachine {
+	policy := config.Policy
+	return &networkStateMachine{
+		NetworkUpdateChannel:         updates,
+		state:                        netmanagerclient.NS_INIT,
+		clock:                        clock,
+		wifiScanConnectTimer:         newPolicyTimer(clock, policy.ScanConnectTimeout),
+		wifiScanTimer:                newPolicyTimer(clock, policy.HotspotFallbackDelay),
+		hotspotTimer:                 newPolicyTimer(clock, policy.HotspotTimeout),
+		errorRetryTimer:              newPolicyTimer(clock, 0),
+		watchdogTimer:                newPolicyTimer(clock, 0),
+		hiddenProbeTimer:             newPolicyTimer(clock, 0),
+		scanResultsTimer:             newPolicyTimer(clock, 0),
+		periodicScanTimer:            newPolicyTimer(clock, 0),
+		hotspotFallback:              policy.HotspotFallback,
+		backend:                      backend,
+		dhcp:                         dhcp,
+		config:                       config,
+		trigger:                      netmanagerclient.TRIGGER_STARTUP,
+		networkFailures:              map[string]netmanagerclient.NetworkFailure{},
+		connectionFailures:           backend.ConnectionFailures(),
+		networkStats:                 map[string]netmanagerclient.NetworkStats{},
+		minutesSinceHumanInteraction: getMinutesSinceHumanInteraction,
+		notifyState:                  sendNewNetworkState,
+		notifyError:                  sendServiceError,
+		notifyScanResults:            sendScanResultsUpdated,
+		notifyReady:                  sdNotifyReady,
+		notifyWatchdog:               sdNotifyWatchdog,
+		operationErrors:              map[string]*netmanagerclient.OperationErrors{},
+		quit:                         make(chan struct{}),
+	}
 }
 
 func (nsm *networkStateMachine) handleStateTransition(newState netmanagerclient.NetworkState, newConName string) error {
-	oldConName := nsm.connName
 	nsm.connName = newConName
 	oldState := nsm.state
+	nsm.updateNetworkStats(newState, newConName)
 	if newState == oldState {
 		return nil
 	}
 	nsm.setState(newState)
 	log.Printf("State transition: %s -> %s, Active Connection: '%s'", oldState, newState, newConName)
-	logBssid()
-
-	// If going from CONNECTING to SCANNING then the connection probably failed.
-	if oldState == netmanagerclient.NS_WIFI_CONNECTING && newState == netmanagerclient.NS_WIFI_SCANNING {
-		// Check if connection failed. Note that this can be for multiple different reasons, wrong password, bad connection...
-		threeSecondsAgo := time.Now().Add(-3 * time.Second).Format("2006-01-02 15:04:05")
-		out, err := exec.Command("journalctl", "-u", "NetworkManager", "--no-pager", "--since", threeSecondsAgo).CombinedOutput()
-		if err != nil {
-			return err
-		}
-		if strings.Contains(string(out), fmt.Sprintf("Activation: failed for connection '%s'", oldConName)) {
-			log.Printf("Failed to connect to '%s'", oldConName)
-			// Set auth retries to 1, this will make it fail sooner in the future if it fails again.
-			// Don't want to disable autoconnect because it might be some other issue causing it to fail to connect.
-			// If it is successfully connect to in the future it will be set back to 2.
-			// Reading the value of auth-retries is used to determine if the connection has failed.
-			if err := runNMCli("connection", "modify", oldConName, "connection.auth-retries", "1"); err != nil {
-				log.Printf("failed to set auth-retries to 1, '%s'", err)
-			}
-		}
-	}
 
+	policy := nsm.config.Policy
 	switch newState {
 	case netmanagerclient.NS_WIFI_SCANNING:
 		log.Println("Restarting wifi scan timer")
-		resetTimer(nsm.wifiScanTimer, 10*time.Second)
+		setPolicyTimer(nsm.wifiScanTimer, policy.HotspotFallbackDelay)
 		// Reset timer for wifi to scan and connect to a network.
 		if oldState != netmanagerclient.NS_WIFI_CONNECTING {
-			resetTimer(nsm.wifiScanConnectTimer, 10*time.Minute)
+			setPolicyTimer(nsm.wifiScanConnectTimer, policy.ScanConnectTimeout)
 		}
+		resetTimer(nsm.periodicScanTimer, nsm.scanInterval())
+		nsm.probeHiddenNetworks()
 
 	case netmanagerclient.NS_HOTSPOT_RUNNING:
-		// Reset timer for hotspot when it has started up.
-		resetTimer(nsm.hotspotTimer, 5*time.Minute)
+		// Reset timer for hotspot when it has started up, unless it has been asked to stay on for longer.
+		setPolicyTimer(nsm.hotspotTimer, nsm.hotspotDuration())
 
 	case netmanagerclient.NS_WIFI_CONNECTED:
+		delete(nsm.networkFailures, newConName)
+		resetTimer(nsm.periodicScanTimer, nsm.scanInterval())
 		// Set auth retries to 2 in case it was set to 1 previously.
-		if err := runNMCli("connection", "modify", newConName, "connection.auth-retries", "2"); err != nil {
+		if err := nsm.backend.ModifyConnection(newConName, map[string]string{"connection.auth-retries": "2"}); err != nil {
 			log.Printf("failed to set auth-retries to 2, '%s'", err)
 		}
 	}
 	return nil
 }
 
+// handleConnectionFailure records a failed attempt to connect to a saved network. Needs to be called with the mutex locked.
+func (nsm *networkStateMachine) handleConnectionFailure(f ConnectionFailure) {
+	log.Printf("Failed to connect to '%s': %s", f.ID, f.Reason)
+	failure := nsm.networkFailures[f.ID]
+	failure.Count++
+	failure.LastFailure = nsm.clock.Now()
+	failure.Reason = f.Reason
+	nsm.networkFailures[f.ID] = failure
+	nsm.recordFailureStats(f)
+	if f.Reason != netmanagerclient.FAILURE_BAD_SECRETS {
+		return
+	}
+	// Set auth retries to 1, this will make it fail sooner in the future if it fails again.
+	// Don't want to disable autoconnect because the password might be fixed on the access point.
+	// If it is successfully connect to in the future it will be set back to 2.
+	// Reading the value of auth-retries is used to determine if the connection has failed when the service isn't running.
+	if err := nsm.backend.ModifyConnection(f.ID, map[string]string{"connection.auth-retries": "1"}); err != nil {
+		log.Printf("failed to set auth-retries to 1, '%s'", err)
+	}
+}
+
 // Utility function to safely reset a timer
-func resetTimer(timer *time.Timer, duration time.Duration) {
-	if timer == nil {
-		timer = time.NewTimer(duration)
+func resetTimer(t timer, duration time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C(): // Drain the channel if needed
+		default:
+		}
 	}
-	if !(timer).Stop() {
+	t.Reset(duration)
+}
+
+// stopTimer stops the timer and drains the channel if it had already fired.
+func stopTimer(t timer) {
+	if !t.Stop() {
 		select {
-		case <-(*timer).C: // Drain the channel if needed
+		case <-t.C():
 		default:
 		}
 	}
-	timer.Reset(duration)
 }
 
-func (nsm *networkStateMachine) runStateMachine() error {
-	log.Println("Starting Network Manager state machine")
-	if err := runNMCli("radio", "wifi", "on"); err != nil {
-		return err
+// setPolicyTimer resets the timer, or stops it if the policy has disabled the timeout by setting it to 0.
+func setPolicyTimer(t timer, duration time.Duration) {
+	if duration == 0 {
+		stopTimer(t)
+		return
 	}
+	resetTimer(t, duration)
+}
 
-	// Timeout flags
-	wifiScanConnectTimeout := false
-	wifiScanTimeout := false
-	hotspotTimeout := false
+func newPolicyTimer(clock clock, duration time.Duration) timer {
+	if duration == 0 {
+		t := clock.NewTimer(time.Hour)
+		stopTimer(t)
+		return t
+	}
+	return clock.NewTimer(duration)
+}
+
+// timeouts are the timers that have fired and are waiting to be handled.
+type timeouts struct {
+	wifiScanConnect bool
+	wifiScan        bool
+	hotspot         bool
+	errorRetry      bool
+	hiddenProbe     bool
+	scanResults     bool
+	periodicScan    bool
+}
+
+func (nsm *networkStateMachine) runStateMachine() error {
+	log.Println("Starting Network Manager state machine")
 
 	nsm.mux.Lock()
 	defer nsm.mux.Unlock()
 
+	var timeouts timeouts
+	startErr := opErr(opWifiRadioOn, nsm.backend.SetWifiRadio(true))
+
 	for {
-		// Look at the network setup to determine what network state the device is in.
-		newState, conName, err := detectState()
-		if err != nil {
-			return err
-		}
-		// Handle state transitions, this will reset appropriate timers if needed.
-		err = nsm.handleStateTransition(newState, conName)
-		if err != nil {
-			return err
+		// Scan results are read in every state, so a scan that was running when the service had an error
+		// doesn't stay pending until it recovers.
+		if timeouts.scanResults {
+			timeouts.scanResults = false
+			nsm.readScanResults()
 		}
-
-		// Update the state
-		switch nsm.state {
-		case netmanagerclient.NS_WIFI_OFF:
-			// Turn wifi back on if button is pressed, this will get handled elsewhere.
-		case netmanagerclient.NS_WIFI_SCANNING:
-			if wifiScanConnectTimeout {
-				wifiScanConnectTimeout = false
-				log.Println("Wifi scan connect timeout, powering off wifi")
-				if err := runNMCli("radio", "wifi", "off"); err != nil {
-					return err
-				}
-			}
-			if wifiScanTimeout {
-				wifiScanTimeout = false
-				if nsm.hotspotFallback {
-					// Checking if the hotspot should turn on.
-					minutes, err := getMinutesSinceHumanInteraction()
-					log.Info("Minutes since human interaction:", minutes)
-					if err != nil {
-						return fmt.Errorf("failed to get minutes since human interaction: %v", err)
-					}
-					if minutes > 60 {
-						log.Info("Not falling back to hosting hotspot as there has not been a user interaction in 60 minutes")
-						break
-					}
-					nsm.hotspotFallback = false
-					log.Info("Enable hotspot")
-					if err := nsm.setupHotspot(); err != nil {
-						return err
-					}
-				}
-			}
-		case netmanagerclient.NS_WIFI_CONNECTING:
-			// Nothing to do
-		case netmanagerclient.NS_WIFI_CONNECTED:
-			// Nothing to do
-		case netmanagerclient.NS_HOTSPOT_STARTING:
-			// Nothing to do
-		case netmanagerclient.NS_HOTSPOT_RUNNING:
-			if hotspotTimeout {
-				hotspotTimeout = false
-				log.Println("Hotspot timeout, powering off hotspot")
-				nsm.setupWifi() // Enabling wifi will disable the hotspot, then it will scan the network once again then.
+		err := startErr
+		startErr = nil
+		if err == nil && nsm.state == netmanagerclient.NS_ERROR {
+			// Only try to recover when the retry timer fires, so errors are backed off.
+			if timeouts.errorRetry {
+				timeouts.errorRetry = false
+				nsm.setTrigger(netmanagerclient.TRIGGER_TIMER, "error retry")
+				err = nsm.recover()
 			}
-		default:
-			log.Error("Unhandled network state:", nsm.state)
+		} else if err == nil {
+			err = nsm.update(&timeouts)
+		}
+		if err != nil {
+			nsm.handleError(err)
 		}
+		nsm.pingWatchdog()
 
+		nsm.saveState()
 		nsm.mux.Unlock()
+		if nsm.onIdle != nil {
+			nsm.onIdle()
+		}
 		select {
-		case <-nsm.wifiScanConnectTimer.C:
+		case <-nsm.wifiScanConnectTimer.C():
+			nsm.mux.Lock()
 			if nsm.state == netmanagerclient.NS_WIFI_SCANNING || nsm.state == netmanagerclient.NS_WIFI_CONNECTING {
 				// log.Println("Wifi scan connect timeout")
-				wifiScanConnectTimeout = true
+				timeouts.wifiScanConnect = true
 			}
-		case <-nsm.wifiScanTimer.C:
+		case <-nsm.wifiScanTimer.C():
+			nsm.mux.Lock()
 			if nsm.state == netmanagerclient.NS_WIFI_SCANNING {
 				// log.Println("Wifi scan timeout")
-				wifiScanTimeout = true
+				timeouts.wifiScan = true
 			}
-		case <-nsm.hotspotTimer.C:
+		case <-nsm.hotspotTimer.C():
+			nsm.mux.Lock()
 			if nsm.state == netmanagerclient.NS_HOTSPOT_RUNNING {
 				// log.Println("Hotspot timeout")
-				hotspotTimeout = true
+				timeouts.hotspot = true
+			}
+		case <-nsm.errorRetryTimer.C():
+			nsm.mux.Lock()
+			if nsm.state == netmanagerclient.NS_ERROR {
+				timeouts.errorRetry = true
+			}
+		case <-nsm.watchdogTimer.C():
+			nsm.mux.Lock()
+		case <-nsm.hiddenProbeTimer.C():
+			nsm.mux.Lock()
+			if nsm.state == netmanagerclient.NS_WIFI_SCANNING {
+				timeouts.hiddenProbe = true
+			}
+		case <-nsm.scanResultsTimer.C():
+			nsm.mux.Lock()
+			timeouts.scanResults = true
+		case <-nsm.periodicScanTimer.C():
+			nsm.mux.Lock()
+			if nsm.canScan() {
+				timeouts.periodicScan = true
 			}
 		case <-nsm.NetworkUpdateChannel:
 			// log.Println("Network update")
+			nsm.mux.Lock()
+		case failure := <-nsm.connectionFailures:
+			nsm.mux.Lock()
+			nsm.handleConnectionFailure(failure)
+		case <-nsm.quit:
+			log.Println("Stopping Network Manager state machine")
+			nsm.mux.Lock()
+			return nil
 		}
-		nsm.mux.Lock()
 	}
 }
 
-func getActiveBSSIDFromOutput(output string) (string, error) {
-	lines := strings.Split(output, "\n")
-	inUseAPID := ""
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.Contains(line, ".IN-USE:*") {
-			inUseAPID = strings.Split(line, ".")[0]
-			break
-		}
+// setReady lets systemd know the service has started, once the state has first been detected.
+// Errors after that are recovered from by the state machine, so don't stop the service from starting.
+// Needs to be called with the mutex locked.
+func (nsm *networkStateMachine) setReady() {
+	if nsm.ready {
+		return
+	}
+	nsm.ready = true
+	if err := nsm.notifyReady(); err != nil {
+		log.Println(err)
+	}
+}
+
+// pingWatchdog lets systemd know the state machine is still running. The watchdog timer makes
+// sure the loop runs, and so pings, often enough even when nothing else is happening.
+func (nsm *networkStateMachine) pingWatchdog() {
+	if nsm.watchdogInterval == 0 {
+		return
 	}
+	if err := nsm.notifyWatchdog(); err != nil {
+		log.Println(err)
+	}
+	resetTimer(nsm.watchdogTimer, nsm.watchdogInterval)
+}
 
-	if inUseAPID == "" {
-		return "", fmt.Errorf("no active AP found")
+// update detects the state of the network and handles any timeouts for that state.
+// Needs to be called with the mutex locked.
+func (nsm *networkStateMachine) update(timeouts *timeouts) error {
+	// Look at the network setup to determine what network state the device is in.
+	newState, conName, err := nsm.detectState()
+	if err != nil {
+		return opErr(opDetectState, err)
+	}
+	nsm.setReady()
+	// Handle state transitions, this will reset appropriate timers if needed.
+	if err := nsm.handleStateTransition(newState, conName); err != nil {
+		return opErr(opStateTransition, err)
 	}
 
-	for _, line := range lines {
-		if strings.HasPrefix(line, inUseAPID+".BSSID:") {
-			parts := strings.SplitN(line, ":", 2)
-			if len(parts) == 2 {
-				return parts[1], nil
-			}
+	if timeouts.periodicScan {
+		timeouts.periodicScan = false
+		// Keep on scanning even if this scan fails to start.
+		resetTimer(nsm.periodicScanTimer, nsm.scanInterval())
+		if !nsm.scanPending && nsm.canScan() {
+			nsm.startScan()
 		}
 	}
+	if nsm.scanWanted && !nsm.scanPending && nsm.canScan() {
+		nsm.startScan()
+	}
 
-	return "", fmt.Errorf("no BSSID found")
+	// Update the state
+	switch nsm.state {
+	case netmanagerclient.NS_WIFI_OFF:
+		// Turn wifi back on if button is pressed, this will get handled elsewhere.
+	case netmanagerclient.NS_WIFI_SCANNING:
+		if timeouts.hiddenProbe {
+			timeouts.hiddenProbe = false
+			nsm.probeHiddenNetworks()
+		}
+		if timeouts.wifiScanConnect {
+			timeouts.wifiScanConnect = false
+			log.Println("Wifi scan connect timeout, powering off wifi")
+			nsm.setTrigger(netmanagerclient.TRIGGER_TIMER, "scan-connect timeout")
+			if err := nsm.backend.SetWifiRadio(false); err != nil {
+				return opErr(opWifiRadioOff, err)
+			}
+		}
+		if timeouts.wifiScan {
+			timeouts.wifiScan = false
+			if nsm.hotspotFallback {
+				// Checking if the hotspot should turn on.
+				if cutoff := nsm.config.Policy.HumanInteractionCutoff; cutoff != 0 {
+					minutes, err := nsm.minutesSinceHumanInteraction()
+					log.Info("Minutes since human interaction:", minutes)
+					if err != nil {
+						// Not knowing when there was a human interaction isn't a reason to stop the hotspot from starting.
+						nsm.recordError(opErr(opHumanInteraction, err))
+					} else if time.Duration(minutes)*time.Minute > cutoff {
+						log.Infof("Not falling back to hosting hotspot as there has not been a user interaction in %s", cutoff)
+						break
+					}
+				}
+				nsm.hotspotFallback = false
+				log.Info("Enable hotspot")
+				nsm.setTrigger(netmanagerclient.TRIGGER_TIMER, "hotspot fallback")
+				if err := nsm.setupHotspot(); err != nil {
+					// Let the fallback happen again once the service has recovered.
+					nsm.hotspotFallback = true
+					return opErr(opStartHotspot, err)
+				}
+			}
+		}
+	case netmanagerclient.NS_WIFI_CONNECTING:
+		// Nothing to do
+	case netmanagerclient.NS_WIFI_CONNECTED:
+		// Nothing to do
+	case netmanagerclient.NS_HOTSPOT_STARTING:
+		// Nothing to do
+	case netmanagerclient.NS_HOTSPOT_RUNNING:
+		if timeouts.hotspot {
+			timeouts.hotspot = false
+			log.Println("Hotspot timeout, powering off hotspot")
+			nsm.setTrigger(netmanagerclient.TRIGGER_TIMER, "hotspot timeout")
+			// Enabling wifi will disable the hotspot, then it will scan the network once again then.
+			if err := nsm.setupWifi(); err != nil {
+				return opErr(opStartWifi, err)
+			}
+		}
+	default:
+		log.Error("Unhandled network state:", nsm.state)
+	}
+	return nil
 }
 
-func logBssid() {
-	bssidOutRaw, err := exec.Command("nmcli", "--terse", "--fields", "AP.BSSID,AP.IN-USE", "device", "show", "wlan0").CombinedOutput()
+// hiddenProbeInterval is how often to probe for hidden networks while scanning.
+const hiddenProbeInterval = 30 * time.Second
+
+// probeHiddenNetworks asks for a scan that probes for the saved hidden networks, as they can't be found by
+// listening for beacons. NetworkManager then connects to them the same as any other network it finds.
+// Needs to be called with the mutex locked.
+func (nsm *networkStateMachine) probeHiddenNetworks() {
+	resetTimer(nsm.hiddenProbeTimer, hiddenProbeInterval)
+	ssids, err := nsm.backend.HiddenWifiSSIDs()
 	if err != nil {
-		log.Printf("failed to run nmcli: %v, output: %s", err, bssidOutRaw)
+		nsm.recordError(opErr(opProbeHidden, err))
 		return
 	}
-	bssid, err := getActiveBSSIDFromOutput(string(bssidOutRaw))
-	if err != nil {
-		log.Printf("failed to get active bssid: %v, output: %s", err, bssidOutRaw)
+	if len(ssids) == 0 {
+		return
+	}
+	log.Println("Probing for hidden networks:", ssids)
+	if err := nsm.backend.RequestWifiScan("wlan0", ssids); err != nil {
+		// Not finding a hidden network isn't a reason to stop trying to connect to the others.
+		nsm.recordError(opErr(opProbeHidden, err))
 		return
 	}
+	nsm.scanStarted()
+}
+
+func (nsm *networkStateMachine) activeBSSID() string {
+	bssid, err := nsm.backend.ActiveBSSID("wlan0")
+	if err != nil {
+		log.Printf("failed to get active bssid: %v", err)
+		return ""
+	}
 	log.Info("Active BSSID:", bssid)
+	return bssid
 }
 
 func (nsm *networkStateMachine) keepHotspotOnFor(keepOnFor time.Duration) {
-	newKeepOnUntil := time.Now().Add(keepOnFor)
+	if nsm.config.Policy.HotspotTimeout == 0 {
+		log.Println("Keep hotspot on for", keepOnFor, "but the hotspot doesn't time out")
+		return
+	}
+	newKeepOnUntil := nsm.clock.Now().Add(keepOnFor)
 	if newKeepOnUntil.After(nsm.keepHotspotOnUntil) {
 		log.Println("Keep hotspot on for", keepOnFor)
 		nsm.keepHotspotOnUntil = newKeepOnUntil
 		resetTimer(nsm.hotspotTimer, keepOnFor)
 	} else {
-		log.Printf("Keep hotspot on for %s, but already on for %s", keepOnFor, time.Until(nsm.keepHotspotOnUntil))
+		log.Printf("Keep hotspot on for %s, but already on for %s", keepOnFor, nsm.keepHotspotOnUntil.Sub(nsm.clock.Now()))
+	}
+}
+
+// hotspotDuration is how long the hotspot should stay on for from now, 0 if it shouldn't turn off.
+func (nsm *networkStateMachine) hotspotDuration() time.Duration {
+	duration := nsm.config.Policy.HotspotTimeout
+	if keepOnFor := nsm.keepHotspotOnUntil.Sub(nsm.clock.Now()); duration != 0 && keepOnFor > duration {
+		duration = keepOnFor
 	}
+	return duration
+}
+
+// reloadConfig reads the config from the directory and applies it.
+// If the config can't be read or is invalid the current config is kept.
+func (nsm *networkStateMachine) reloadConfig(configDir string) error {
+	conf, err := loadConfig(configDir)
+	if err != nil {
+		return fmt.Errorf("failed to reload config: %v", err)
+	}
+	nsm.mux.Lock()
+	defer nsm.mux.Unlock()
+	return nsm.applyConfig(conf)
+}
+
+// applyConfig changes the config of a running state machine. Timers that are running are restarted
+// with the new durations, and the hotspot is updated if it is running.
+func (nsm *networkStateMachine) applyConfig(conf *serviceConfig) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	old := nsm.config
+	nsm.config = conf
+	log.Println("Applying new config")
+
+	if !reflect.DeepEqual(old.Bushnet, conf.Bushnet) {
+		log.Println("Updating bushnet networks")
+		if err := setupBushnetNetworks(nsm.backend, conf.Bushnet); err != nil {
+			return err
+		}
+		if err := removeBushnetNetworks(nsm.backend, old.Bushnet, conf.Bushnet); err != nil {
+			return err
+		}
+	}
+
+	if old.Policy != conf.Policy {
+		log.Println("Updating network policy")
+		if old.Policy.HotspotFallback != conf.Policy.HotspotFallback {
+			nsm.hotspotFallback = conf.Policy.HotspotFallback
+		}
+		switch nsm.state {
+		case netmanagerclient.NS_WIFI_SCANNING:
+			if old.Policy.HotspotFallbackDelay != conf.Policy.HotspotFallbackDelay {
+				setPolicyTimer(nsm.wifiScanTimer, conf.Policy.HotspotFallbackDelay)
+			}
+			fallthrough
+		case netmanagerclient.NS_WIFI_CONNECTING:
+			if old.Policy.ScanConnectTimeout != conf.Policy.ScanConnectTimeout {
+				setPolicyTimer(nsm.wifiScanConnectTimer, conf.Policy.ScanConnectTimeout)
+			}
+		case netmanagerclient.NS_HOTSPOT_RUNNING:
+			if old.Policy.HotspotTimeout != conf.Policy.HotspotTimeout {
+				setPolicyTimer(nsm.hotspotTimer, nsm.hotspotDuration())
+			}
+		}
+	}
+
+	hotspotUp := nsm.state == netmanagerclient.NS_HOTSPOT_RUNNING || nsm.state == netmanagerclient.NS_HOTSPOT_STARTING
+	if hotspotUp && !reflect.DeepEqual(old.Hotspot, conf.Hotspot) {
+		log.Println("Updating running hotspot")
+		if !reflect.DeepEqual(hotspotConnectionConfig(old.Hotspot), hotspotConnectionConfig(conf.Hotspot)) {
+			if err := nsm.backend.ModifyConnection(bushnetHotspot, hotspotConnectionConfig(conf.Hotspot)); err != nil {
+				return err
+			}
+			// Bring the hotspot up again so NetworkManager uses the new settings.
+			if err := nsm.backend.ConnectionUp(bushnetHotspot); err != nil {
+				return err
+			}
+		}
+		if err := nsm.dhcp.Start(conf.Hotspot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setTrigger sets what caused the action the service is about to take.
+func (nsm *networkStateMachine) setTrigger(trigger netmanagerclient.StateTrigger, detail string) {
+	nsm.trigger = trigger
+	nsm.triggerDetail = detail
+}
+
+const maxStateHistory = 200
+
+// recordTransition adds the transition to the history. Any transitions after this one
+// are put down to NetworkManager until the service takes another action.
+func (nsm *networkStateMachine) recordTransition(oldState, newState netmanagerclient.NetworkState) {
+	nsm.history = append(nsm.history, netmanagerclient.StateTransition{
+		Time:           nsm.clock.Now(),
+		OldState:       oldState,
+		NewState:       newState,
+		ConnectionName: nsm.connName,
+		BSSID:          nsm.activeBSSID(),
+		Trigger:        nsm.trigger,
+		Detail:         nsm.triggerDetail,
+	})
+	if len(nsm.history) > maxStateHistory {
+		nsm.history = nsm.history[len(nsm.history)-maxStateHistory:]
+	}
+	nsm.setTrigger(netmanagerclient.TRIGGER_NM_SIGNAL, "")
 }
 
 func (nsm *networkStateMachine) setState(ns netmanagerclient.NetworkState) {
 	if nsm.state != ns {
 		log.Printf("State changed from %s to %s", nsm.state, ns)
+		nsm.recordTransition(nsm.state, ns)
+		if ns != netmanagerclient.NS_WIFI_CONNECTED && ns != netmanagerclient.NS_ERROR {
+			nsm.endConnectedSession()
+		}
 		nsm.state = ns
-		err := sendNewNetworkState(ns)
+		err := nsm.notifyState(ns)
 		if err != nil {
 			log.Println(err)
 		}
 	}
 }
 
-func runNMCli(args ...string) error {
-	out, err := exec.Command("nmcli", args...).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to run nmcli: %v, output: %s", err, out)
-	}
-	return nil
-}
-
 const bushnetHotspot = "BushnetHotspot"
 
 func (nsm *networkStateMachine) setupHotspot() error {
 	nsm.setState(netmanagerclient.NS_HOTSPOT_STARTING)
 	log.Println("Turn wifi radio on.")
-	if err := runNMCli("radio", "wifi", "on"); err != nil {
+	if err := nsm.backend.SetWifiRadio(true); err != nil {
 		return err
 	}
 
 	log.Println("Setting up network for hosting a hotspot.")
-	hotspotConfig := map[string]string{
-		"connection.type":              "802-11-wireless",
-		"ifname":                       "wlan0",
-		"autoconnect":                  "no",
-		"ssid":                         "bushnet",
-		"802-11-wireless.mode":         "ap",
-		"802-11-wireless.band":         "bg",
-		"ipv4.method":                  "manual", // Using 'manual' instead of 'shared' so can configure dnsmasq to not share the internet connection of the modem to connected devices.
-		"wifi-sec.key-mgmt":            "wpa-psk",
-		"wifi-sec.psk":                 "feathers",
-		"ipv4.addresses":               router_ip + "/24",
-		"802-11-wireless-security.pmf": "disable", // Android has issues with PMF
-	}
-
-	if err := netmanagerclient.ModifyNetworkConfig(bushnetHotspot, hotspotConfig); err != nil {
+	hotspot := nsm.config.Hotspot
+	if err := nsm.backend.ModifyConnection(bushnetHotspot, hotspotConnectionConfig(hotspot)); err != nil {
 		return err
 	}
 
 	log.Println("Starting hotspot...")
-	if err := runNMCli("connection", "up", bushnetHotspot); err != nil {
+	if err := nsm.backend.ConnectionUp(bushnetHotspot); err != nil {
 		return err
 	}
 
-	if err := createDNSConfig("192.168.4.2,192.168.4.20"); err != nil {
+	return nsm.dhcp.Start(hotspot)
+}
+
+// stopHotspot stops the hotspot and DHCP server if they are running.
+func (nsm *networkStateMachine) stopHotspot() error {
+	if err := nsm.dhcp.Stop(); err != nil {
 		return err
 	}
-
-	log.Printf("Starting DNS...")
-	if err := exec.Command("systemctl", "restart", "dnsmasq").Run(); err != nil {
+	conns, err := nsm.backend.ActiveConnections()
+	if err != nil {
 		return err
 	}
+	for _, conn := range conns {
+		if conn.Name == bushnetHotspot {
+			log.Println("Stopping hotspot")
+			return nsm.backend.ConnectionDown(bushnetHotspot)
+		}
+	}
 	return nil
 }
 
-func detectState() (netmanagerclient.NetworkState, string, error) {
-	out, err := exec.Command("nmcli", "radio", "wifi").CombinedOutput()
+// shutdown applies the shutdown policy to the network. Call once the state machine has stopped.
+func (nsm *networkStateMachine) shutdown() error {
+	nsm.mux.Lock()
+	defer nsm.mux.Unlock()
+	defer nsm.saveState()
+	// The connection might stay up, it is picked up again if the service starts again on this boot.
+	nsm.countConnectedTime()
+	switch nsm.config.Policy.OnShutdown {
+	case ShutdownStopHotspot:
+		return nsm.stopHotspot()
+	default:
+		log.Println("Leaving network as it is")
+		return nil
+	}
+}
+
+func hotspotConnectionConfig(hotspot Hotspot) map[string]string {
+	return map[string]string{
+		"connection.type":              "802-11-wireless",
+		"ifname":                       "wlan0",
+		"autoconnect":                  "no",
+		"ssid":                         hotspot.SSID,
+		"802-11-wireless.mode":         "ap",
+		"802-11-wireless.band":         "bg",
+		"ipv4.method":                  "manual", // Using 'manual' instead of 'shared' so can configure dnsmasq to not share the internet connection of the modem to connected devices.
+		"wifi-sec.key-mgmt":            "wpa-psk",
+		"wifi-sec.psk":                 hotspot.PSK,
+		"ipv4.addresses":               hotspot.RouterAddress(),
+		"802-11-wireless-security.pmf": "disable", // Android has issues with PMF
+	}
+}
+
+func (nsm *networkStateMachine) detectState() (netmanagerclient.NetworkState, string, error) {
+	radioEnabled, err := nsm.backend.WifiRadioEnabled()
 	if err != nil {
-		return netmanagerclient.NS_ERROR, "", fmt.Errorf("error getting wifi radio state %s, err: %s", out, err)
+		return netmanagerclient.NS_ERROR, "", err
 	}
-	radioState := strings.TrimSpace(string(out))
-	if radioState == "disabled" {
+	if !radioEnabled {
 		return netmanagerclient.NS_WIFI_OFF, "", nil
-	} else if radioState != "enabled" {
-		return netmanagerclient.NS_ERROR, "", fmt.Errorf("unknown radio state '%s'", radioState)
 	}
 
 	// Get name of active network, if there is one.
 	wifiConnectionName := ""
-	out, err = exec.Command("nmcli", "--terse", "--fields", "TYPE,NAME", "connection", "show", "--active").CombinedOutput()
+	conns, err := nsm.backend.ActiveConnections()
 	if err != nil {
-		return netmanagerclient.NS_ERROR, "", fmt.Errorf("error running list of active connections %s, err: %s", out, err)
+		return netmanagerclient.NS_ERROR, "", err
 	}
-	lines := strings.Split(string(out), "\n")
-	for _, line := range lines {
-		parts := strings.Split(line, ":")
-		if len(parts) < 2 {
-			continue
-		}
-		if parts[0] == "802-11-wireless" {
-			wifiConnectionName = strings.Join(parts[1:], ":")
+	for _, conn := range conns {
+		if conn.Type == "802-11-wireless" {
+			wifiConnectionName = conn.Name
 		}
 	}
 
@@ -345,13 +704,18 @@ func detectState() (netmanagerclient.NetworkState, string, error) {
 
 	// Connected to a network. Check if it has a IP address.
 	// If it doesn't have an IP address it is still trying to connect, could have the wrong password.
-	out, err = exec.Command("nmcli", "--terse", "--fields", "IP4.ADDRESS", "connection", "show", wifiConnectionName).CombinedOutput()
+	// Static addresses are only added once the network is up, the same as from DHCP, and a network
+	// might only have IPv6 addresses, so either will do.
+	ipAddress, err := nsm.backend.ConnectionIP4Address(wifiConnectionName)
 	if err != nil {
-		return netmanagerclient.NS_ERROR, "", fmt.Errorf("error checking ip address of connection: %s, err: %s", out, err)
+		return netmanagerclient.NS_ERROR, "", err
+	}
+	if ipAddress == "" {
+		ipAddress, err = nsm.backend.ConnectionIP6Address(wifiConnectionName)
+		if err != nil {
+			return netmanagerclient.NS_ERROR, "", err
+		}
 	}
-
-	ipAddress := strings.TrimPrefix(string(out), "IP4.ADDRESS[1]:")
-	ipAddress = strings.TrimSpace(ipAddress)
 
 	if ipAddress == "" {
 		return netmanagerclient.NS_WIFI_CONNECTING, wifiConnectionName, nil
@@ -360,59 +724,25 @@ func detectState() (netmanagerclient.NetworkState, string, error) {
 	}
 }
 
-const router_ip = "192.168.4.1"
-
-func createDNSConfig(ip_range string) error {
-	file_name := "/etc/dnsmasq.conf"
-	config_lines := []string{
-		"interface=wlan0",
-		"dhcp-range=" + ip_range + ",12h",
-		"domain=wlan",
-		"server=1.1.1.1",
-		"server=8.8.8.8",
-	}
-	return createConfigFile(file_name, config_lines)
-}
-
-func createConfigFile(name string, config []string) error {
-	file, err := os.Create(name)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	w := bufio.NewWriter(file)
-	for _, line := range config {
-		_, err = fmt.Fprintln(w, line)
-		if err != nil {
-			return err
-		}
-	}
-	err = w.Flush()
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
 func (nsm *networkStateMachine) setupWifi() error {
 	// Deactivate hotspot if it is active, this will enable the wifi again.
-	out, err := exec.Command("nmcli", "-t", "-f", "NAME,STATE", "connection", "show", "--active").CombinedOutput()
+	conns, err := nsm.backend.ActiveConnections()
 	if err != nil {
-		return fmt.Errorf("error executing nmcli: %w, output: %s", err, string(out))
+		return err
 	}
 
-	log.Println("Stopping dnsmasq")
-	if err := exec.Command("systemctl", "stop", "dnsmasq").Run(); err != nil {
+	if err := nsm.dhcp.Stop(); err != nil {
 		return err
 	}
 
-	if strings.Contains(string(out), bushnetHotspot) {
-		return runNMCli("connection", "down", bushnetHotspot)
+	for _, conn := range conns {
+		if conn.Name == bushnetHotspot {
+			return nsm.backend.ConnectionDown(bushnetHotspot)
+		}
 	}
 
 	log.Println("Turn wifi radio on.")
-	if err := runNMCli("radio", "wifi", "on"); err != nil {
+	if err := nsm.backend.SetWifiRadio(true); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStateMachine(b *fakeBackend, d *fakeDHCP) *networkStateMachine {
+	nsm := newNetworkStateMachine(b, d, b.updates, realClock{}, defaultServiceConfig())
+	nsm.minutesSinceHumanInteraction = func() (uint8, error) { return 0, nil }
+	nsm.notifyState = func(netmanagerclient.NetworkState) error { return nil }
+	nsm.notifyError = func(string, error) error { return nil }
+	nsm.notifyReady = func() error { return nil }
+	nsm.notifyScanResults = func() error { return nil }
+	return nsm
+}
+
+func (nsm *networkStateMachine) currentState() netmanagerclient.NetworkState {
+	nsm.mux.Lock()
+	defer nsm.mux.Unlock()
+	return nsm.state
+}
+
+func startTestStateMachine(t *testing.T, nsm *networkStateMachine) <-chan error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- nsm.runStateMachine()
+	}()
+	t.Cleanup(func() {
+		select {
+		case <-nsm.quit:
+		default:
+			close(nsm.quit)
+		}
+	})
+	return errChan
+}
+
+func waitForState(t *testing.T, nsm *networkStateMachine, state netmanagerclient.NetworkState) {
+	t.Helper()
+	assert.Eventually(t, func() bool { return nsm.currentState() == state }, time.Second, time.Millisecond,
+		"expected state %s, got %s", state, nsm.currentState())
+}
+
+func TestDetectState(t *testing.T) {
+	b := newFakeBackend()
+	nsm := newTestStateMachine(b, &fakeDHCP{})
+
+	state, _, err := nsm.detectState()
+	require.NoError(t, err)
+	assert.Equal(t, netmanagerclient.NS_WIFI_OFF, state)
+
+	b.radioOn = true
+	state, _, err = nsm.detectState()
+	require.NoError(t, err)
+	assert.Equal(t, netmanagerclient.NS_WIFI_SCANNING, state)
+
+	b.connect("802-3-ethernet", "usb0", "10.0.0.2")
+	state, _, err = nsm.detectState()
+	require.NoError(t, err)
+	assert.Equal(t, netmanagerclient.NS_WIFI_SCANNING, state)
+
+	b.connect("802-11-wireless", "home", "")
+	state, name, err := nsm.detectState()
+	require.NoError(t, err)
+	assert.Equal(t, netmanagerclient.NS_WIFI_CONNECTING, state)
+	assert.Equal(t, "home", name)
+
+	b.connect("802-11-wireless", "home", "192.168.1.20/24")
+	state, _, err = nsm.detectState()
+	require.NoError(t, err)
+	assert.Equal(t, netmanagerclient.NS_WIFI_CONNECTED, state)
+
+	b.disconnect("home", false)
+	b.connect("802-11-wireless", bushnetHotspot, "192.168.4.1/24")
+	state, _, err = nsm.detectState()
+	require.NoError(t, err)
+	assert.Equal(t, netmanagerclient.NS_HOTSPOT_RUNNING, state)
+
+	b.setErr("ActiveConnections", errors.New("nm not running"))
+	state, _, err = nsm.detectState()
+	assert.Error(t, err)
+	assert.Equal(t, netmanagerclient.NS_ERROR, state)
+}
+
+func TestStateMachineWithFakeBackend(t *testing.T) {
+	b := newFakeBackend()
+	d := &fakeDHCP{}
+	b.connect("802-11-wireless", "home", "192.168.1.20/24")
+	nsm := newTestStateMachine(b, d)
+	errChan := startTestStateMachine(t, nsm)
+
+	// Radio is turned on when starting and the device is connected to the network.
+	waitForState(t, nsm, netmanagerclient.NS_WIFI_CONNECTED)
+	assert.Equal(t, "2", b.profile("home")["connection.auth-retries"])
+
+	// Connection fails, auth retries is lowered so it fails faster next time.
+	b.connect("802-11-wireless", "home", "")
+	waitForState(t, nsm, netmanagerclient.NS_WIFI_CONNECTING)
+	b.disconnect("home", true)
+	waitForState(t, nsm, netmanagerclient.NS_WIFI_SCANNING)
+	assert.Equal(t, "1", b.profile("home")["connection.auth-retries"])
+
+	// Starting the hotspot creates the profile, brings it up and starts DHCP.
+	nsm.mux.Lock()
+	require.NoError(t, nsm.setupHotspot())
+	nsm.mux.Unlock()
+	waitForState(t, nsm, netmanagerclient.NS_HOTSPOT_RUNNING)
+	assert.Equal(t, "ap", b.profile(bushnetHotspot)["802-11-wireless.mode"])
+	assert.True(t, d.isRunning())
+
+	// Enabling wifi takes the hotspot down.
+	nsm.mux.Lock()
+	require.NoError(t, nsm.setupWifi())
+	nsm.mux.Unlock()
+	waitForState(t, nsm, netmanagerclient.NS_WIFI_SCANNING)
+	assert.False(t, d.isRunning())
+	assert.Contains(t, b.getCalls(), "ConnectionDown "+bushnetHotspot)
+
+	close(nsm.quit)
+	select {
+	case err := <-errChan:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("state machine did not stop")
+	}
+}
+
+func TestErrorRetryDelay(t *testing.T) {
+	assert.Equal(t, 5*time.Second, errorRetryDelay(1))
+	assert.Equal(t, 10*time.Second, errorRetryDelay(2))
+	assert.Equal(t, 160*time.Second, errorRetryDelay(6))
+	assert.Equal(t, 5*time.Minute, errorRetryDelay(7))
+	assert.Equal(t, 5*time.Minute, errorRetryDelay(100))
+}
+
+func TestStateHistoryIsBounded(t *testing.T) {
+	nsm := newTestStateMachine(newFakeBackend(), &fakeDHCP{})
+	for i := 0; i < maxStateHistory+10; i++ {
+		if i%2 == 0 {
+			nsm.setState(netmanagerclient.NS_WIFI_SCANNING)
+		} else {
+			nsm.setState(netmanagerclient.NS_WIFI_OFF)
+		}
+	}
+	require.Len(t, nsm.history, maxStateHistory)
+	assert.Equal(t, netmanagerclient.NS_WIFI_SCANNING, nsm.history[0].NewState)
+	assert.Equal(t, netmanagerclient.NS_WIFI_OFF, nsm.history[maxStateHistory-1].NewState)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+)
+
+const (
+	DefaultStateFile = "/var/lib/rpi-net-manager/state.json"
+	stateFileVersion = 1
+	bootIDFile       = "/proc/sys/kernel/random/boot_id"
+)
+
+// What is restored from the state file depends on if the device has rebooted since it was saved:
+//   - The state history is always restored.
+//   - Network failures are restored until they are older than networkFailureExpiry.
+//   - The hotspot fallback one-shot is restored after the service restarts. After a reboot it is only restored
+//     if the state was saved less than rebootGracePeriod ago, so a reboot loop doesn't keep starting the hotspot
+//     but a device that is turned on again later will fall back to the hotspot.
+//   - Keeping the hotspot on is only restored after the service restarts, as the hotspot is down after a reboot.
+//   - Network statistics are always restored. The network that was connected when the service stopped is only
+//     restored after the service restarts, so it isn't counted as connecting again if it is still connected.
+const (
+	networkFailureExpiry = 24 * time.Hour
+	rebootGracePeriod    = 10 * time.Minute
+)
+
+type persistedState struct {
+	Version            int                                        `json:"version"`
+	BootID             string                                     `json:"bootID"`
+	SavedAt            time.Time                                  `json:"savedAt"`
+	HotspotFallback    bool                                       `json:"hotspotFallback"`
+	KeepHotspotOnUntil time.Time                                  `json:"keepHotspotOnUntil"`
+	NetworkFailures    map[string]netmanagerclient.NetworkFailure `json:"networkFailures"`
+	NetworkStats       map[string]netmanagerclient.NetworkStats   `json:"networkStats"`
+	ConnectedTo        string                                     `json:"connectedTo"`
+	History            []netmanagerclient.StateTransition         `json:"history"`
+}
+
+// stateStore saves the context of the state machine so it can be restored when the service starts.
+type stateStore struct {
+	path   string
+	bootID string
+	// last is what was last saved, without the time it was saved, so the file is only written when something changes.
+	last []byte
+}
+
+func newStateStore(path string) *stateStore {
+	bootID, err := readBootID()
+	if err != nil {
+		log.Printf("Failed to read boot ID, state will be treated as from a previous boot: %v", err)
+	}
+	return &stateStore{path: path, bootID: bootID}
+}
+
+func readBootID() (string, error) {
+	data, err := os.ReadFile(bootIDFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (s *stateStore) load() (*persistedState, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	state := &persistedState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file '%s': %v", s.path, err)
+	}
+	if state.Version != stateFileVersion {
+		return nil, fmt.Errorf("unsupported state file version %d", state.Version)
+	}
+	return state, nil
+}
+
+func (s *stateStore) save(state persistedState, now time.Time) error {
+	state.Version = stateFileVersion
+	state.BootID = s.bootID
+	state.SavedAt = time.Time{}
+	unchanged, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(unchanged, s.last) {
+		return nil
+	}
+	state.SavedAt = now
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to make state directory: %v", err)
+	}
+	// Write to a temporary file then rename it so a power cut doesn't leave a partly written file.
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	s.last = unchanged
+	return nil
+}
+
+// saveState saves the context of the state machine if it has changed. Needs to be called with the mutex locked.
+func (nsm *networkStateMachine) saveState() {
+	if nsm.store == nil {
+		return
+	}
+	state := persistedState{
+		HotspotFallback:    nsm.hotspotFallback,
+		KeepHotspotOnUntil: nsm.keepHotspotOnUntil,
+		NetworkFailures:    nsm.networkFailures,
+		NetworkStats:       nsm.networkStats,
+		ConnectedTo:        nsm.connectedTo,
+		History:            nsm.history,
+	}
+	err := nsm.store.save(state, nsm.clock.Now())
+	if err != nil {
+		log.Printf("Failed to save state: %v", err)
+	}
+}
+
+// restoreState restores the context of the state machine from when the service last ran.
+// A missing or unreadable state file isn't an error, the service just starts fresh.
+func (nsm *networkStateMachine) restoreState() {
+	if nsm.store == nil {
+		return
+	}
+	state, err := nsm.store.load()
+	if errors.Is(err, os.ErrNotExist) {
+		log.Println("No saved state to restore")
+		return
+	} else if err != nil {
+		log.Printf("Failed to load saved state: %v", err)
+		return
+	}
+	nsm.mux.Lock()
+	defer nsm.mux.Unlock()
+
+	now := nsm.clock.Now()
+	sameBoot := nsm.store.bootID != "" && state.BootID == nsm.store.bootID
+	log.Printf("Restoring state saved at %s, same boot: %t", state.SavedAt.Format(time.DateTime), sameBoot)
+
+	nsm.history = state.History
+	if len(nsm.history) > maxStateHistory {
+		nsm.history = nsm.history[len(nsm.history)-maxStateHistory:]
+	}
+
+	for id, failure := range state.NetworkFailures {
+		if now.Sub(failure.LastFailure) < networkFailureExpiry {
+			nsm.networkFailures[id] = failure
+		}
+	}
+
+	for id, stats := range state.NetworkStats {
+		nsm.networkStats[id] = stats
+	}
+
+	if sameBoot || now.Sub(state.SavedAt) < rebootGracePeriod {
+		nsm.hotspotFallback = state.HotspotFallback && nsm.config.Policy.HotspotFallback
+	}
+
+	if sameBoot && state.KeepHotspotOnUntil.After(now) {
+		nsm.keepHotspotOnUntil = state.KeepHotspotOnUntil
+	}
+
+	// The time connected before the service stopped was counted when it stopped.
+	if sameBoot && state.ConnectedTo != "" {
+		nsm.connectedTo = state.ConnectedTo
+		nsm.connectedSince = now
+	}
+}
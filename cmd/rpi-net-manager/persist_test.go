@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// savedStateMachine makes a state machine that has been running for a while and saves its state.
+func savedStateMachine(t *testing.T, path string, now time.Time) {
+	nsm := newTestStateMachine(newFakeBackend(), &fakeDHCP{})
+	nsm.store = &stateStore{path: path, bootID: "boot-1"}
+	nsm.hotspotFallback = false
+	nsm.keepHotspotOnUntil = now.Add(20 * time.Minute)
+	nsm.networkFailures["home"] = netmanagerclient.NetworkFailure{Count: 2, LastFailure: now.Add(-time.Hour)}
+	nsm.networkFailures["old"] = netmanagerclient.NetworkFailure{Count: 1, LastFailure: now.Add(-48 * time.Hour)}
+	nsm.history = []netmanagerclient.StateTransition{
+		{Time: now, OldState: netmanagerclient.NS_INIT, NewState: netmanagerclient.NS_HOTSPOT_RUNNING, Trigger: netmanagerclient.TRIGGER_STARTUP},
+	}
+	state := persistedState{
+		HotspotFallback:    nsm.hotspotFallback,
+		KeepHotspotOnUntil: nsm.keepHotspotOnUntil,
+		NetworkFailures:    nsm.networkFailures,
+		History:            nsm.history,
+	}
+	require.NoError(t, nsm.store.save(state, now))
+}
+
+func restoredStateMachine(path, bootID string) *networkStateMachine {
+	nsm := newTestStateMachine(newFakeBackend(), &fakeDHCP{})
+	nsm.store = &stateStore{path: path, bootID: bootID}
+	nsm.restoreState()
+	return nsm
+}
+
+func TestRestoreStateAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	now := time.Now()
+	savedStateMachine(t, path, now.Add(-time.Hour))
+
+	nsm := restoredStateMachine(path, "boot-1")
+	assert.False(t, nsm.hotspotFallback)
+	// The deadline to keep the hotspot on has passed.
+	assert.True(t, nsm.keepHotspotOnUntil.IsZero())
+	assert.Len(t, nsm.history, 1)
+	assert.Equal(t, 2, nsm.networkFailures["home"].Count)
+	assert.NotContains(t, nsm.networkFailures, "old")
+
+	// Keep on deadline is restored if it hasn't passed yet.
+	savedStateMachine(t, path, now)
+	nsm = restoredStateMachine(path, "boot-1")
+	assert.WithinDuration(t, now.Add(20*time.Minute), nsm.keepHotspotOnUntil, 0)
+}
+
+func TestRestoreStateAfterReboot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	now := time.Now()
+
+	// A reboot soon after saving, such as a reboot loop, keeps the hotspot fallback used.
+	savedStateMachine(t, path, now.Add(-time.Minute))
+	nsm := restoredStateMachine(path, "boot-2")
+	assert.False(t, nsm.hotspotFallback)
+	assert.True(t, nsm.keepHotspotOnUntil.IsZero())
+	assert.Len(t, nsm.history, 1)
+	assert.Contains(t, nsm.networkFailures, "home")
+
+	// The device being turned on again later will fall back to the hotspot again.
+	savedStateMachine(t, path, now.Add(-time.Hour))
+	nsm = restoredStateMachine(path, "boot-2")
+	assert.True(t, nsm.hotspotFallback)
+	assert.True(t, nsm.keepHotspotOnUntil.IsZero())
+	assert.Len(t, nsm.history, 1)
+	assert.Contains(t, nsm.networkFailures, "home")
+	assert.NotContains(t, nsm.networkFailures, "old")
+}
+
+func TestRestoreStateBadFile(t *testing.T) {
+	dir := t.TempDir()
+	nsm := restoredStateMachine(filepath.Join(dir, "missing.json"), "boot-1")
+	assert.True(t, nsm.hotspotFallback)
+
+	path := filepath.Join(dir, "state.json")
+	require.NoError(t, os.WriteFile(path, []byte("{\"version\": 1, \"history\": ["), 0644))
+	nsm = restoredStateMachine(path, "boot-1")
+	assert.True(t, nsm.hotspotFallback)
+	assert.Empty(t, nsm.history)
+
+	require.NoError(t, os.WriteFile(path, []byte("{\"version\": 99, \"hotspotFallback\": false}"), 0644))
+	nsm = restoredStateMachine(path, "boot-1")
+	assert.True(t, nsm.hotspotFallback)
+}
+
+func TestSaveStateOnlyWhenChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "state.json")
+	nsm := newTestStateMachine(newFakeBackend(), &fakeDHCP{})
+	nsm.store = &stateStore{path: path, bootID: "boot-1"}
+
+	nsm.saveState()
+	require.FileExists(t, path)
+	require.NoError(t, os.Remove(path))
+	nsm.saveState()
+	assert.NoFileExists(t, path)
+
+	nsm.hotspotFallback = false
+	nsm.saveState()
+	assert.FileExists(t, path)
+}
+
+func TestSimulationNetworkFailures(t *testing.T) {
+	s := newSimulation(t, func(b *fakeBackend) {
+		b.profiles["home"] = map[string]string{}
+	})
+	for i := 0; i < 2; i++ {
+		s.do(func() { s.backend.connect("802-11-wireless", "home", "") })
+		s.do(func() { s.backend.disconnect("home", true) })
+	}
+	assert.Equal(t, 2, s.nsm.networkFailures["home"].Count)
+	assert.Equal(t, s.clock.Now(), s.nsm.networkFailures["home"].LastFailure)
+
+	assert.Equal(t, netmanagerclient.FAILURE_BAD_SECRETS, s.nsm.networkFailures["home"].Reason)
+	assert.Equal(t, "1", s.backend.profile("home")["connection.auth-retries"])
+
+	// Connecting clears the failures.
+	s.do(func() { s.backend.connect("802-11-wireless", "home", "192.168.1.20/24") })
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTED)
+	assert.NotContains(t, s.nsm.networkFailures, "home")
+	assert.Equal(t, "2", s.backend.profile("home")["connection.auth-retries"])
+
+	// Only a wrong password makes the connection give up sooner next time.
+	s.do(func() { s.backend.fail("home", netmanagerclient.FAILURE_NO_AP) })
+	assert.Equal(t, 1, s.nsm.networkFailures["home"].Count)
+	assert.Equal(t, netmanagerclient.FAILURE_NO_AP, s.nsm.networkFailures["home"].Reason)
+	assert.Equal(t, "2", s.backend.profile("home")["connection.auth-retries"])
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+)
+
+// bushnetConnections returns the IDs of the connections the service manages, the bushnet networks and the hotspot.
+func (nsm *networkStateMachine) bushnetConnections() []string {
+	return append(slices.Clone(nsm.config.Bushnet.SSIDs), bushnetHotspot)
+}
+
+// isBushnetConnection checks if the connection is one the service manages, so can't be changed by the user.
+func (nsm *networkStateMachine) isBushnetConnection(id string) bool {
+	return slices.Contains(nsm.bushnetConnections(), id)
+}
+
+// userWifiConnections returns the IDs of the saved wifi networks that were added by the user.
+func (nsm *networkStateMachine) userWifiConnections() ([]string, error) {
+	ids, err := nsm.backend.SavedWifiConnections()
+	if err != nil {
+		return nil, err
+	}
+	userIDs := []string{}
+	for _, id := range ids {
+		if !nsm.isBushnetConnection(id) {
+			userIDs = append(userIDs, id)
+		}
+	}
+	return userIDs, nil
+}
+
+// checkUserWifiConnection checks that the connection is a saved wifi network that can be changed by the user.
+func (nsm *networkStateMachine) checkUserWifiConnection(id string) error {
+	if nsm.isBushnetConnection(id) {
+		return netmanagerclient.ErrBushnetNetwork
+	}
+	ids, err := nsm.userWifiConnections()
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(ids, id) {
+		return netmanagerclient.InputError{Message: fmt.Sprintf("no saved network '%s'", id)}
+	}
+	return nil
+}
+
+func (nsm *networkStateMachine) setWifiNetworkPriority(id string, priority int) error {
+	if err := netmanagerclient.CheckWifiNetworkPriority(priority); err != nil {
+		return err
+	}
+	if err := nsm.checkUserWifiConnection(id); err != nil {
+		return err
+	}
+	log.Printf("Setting priority of '%s' to %d", id, priority)
+	return nsm.backend.ModifyConnection(id, map[string]string{"connection.autoconnect-priority": strconv.Itoa(priority)})
+}
+
+// reorderPriorities gives the networks priorities counting down from just below the bushnet networks, so they are
+// connected to in the given order. The order has to include each of the saved networks once.
+func reorderPriorities(order, saved []string) (map[string]int, error) {
+	priorities := map[string]int{}
+	for i, id := range order {
+		if _, ok := priorities[id]; ok {
+			return nil, netmanagerclient.InputError{Message: fmt.Sprintf("network '%s' is given more than once", id)}
+		}
+		if !slices.Contains(saved, id) {
+			return nil, netmanagerclient.InputError{Message: fmt.Sprintf("no saved network '%s'", id)}
+		}
+		priorities[id] = netmanagerclient.BushnetPriority - 1 - i
+	}
+	for _, id := range saved {
+		if _, ok := priorities[id]; !ok {
+			return nil, netmanagerclient.InputError{Message: fmt.Sprintf("network '%s' is missing from the order", id)}
+		}
+	}
+	if len(order) > 0 && priorities[order[len(order)-1]] < netmanagerclient.MinWifiNetworkPriority {
+		return nil, netmanagerclient.InputError{Message: "too many networks to order"}
+	}
+	return priorities, nil
+}
+
+func (nsm *networkStateMachine) reorderWifiNetworks(order []string) error {
+	for _, id := range order {
+		if nsm.isBushnetConnection(id) {
+			return netmanagerclient.ErrBushnetNetwork
+		}
+	}
+	saved, err := nsm.userWifiConnections()
+	if err != nil {
+		return err
+	}
+	priorities, err := reorderPriorities(order, saved)
+	if err != nil {
+		return err
+	}
+	log.Printf("Reordering wifi networks: %v", order)
+	for _, id := range order {
+		err := nsm.backend.ModifyConnection(id, map[string]string{"connection.autoconnect-priority": strconv.Itoa(priorities[id])})
+		if err != nil {
+			return fmt.Errorf("failed to set priority of '%s': %v", id, err)
+		}
+	}
+	return nil
+}
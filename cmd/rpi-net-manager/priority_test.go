@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReorderPriorities(t *testing.T) {
+	saved := []string{"office", "tether", "home"}
+	tests := []struct {
+		name  string
+		order []string
+		want  map[string]int
+		err   string
+	}{
+		{
+			name:  "all networks",
+			order: []string{"office", "home", "tether"},
+			want:  map[string]int{"office": 9, "home": 8, "tether": 7},
+		},
+		{
+			name:  "duplicate",
+			order: []string{"office", "home", "office", "tether"},
+			err:   "network 'office' is given more than once",
+		},
+		{
+			name:  "unknown",
+			order: []string{"office", "home", "tether", "cafe"},
+			err:   "no saved network 'cafe'",
+		},
+		{
+			name:  "missing",
+			order: []string{"office", "home"},
+			err:   "network 'tether' is missing from the order",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			priorities, err := reorderPriorities(tt.order, saved)
+			if tt.err != "" {
+				assert.EqualError(t, err, "Input Error: "+tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, priorities)
+		})
+	}
+}
+
+func TestWifiNetworkPriority(t *testing.T) {
+	backend := newFakeBackend()
+	backend.profiles["home"] = map[string]string{}
+	backend.profiles["office"] = map[string]string{}
+	backend.profiles["bushnet"] = map[string]string{}
+	nsm := newTestStateMachine(backend, &fakeDHCP{})
+
+	require.NoError(t, nsm.setWifiNetworkPriority("home", 5))
+	assert.Equal(t, "5", backend.profile("home")["connection.autoconnect-priority"])
+	assert.Equal(t, netmanagerclient.ErrInvalidPriority, nsm.setWifiNetworkPriority("home", 1000))
+	// User networks can't be put above the bushnet networks.
+	require.NoError(t, nsm.setWifiNetworkPriority("home", netmanagerclient.BushnetPriority-1))
+	assert.Equal(t, netmanagerclient.ErrInvalidPriority, nsm.setWifiNetworkPriority("home", netmanagerclient.BushnetPriority))
+	assert.Equal(t, "9", backend.profile("home")["connection.autoconnect-priority"])
+	require.NoError(t, nsm.setWifiNetworkPriority("home", netmanagerclient.MinWifiNetworkPriority))
+	assert.Equal(t, netmanagerclient.ErrInvalidPriority, nsm.setWifiNetworkPriority("home", netmanagerclient.MinWifiNetworkPriority-1))
+	assert.Equal(t, netmanagerclient.ErrBushnetNetwork, nsm.setWifiNetworkPriority("bushnet", 5))
+	assert.Error(t, nsm.setWifiNetworkPriority("cafe", 5))
+	assert.NotContains(t, backend.profiles, "cafe")
+
+	require.NoError(t, nsm.reorderWifiNetworks([]string{"office", "home"}))
+	assert.Equal(t, "9", backend.profile("office")["connection.autoconnect-priority"])
+	assert.Equal(t, "8", backend.profile("home")["connection.autoconnect-priority"])
+	assert.Equal(t, netmanagerclient.ErrBushnetNetwork, nsm.reorderWifiNetworks([]string{"bushnet", "office", "home"}))
+}
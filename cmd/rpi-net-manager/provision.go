@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+)
+
+// Wifi networks can be provisioned by putting one of these files on the boot partition or a USB drive.
+// wifi.json is in the same format as a network bundle from export-networks, though only the SSID and
+// credentials of each network are needed. wpa_supplicant.conf is the file Raspberry Pi OS used for wifi
+// before NetworkManager, so existing fleet tooling can keep writing it.
+const (
+	wifiJSONFileName       = "wifi.json"
+	wpaSupplicantFileName  = "wpa_supplicant.conf"
+	provisionStatusSuffix  = "-status.txt"
+	provisionAppliedSuffix = ".applied"
+)
+
+var provisionFileNames = []string{wifiJSONFileName, wpaSupplicantFileName}
+
+// How long to wait before trying a provisioning file again when it failed for a reason that might not
+// happen again, such as NetworkManager not running yet.
+const provisionRetryInterval = time.Minute
+
+// provisioner adds the networks from provisioning files, then removes the files so the credentials
+// aren't left on the drive.
+type provisioner struct {
+	config         Provisioning
+	mountsFile     string
+	importNetworks func(*netmanagerclient.NetworkBundle, netmanagerclient.ImportOptions) ([]netmanagerclient.ImportResult, error)
+	// bushnetNetworks gets the networks the service manages, so they aren't imported over.
+	bushnetNetworks func() []string
+	now             func() time.Time
+	// retryDirs are the directories with files that were kept to be tried again.
+	retryDirs map[string]bool
+}
+
+func newProvisioner(config Provisioning, bushnetNetworks func() []string) *provisioner {
+	return &provisioner{
+		config:          config,
+		mountsFile:      "/proc/self/mounts",
+		importNetworks:  netmanagerclient.ImportWifiNetworks,
+		bushnetNetworks: bushnetNetworks,
+		now:             time.Now,
+		retryDirs:       map[string]bool{},
+	}
+}
+
+// provisionAll checks the boot directories and the drives that are already mounted.
+func (p *provisioner) provisionAll() {
+	dirs := append([]string{}, p.config.BootDirs...)
+	mounts, err := p.removableMounts()
+	if err != nil {
+		log.Printf("Failed to read mounts: %v", err)
+	}
+	dirs = append(dirs, sortedMounts(mounts)...)
+	for _, dir := range dirs {
+		p.provisionDir(dir)
+	}
+}
+
+// watchMounts checks each drive that is mounted after the service started, and tries the files that
+// were kept again, until quit is closed.
+func (p *provisioner) watchMounts(quit <-chan struct{}) {
+	known, err := p.removableMounts()
+	if err != nil {
+		log.Printf("Failed to read mounts, not watching for drives: %v", err)
+		return
+	}
+	changes, err := watchMountChanges(p.mountsFile, quit)
+	if err != nil {
+		log.Printf("Failed to watch mounts, not watching for drives: %v", err)
+		return
+	}
+	retryTicker := time.NewTicker(provisionRetryInterval)
+	defer retryTicker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-retryTicker.C:
+			p.retry()
+			continue
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+		}
+		mounts, err := p.removableMounts()
+		if err != nil {
+			log.Debugf("Failed to read mounts: %v", err)
+			continue
+		}
+		for _, dir := range sortedMounts(mounts) {
+			if !known[dir] {
+				log.Printf("Drive mounted at '%s'", dir)
+				p.provisionDir(dir)
+			}
+		}
+		known = mounts
+	}
+}
+
+// watchMountChanges lets the caller know each time something is mounted or unmounted, until quit is closed.
+// The kernel flags the mounts file with POLLPRI and POLLERR when the mounts change, so it is waited on with epoll.
+func watchMountChanges(mountsFile string, quit <-chan struct{}) (<-chan struct{}, error) {
+	mounts, err := os.Open(mountsFile)
+	if err != nil {
+		return nil, err
+	}
+	// Closing the write end of the pipe wakes up epoll when it is time to stop.
+	stopRead, stopWrite, err := os.Pipe()
+	if err != nil {
+		mounts.Close()
+		return nil, err
+	}
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		mounts.Close()
+		stopRead.Close()
+		stopWrite.Close()
+		return nil, fmt.Errorf("failed to create epoll: %v", err)
+	}
+	closeAll := func() {
+		syscall.Close(epfd)
+		mounts.Close()
+		stopRead.Close()
+	}
+	mountsFd := int(mounts.Fd())
+	stopFd := int(stopRead.Fd())
+	for fd, events := range map[int]uint32{mountsFd: syscall.EPOLLPRI | syscall.EPOLLERR, stopFd: syscall.EPOLLIN} {
+		if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: events, Fd: int32(fd)}); err != nil {
+			closeAll()
+			stopWrite.Close()
+			return nil, fmt.Errorf("failed to watch '%s': %v", mountsFile, err)
+		}
+	}
+
+	go func() {
+		<-quit
+		stopWrite.Close()
+	}()
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
+		defer closeAll()
+		events := make([]syscall.EpollEvent, 2)
+		for {
+			n, err := syscall.EpollWait(epfd, events, -1)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				log.Printf("Failed to wait for mounts to change: %v", err)
+				return
+			}
+			for _, event := range events[:n] {
+				if int(event.Fd) == stopFd {
+					return
+				}
+			}
+			// Changes that happen while the last one is being handled are picked up by reading the mounts then.
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// retry provisions the directories with files that were kept to be tried again.
+func (p *provisioner) retry() {
+	for _, dir := range sortedMounts(p.retryDirs) {
+		log.Printf("Trying to provision wifi networks from '%s' again", dir)
+		p.provisionDir(dir)
+	}
+}
+
+// removableMounts gets the mount points that are under one of the mount roots.
+func (p *provisioner) removableMounts() (map[string]bool, error) {
+	data, err := os.ReadFile(p.mountsFile)
+	if err != nil {
+		return nil, err
+	}
+	mounts := map[string]bool{}
+	for _, dir := range parseMountPoints(data) {
+		for _, root := range p.config.MountRoots {
+			if dir == root || strings.HasPrefix(dir, strings.TrimSuffix(root, "/")+"/") {
+				mounts[dir] = true
+			}
+		}
+	}
+	return mounts, nil
+}
+
+// parseMountPoints reads the mount points from /proc/self/mounts, where spaces and other
+// whitespace in a path are written as octal escapes.
+func parseMountPoints(data []byte) []string {
+	dirs := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		dirs = append(dirs, unescapeMountPath(fields[1]))
+	}
+	return dirs
+}
+
+func unescapeMountPath(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func sortedMounts(mounts map[string]bool) []string {
+	dirs := []string{}
+	for dir := range mounts {
+		dirs = append(dirs, dir)
+	}
+	slices.Sort(dirs)
+	return dirs
+}
+
+func (p *provisioner) provisionDir(dir string) {
+	delete(p.retryDirs, dir)
+	for _, name := range provisionFileNames {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Printf("Failed to check for '%s': %v", path, err)
+			}
+			continue
+		}
+		log.Printf("Provisioning wifi networks from '%s'", path)
+		if err := p.provisionFile(path); err != nil {
+			log.Errorf("Failed to provision wifi networks from '%s': %v", path, err)
+		}
+	}
+}
+
+// provisionFile adds the networks in the file, removes the file, then writes what was done with
+// each network to a status file next to it. The file is removed even if it can't be read, as it
+// will still have credentials in it. If the networks failed to be added for a reason that might not
+// happen again the file is kept, so it can be tried again without losing the credentials.
+func (p *provisioner) provisionFile(path string) error {
+	status := []string{fmt.Sprintf("Provisioned wifi networks from %s at %s", filepath.Base(path), p.now().Format(time.RFC3339))}
+	bundle, results, err := p.readFile(path)
+	retry := false
+	if err == nil && len(bundle.Networks) > 0 {
+		// Overwriting lets the credentials of a network be changed by provisioning it again.
+		imported, importErr := p.importNetworks(bundle, netmanagerclient.ImportOptions{
+			Conflict: netmanagerclient.CONFLICT_OVERWRITE,
+			Bushnet:  p.bushnetNetworks(),
+		})
+		if importErr != nil {
+			err = importErr
+			retry = true
+		}
+		results = append(results, imported...)
+	}
+	if err != nil {
+		status = append(status, fmt.Sprintf("failed: %v", err))
+	}
+	for _, result := range results {
+		line := fmt.Sprintf("%s: %s", result.ID, result.Action)
+		if result.NewID != "" {
+			line += fmt.Sprintf(" as '%s'", result.NewID)
+		}
+		if result.Reason != "" {
+			line += ", " + result.Reason
+		}
+		log.Printf("Provisioned network %s", line)
+		status = append(status, line)
+		retry = retry || result.Retry
+	}
+
+	if retry {
+		p.retryDirs[filepath.Dir(path)] = true
+		log.Printf("Keeping '%s' to try again in %s", path, provisionRetryInterval)
+		status = append(status, fmt.Sprintf("kept %s to try again", filepath.Base(path)))
+	} else if removeErr := p.removeFile(path); removeErr != nil {
+		status = append(status, fmt.Sprintf("failed to remove %s: %v", filepath.Base(path), removeErr))
+		if err == nil {
+			err = removeErr
+		}
+	}
+	statusPath := strings.TrimSuffix(path, filepath.Ext(path)) + provisionStatusSuffix
+	if writeErr := os.WriteFile(statusPath, []byte(strings.Join(status, "\n")+"\n"), 0644); writeErr != nil {
+		return fmt.Errorf("failed to write status file: %v", writeErr)
+	}
+	return err
+}
+
+// readFile reads the networks from the file. Networks in a wpa_supplicant.conf file that can't be
+// added are returned as failed results.
+func (p *provisioner) readFile(path string) (*netmanagerclient.NetworkBundle, []netmanagerclient.ImportResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if filepath.Base(path) == wpaSupplicantFileName {
+		bundle, invalid := parseWpaSupplicant(data)
+		return bundle, invalid, nil
+	}
+	bundle, err := parseWifiJSON(data)
+	return bundle, nil, err
+}
+
+// removeFile overwrites the file before removing it, or renames it if that is what is configured.
+// Overwriting the file is best effort, the flash storage might keep a copy of the old data.
+func (p *provisioner) removeFile(path string) error {
+	if p.config.OnApplied == AppliedRename {
+		return os.Rename(path, path+provisionAppliedSuffix)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		_, err = f.Write(make([]byte, info.Size()))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to overwrite file: %v", err)
+	}
+	return os.Remove(path)
+}
+
+// parseWifiJSON reads a wifi.json file. The version can be left out, and anything that isn't
+// set for a network uses what AddWifiNetwork would.
+func parseWifiJSON(data []byte) (*netmanagerclient.NetworkBundle, error) {
+	bundle := &netmanagerclient.NetworkBundle{}
+	if err := json.Unmarshal(data, bundle); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", wifiJSONFileName, err)
+	}
+	if bundle.Version == 0 {
+		bundle.Version = netmanagerclient.NetworkBundleVersion
+	}
+	if bundle.Version > netmanagerclient.NetworkBundleVersion {
+		return nil, fmt.Errorf("unsupported %s version %d", wifiJSONFileName, bundle.Version)
+	}
+	for i := range bundle.Networks {
+		n := &bundle.Networks[i]
+		if n.ID == "" {
+			n.ID = n.SSID
+			if ssid, err := n.RawSSID(); err == nil {
+				n.ID = ssid.String()
+			}
+		}
+		if n.Security == "" {
+			switch {
+			case n.Enterprise != nil:
+				n.Security = netmanagerclient.SECURITY_WPA2_EAP
+			case n.PSK != "":
+				n.Security = netmanagerclient.SECURITY_WPA2_PSK
+			default:
+				n.Security = netmanagerclient.SECURITY_OPEN
+			}
+		}
+		if n.IP.IPv4.Method == "" {
+			n.IP.IPv4.Method = netmanagerclient.IP_METHOD_AUTO
+		}
+		if n.IP.IPv6.Method == "" {
+			n.IP.IPv6.Method = netmanagerclient.IP_METHOD_AUTO
+		}
+	}
+	return bundle, nil
+}
+
+// parseWpaSupplicant reads the network blocks of a wpa_supplicant.conf file. Networks that
+// can't be added, such as ones using WEP, are returned as failed results.
+func parseWpaSupplicant(data []byte) (*netmanagerclient.NetworkBundle, []netmanagerclient.ImportResult) {
+	bundle := &netmanagerclient.NetworkBundle{Version: netmanagerclient.NetworkBundleVersion}
+	invalid := []netmanagerclient.ImportResult{}
+	var block map[string]string
+	count := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "network={"):
+			block = map[string]string{}
+			count++
+		case line == "}" && block != nil:
+			network, err := wpaSupplicantNetwork(block)
+			if err != nil {
+				id, _ := unquote(block["ssid"])
+				if id == "" {
+					id = fmt.Sprintf("network %d", count)
+				}
+				invalid = append(invalid, netmanagerclient.ImportResult{ID: id, Action: netmanagerclient.IMPORT_FAILED, Reason: err.Error()})
+			} else {
+				bundle.Networks = append(bundle.Networks, network)
+			}
+			block = nil
+		case block != nil:
+			if key, value, ok := strings.Cut(line, "="); ok {
+				block[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+		}
+	}
+	return bundle, invalid
+}
+
+func wpaSupplicantNetwork(block map[string]string) (netmanagerclient.ExportedNetwork, error) {
+	n := netmanagerclient.ExportedNetwork{IP: netmanagerclient.DefaultIPConfig()}
+	ssid, ok := block["ssid"]
+	if !ok {
+		return n, errors.New("network has no ssid")
+	}
+	var raw netmanagerclient.SSID
+	if quoted, ok := unquote(ssid); ok {
+		raw = netmanagerclient.SSID(quoted)
+	} else {
+		// An unquoted SSID is written as hex, this is how SSIDs that aren't UTF-8 are written.
+		var err error
+		if raw, err = netmanagerclient.ParseSSIDHex(ssid); err != nil {
+			return n, fmt.Errorf("ssid '%s' is not quoted or hex", ssid)
+		}
+	}
+	n.SetSSID(raw)
+	n.ID = n.SSID
+	// A quoted PSK is the passphrase, an unquoted one is the key as hex, which NetworkManager also accepts.
+	n.PSK = block["psk"]
+	if quoted, ok := unquote(n.PSK); ok {
+		n.PSK = quoted
+	}
+
+	keyMgmt := strings.Fields(block["key_mgmt"])
+	switch {
+	case len(keyMgmt) == 0 && n.PSK != "":
+		n.Security = netmanagerclient.SECURITY_WPA2_PSK
+	case len(keyMgmt) == 0 || slices.Equal(keyMgmt, []string{"NONE"}):
+		if _, ok := block["wep_key0"]; ok {
+			return n, errors.New("WEP networks are not supported")
+		}
+		n.Security = netmanagerclient.SECURITY_OPEN
+	case slices.Contains(keyMgmt, "WPA-EAP"):
+		return n, fmt.Errorf("key_mgmt %s is not supported, use %s for enterprise networks", block["key_mgmt"], wifiJSONFileName)
+	case slices.Contains(keyMgmt, "WPA-PSK") && slices.Contains(keyMgmt, "SAE"):
+		n.Security = netmanagerclient.SECURITY_WPA2_WPA3
+	case slices.Contains(keyMgmt, "WPA-PSK"):
+		n.Security = netmanagerclient.SECURITY_WPA2_PSK
+	case slices.Contains(keyMgmt, "SAE"):
+		n.Security = netmanagerclient.SECURITY_WPA3_SAE
+	default:
+		return n, fmt.Errorf("key_mgmt %s is not supported", block["key_mgmt"])
+	}
+	if n.Security == netmanagerclient.SECURITY_WPA3_SAE {
+		if sae, ok := unquote(block["sae_password"]); ok {
+			n.PSK = sae
+		}
+	}
+
+	n.Hidden = block["scan_ssid"] == "1"
+	if priority, ok := block["priority"]; ok {
+		p, err := strconv.Atoi(priority)
+		if err != nil {
+			return n, fmt.Errorf("priority '%s' is not a number", priority)
+		}
+		n.Priority = p
+	}
+	return n, nil
+}
+
+func unquote(s string) (string, bool) {
+	if len(s) >= 2 && strings.HasPrefix(s, `"`) && strings.HasSuffix(s, `"`) {
+		return s[1 : len(s)-1], true
+	}
+	return s, false
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWpaSupplicant(t *testing.T) {
+	conf := `
+ctrl_interface=DIR=/var/run/wpa_supplicant GROUP=netdev
+country=NZ
+
+network={
+	ssid="home"
+	psk="a good password"
+	priority=5
+}
+
+# A hidden WPA3 network
+network={
+	ssid="office"
+	sae_password="correct horse"
+	key_mgmt=SAE
+	scan_ssid=1
+}
+
+network={
+	ssid=636166c3a9
+	key_mgmt=NONE
+}
+
+network={
+	ssid="mixed"
+	psk=0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+	key_mgmt=WPA-PSK SAE
+}
+
+network={
+	ssid="uni"
+	key_mgmt=WPA-EAP
+	eap=PEAP
+}
+
+network={
+	ssid="old"
+	key_mgmt=NONE
+	wep_key0="12345"
+}
+
+network={
+	psk="no ssid here"
+}
+`
+	bundle, invalid := parseWpaSupplicant([]byte(conf))
+	auto := netmanagerclient.DefaultIPConfig()
+	assert.Equal(t, []netmanagerclient.ExportedNetwork{
+		{ID: "home", SSID: "home", Security: netmanagerclient.SECURITY_WPA2_PSK, PSK: "a good password", Priority: 5, IP: auto},
+		{ID: "office", SSID: "office", Security: netmanagerclient.SECURITY_WPA3_SAE, PSK: "correct horse", Hidden: true, IP: auto},
+		{ID: "café", SSID: "café", Security: netmanagerclient.SECURITY_OPEN, IP: auto},
+		{ID: "mixed", SSID: "mixed", Security: netmanagerclient.SECURITY_WPA2_WPA3, PSK: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", IP: auto},
+	}, bundle.Networks)
+
+	require.Len(t, invalid, 3)
+	assert.Equal(t, []string{"uni", "old", "network 7"}, []string{invalid[0].ID, invalid[1].ID, invalid[2].ID})
+	for _, result := range invalid {
+		assert.Equal(t, netmanagerclient.IMPORT_FAILED, result.Action)
+		assert.NotEmpty(t, result.Reason)
+	}
+}
+
+func TestParseWpaSupplicantSSIDNotUTF8(t *testing.T) {
+	bundle, invalid := parseWpaSupplicant([]byte("network={\n\tssid=436166e9\n\tkey_mgmt=NONE\n}\n"))
+	assert.Empty(t, invalid)
+	assert.Equal(t, []netmanagerclient.ExportedNetwork{
+		{ID: `Caf\xe9`, SSID: `Caf\xe9`, SSIDHex: "436166E9", Security: netmanagerclient.SECURITY_OPEN, IP: netmanagerclient.DefaultIPConfig()},
+	}, bundle.Networks)
+
+	// wifi.json can give just the hex of the SSID.
+	jsonBundle, err := parseWifiJSON([]byte(`{"networks": [{"ssidHex": "436166E9"}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, `Caf\xe9`, jsonBundle.Networks[0].ID)
+	ssid, err := jsonBundle.Networks[0].RawSSID()
+	require.NoError(t, err)
+	assert.Equal(t, netmanagerclient.SSID("Caf\xe9"), ssid)
+}
+
+func TestParseWifiJSON(t *testing.T) {
+	bundle, err := parseWifiJSON([]byte(`{"networks": [
+		{"ssid": "home", "psk": "a good password", "priority": 5},
+		{"ssid": "cafe"},
+		{"id": "work", "ssid": "office", "security": "wpa3-sae", "psk": "correct horse", "ip": {"ipv4": {"method": "manual", "addresses": ["10.0.0.5/24"]}}}
+	]}`))
+	require.NoError(t, err)
+	assert.Equal(t, netmanagerclient.NetworkBundleVersion, bundle.Version)
+	auto := netmanagerclient.DefaultIPConfig()
+	assert.Equal(t, []netmanagerclient.ExportedNetwork{
+		{ID: "home", SSID: "home", Security: netmanagerclient.SECURITY_WPA2_PSK, PSK: "a good password", Priority: 5, IP: auto},
+		{ID: "cafe", SSID: "cafe", Security: netmanagerclient.SECURITY_OPEN, IP: auto},
+		{ID: "work", SSID: "office", Security: netmanagerclient.SECURITY_WPA3_SAE, PSK: "correct horse", IP: netmanagerclient.NetworkIPConfig{
+			IPv4: netmanagerclient.IPConfig{Method: netmanagerclient.IP_METHOD_MANUAL, Addresses: []string{"10.0.0.5/24"}},
+			IPv6: netmanagerclient.IPConfig{Method: netmanagerclient.IP_METHOD_AUTO},
+		}},
+	}, bundle.Networks)
+
+	_, err = parseWifiJSON([]byte(`{"version": 2, "networks": []}`))
+	assert.Error(t, err)
+	_, err = parseWifiJSON([]byte(`[{"ssid": "home"}]`))
+	assert.Error(t, err)
+}
+
+func newTestProvisioner(t *testing.T, config Provisioning) (*provisioner, *[]*netmanagerclient.NetworkBundle) {
+	imported := []*netmanagerclient.NetworkBundle{}
+	p := newProvisioner(config, func() []string { return []string{"fieldnet", bushnetHotspot} })
+	p.now = func() time.Time { return time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC) }
+	p.importNetworks = func(bundle *netmanagerclient.NetworkBundle, options netmanagerclient.ImportOptions) ([]netmanagerclient.ImportResult, error) {
+		assert.Equal(t, netmanagerclient.CONFLICT_OVERWRITE, options.Conflict)
+		// The service's own bushnet networks are given so the import doesn't call the service.
+		assert.Equal(t, []string{"fieldnet", bushnetHotspot}, options.Bushnet)
+		imported = append(imported, bundle)
+		results := []netmanagerclient.ImportResult{}
+		for _, n := range bundle.Networks {
+			result := netmanagerclient.ImportResult{ID: n.ID, Action: netmanagerclient.IMPORT_ADDED}
+			if n.ID == "home" {
+				result.Action = netmanagerclient.IMPORT_OVERWRITTEN
+			}
+			results = append(results, result)
+		}
+		return results, nil
+	}
+	return p, &imported
+}
+
+func TestProvisionDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, wifiJSONFileName), []byte(`{"networks": [{"ssid": "home", "psk": "a good password"}]}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, wpaSupplicantFileName), []byte("network={\n\tssid=\"cafe\"\n\tkey_mgmt=NONE\n}\nnetwork={\n\tssid=\"uni\"\n\tkey_mgmt=WPA-EAP\n}\n"), 0644))
+
+	p, imported := newTestProvisioner(t, DefaultProvisioning())
+	p.provisionDir(dir)
+	require.Len(t, *imported, 2)
+
+	// The files with credentials are removed and the status files have no credentials.
+	for _, name := range provisionFileNames {
+		assert.NoFileExists(t, filepath.Join(dir, name))
+	}
+	status, err := os.ReadFile(filepath.Join(dir, "wifi-status.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "Provisioned wifi networks from wifi.json at 2024-03-01T09:30:00Z\nhome: overwritten\n", string(status))
+	status, err = os.ReadFile(filepath.Join(dir, "wpa_supplicant-status.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "Provisioned wifi networks from wpa_supplicant.conf at 2024-03-01T09:30:00Z\n"+
+		"uni: failed, key_mgmt WPA-EAP is not supported, use wifi.json for enterprise networks\n"+
+		"cafe: added\n", string(status))
+
+	// Nothing is done when there are no files.
+	p.provisionDir(dir)
+	assert.Len(t, *imported, 2)
+}
+
+func TestProvisionInvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, wifiJSONFileName)
+	require.NoError(t, os.WriteFile(path, []byte(`{"networks": [{"ssid": "home", "psk": "a good passw`), 0644))
+
+	p, imported := newTestProvisioner(t, DefaultProvisioning())
+	assert.Error(t, p.provisionFile(path))
+	assert.Empty(t, *imported)
+	assert.NoFileExists(t, path)
+	status, err := os.ReadFile(filepath.Join(dir, "wifi-status.txt"))
+	require.NoError(t, err)
+	assert.Contains(t, string(status), "failed: failed to parse wifi.json")
+	assert.NotContains(t, string(status), "a good passw")
+}
+
+func TestProvisionImportFailed(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, wifiJSONFileName)
+	content := []byte(`{"networks": [{"ssid": "home", "psk": "a good password"}]}`)
+	require.NoError(t, os.WriteFile(path, content, 0644))
+
+	// The file is kept when the import fails, such as when NetworkManager isn't running yet.
+	p, imported := newTestProvisioner(t, DefaultProvisioning())
+	importNetworks := p.importNetworks
+	p.importNetworks = func(*netmanagerclient.NetworkBundle, netmanagerclient.ImportOptions) ([]netmanagerclient.ImportResult, error) {
+		return nil, errors.New("NetworkManager is not running")
+	}
+	assert.Error(t, p.provisionFile(path))
+	kept, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, content, kept)
+	status, err := os.ReadFile(filepath.Join(dir, "wifi-status.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "Provisioned wifi networks from wifi.json at 2024-03-01T09:30:00Z\n"+
+		"failed: NetworkManager is not running\n"+
+		"kept wifi.json to try again\n", string(status))
+	assert.Equal(t, map[string]bool{dir: true}, p.retryDirs)
+
+	// It is also kept when a network fails to be added for a reason that might not happen again.
+	p.importNetworks = func(*netmanagerclient.NetworkBundle, netmanagerclient.ImportOptions) ([]netmanagerclient.ImportResult, error) {
+		return []netmanagerclient.ImportResult{{ID: "home", Action: netmanagerclient.IMPORT_FAILED, Reason: "failed to add network", Retry: true}}, nil
+	}
+	p.retry()
+	assert.FileExists(t, path)
+	assert.Equal(t, map[string]bool{dir: true}, p.retryDirs)
+
+	// Once the networks are added the file is removed and isn't tried again.
+	p.importNetworks = importNetworks
+	p.retry()
+	assert.Len(t, *imported, 1)
+	assert.NoFileExists(t, path)
+	assert.Empty(t, p.retryDirs)
+	status, err = os.ReadFile(filepath.Join(dir, "wifi-status.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "Provisioned wifi networks from wifi.json at 2024-03-01T09:30:00Z\nhome: overwritten\n", string(status))
+}
+
+func TestProvisionRename(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, wifiJSONFileName)
+	content := []byte(`{"networks": [{"ssid": "cafe"}]}`)
+	require.NoError(t, os.WriteFile(path, content, 0644))
+
+	config := DefaultProvisioning()
+	config.OnApplied = AppliedRename
+	p, imported := newTestProvisioner(t, config)
+	require.NoError(t, p.provisionFile(path))
+	assert.Len(t, *imported, 1)
+	assert.NoFileExists(t, path)
+	renamed, err := os.ReadFile(path + provisionAppliedSuffix)
+	require.NoError(t, err)
+	assert.Equal(t, content, renamed)
+}
+
+func TestRemovableMounts(t *testing.T) {
+	mounts := `/dev/mmcblk0p2 / ext4 rw,noatime 0 0
+/dev/mmcblk0p1 /boot/firmware vfat rw,relatime 0 0
+/dev/sda1 /media/pi/USB\040DRIVE vfat rw,nosuid,nodev 0 0
+/dev/sdb1 /mnt vfat rw 0 0
+/dev/sdc1 /mediadrive vfat rw 0 0
+`
+	path := filepath.Join(t.TempDir(), "mounts")
+	require.NoError(t, os.WriteFile(path, []byte(mounts), 0644))
+	p := newProvisioner(DefaultProvisioning(), nil)
+	p.mountsFile = path
+	found, err := p.removableMounts()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/media/pi/USB DRIVE", "/mnt"}, sortedMounts(found))
+}
+
+func TestWatchMountChanges(t *testing.T) {
+	quit := make(chan struct{})
+	changes, err := watchMountChanges("/proc/self/mounts", quit)
+	require.NoError(t, err)
+
+	// The changes are closed once quit is.
+	close(quit)
+	select {
+	case _, ok := <-changes:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("didn't stop watching the mounts")
+	}
+
+	_, err = watchMountChanges(filepath.Join(t.TempDir(), "mounts"), nil)
+	assert.Error(t, err)
+}
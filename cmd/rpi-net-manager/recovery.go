@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+)
+
+// Operations run by the state machine, errors are counted for each one.
+const (
+	opWifiRadioOn      = "turn on wifi radio"
+	opWifiRadioOff     = "turn off wifi radio"
+	opDetectState      = "detect state"
+	opStateTransition  = "handle state transition"
+	opHumanInteraction = "get minutes since human interaction"
+	opStartHotspot     = "start hotspot"
+	opStartWifi        = "start wifi"
+	opProbeHidden      = "probe for hidden networks"
+	opScan             = "scan for wifi networks"
+)
+
+// After an error the service waits before trying to recover, doubling the wait each time it fails again.
+// The wait goes back to the minimum once there have been no errors that needed recovering from for errorResetAfter.
+const (
+	errorRetryMinDelay = 5 * time.Second
+	errorRetryMaxDelay = 5 * time.Minute
+	errorResetAfter    = 10 * time.Minute
+)
+
+type operationError struct {
+	op  string
+	err error
+}
+
+func (e *operationError) Error() string {
+	return fmt.Sprintf("failed to %s: %v", e.op, e.err)
+}
+
+func (e *operationError) Unwrap() error {
+	return e.err
+}
+
+// opErr wraps the error with the operation that failed, returning nil if there was no error.
+func opErr(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &operationError{op: op, err: err}
+}
+
+// recordError counts the error against the operation that failed and reports it over D-Bus.
+// Needs to be called with the mutex locked.
+func (nsm *networkStateMachine) recordError(err error) {
+	op := "unknown"
+	var opError *operationError
+	if errors.As(err, &opError) {
+		op = opError.op
+	}
+	log.Error(err)
+	errs, ok := nsm.operationErrors[op]
+	if !ok {
+		errs = &netmanagerclient.OperationErrors{}
+		nsm.operationErrors[op] = errs
+	}
+	errs.Count++
+	errs.LastError = err.Error()
+	errs.LastTime = nsm.clock.Now()
+	nsm.lastError = err
+	nsm.lastErrorTime = nsm.clock.Now()
+	if err := nsm.notifyError(op, err); err != nil {
+		log.Println(err)
+	}
+}
+
+// handleError records the error, puts the state machine in the error state and schedules a retry.
+// Needs to be called with the mutex locked.
+func (nsm *networkStateMachine) handleError(err error) {
+	now := nsm.clock.Now()
+	// Only errors that put the state machine in the error state count, others can keep happening while it is running.
+	if now.Sub(nsm.lastFatalErrorTime) > errorResetAfter {
+		nsm.consecutiveErrors = 0
+	}
+	nsm.lastFatalErrorTime = now
+	nsm.recordError(err)
+	nsm.consecutiveErrors++
+	delay := errorRetryDelay(nsm.consecutiveErrors)
+	nsm.errorRetryAt = now.Add(delay)
+	log.Printf("Will try to recover in %s", delay)
+	nsm.setState(netmanagerclient.NS_ERROR)
+	resetTimer(nsm.errorRetryTimer, delay)
+}
+
+func errorRetryDelay(consecutiveErrors int) time.Duration {
+	delay := errorRetryMinDelay
+	for i := 1; i < consecutiveErrors && delay < errorRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, errorRetryMaxDelay)
+}
+
+// recover tries to get back to a known good state after an error, with the hotspot down and the wifi radio on.
+// Needs to be called with the mutex locked.
+func (nsm *networkStateMachine) recover() error {
+	log.Println("Recovering from error")
+	if err := nsm.setupWifi(); err != nil {
+		return opErr(opStartWifi, err)
+	}
+	newState, conName, err := nsm.detectState()
+	if err != nil {
+		return opErr(opDetectState, err)
+	}
+	nsm.setReady()
+	if err := nsm.handleStateTransition(newState, conName); err != nil {
+		return opErr(opStateTransition, err)
+	}
+	stopTimer(nsm.errorRetryTimer)
+	nsm.errorRetryAt = time.Time{}
+	log.Println("Recovered from error")
+	return nil
+}
+
+// serviceErrors is the errors the service has had, to report over D-Bus.
+func (nsm *networkStateMachine) serviceErrors() netmanagerclient.ServiceErrors {
+	errs := netmanagerclient.ServiceErrors{
+		ConsecutiveErrors: nsm.consecutiveErrors,
+		LastErrorTime:     nsm.lastErrorTime,
+		Operations:        map[string]netmanagerclient.OperationErrors{},
+	}
+	if nsm.lastError != nil {
+		errs.LastError = nsm.lastError.Error()
+	}
+	if nsm.state == netmanagerclient.NS_ERROR {
+		errs.RetryAt = nsm.errorRetryAt
+	}
+	for op, opErrs := range nsm.operationErrors {
+		errs.Operations[op] = *opErrs
+	}
+	return errs
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"time"
+
+	netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+)
+
+// scanResultsDelay is how long to give a scan to finish before reading the access points it found.
+const scanResultsDelay = 5 * time.Second
+
+// scanIntervalSearching and scanIntervalConnected are how often to scan so the cached results stay fresh.
+// Scanning is more frequent while searching for a network to connect to, and rare once connected as it
+// takes the radio off the channel for a while.
+const (
+	scanIntervalSearching = time.Minute
+	scanIntervalConnected = 10 * time.Minute
+)
+
+// scanInterval returns how long to wait after a scan before scanning again in the current state.
+func (nsm *networkStateMachine) scanInterval() time.Duration {
+	if nsm.state == netmanagerclient.NS_WIFI_CONNECTED {
+		return scanIntervalConnected
+	}
+	return scanIntervalSearching
+}
+
+// canScan checks if a scan can be started in the current state. Scanning while connecting can
+// disrupt the association, and the radio can't scan while it is running the hotspot.
+func (nsm *networkStateMachine) canScan() bool {
+	return nsm.state == netmanagerclient.NS_WIFI_SCANNING || nsm.state == netmanagerclient.NS_WIFI_CONNECTED
+}
+
+// scanResultsFor returns the cached scan results. If they are maxAge old or older a new scan is started,
+// or if one can't be started in the current state it is started once it can.
+// Needs to be called with the mutex locked.
+func (nsm *networkStateMachine) scanResultsFor(maxAge time.Duration) netmanagerclient.ScanResults {
+	results := nsm.scanResults
+	if !results.ScannedAt.IsZero() {
+		results.Age = nsm.clock.Now().Sub(results.ScannedAt)
+	}
+	if (results.ScannedAt.IsZero() || results.Age >= maxAge) && !nsm.scanPending {
+		if nsm.canScan() {
+			nsm.startScan()
+		} else {
+			log.Printf("Can't scan while %s, scanning once it can", nsm.state)
+			nsm.scanWanted = true
+		}
+	}
+	results.Scanning = nsm.scanPending
+	return results
+}
+
+// startScan asks for a scan, also probing for the saved hidden networks so they are in the results.
+// Needs to be called with the mutex locked.
+func (nsm *networkStateMachine) startScan() {
+	nsm.scanWanted = false
+	ssids, err := nsm.backend.HiddenWifiSSIDs()
+	if err != nil {
+		nsm.recordError(opErr(opProbeHidden, err))
+	}
+	log.Println("Scanning for wifi networks")
+	if err := nsm.backend.RequestWifiScan("wlan0", ssids); err != nil {
+		nsm.recordError(opErr(opScan, err))
+		return
+	}
+	nsm.scanStarted()
+}
+
+// scanStarted schedules reading the results of a scan that has been started, and puts off the next
+// periodic scan as these results will be just as fresh.
+// Needs to be called with the mutex locked.
+func (nsm *networkStateMachine) scanStarted() {
+	nsm.scanWanted = false
+	nsm.scanPending = true
+	resetTimer(nsm.scanResultsTimer, scanResultsDelay)
+	resetTimer(nsm.periodicScanTimer, nsm.scanInterval())
+}
+
+// readScanResults updates the cached scan results and lets clients know they have been updated.
+// Needs to be called with the mutex locked.
+func (nsm *networkStateMachine) readScanResults() {
+	nsm.scanPending = false
+	switch nsm.state {
+	case netmanagerclient.NS_WIFI_SCANNING, netmanagerclient.NS_WIFI_CONNECTING, netmanagerclient.NS_WIFI_CONNECTED:
+	default:
+		// The scan won't have finished if the radio was turned off or the hotspot started, so scan again later.
+		nsm.scanWanted = true
+		return
+	}
+	aps, err := nsm.backend.WifiAccessPoints("wlan0")
+	if err != nil {
+		nsm.recordError(opErr(opScan, err))
+		return
+	}
+	nsm.scanResults = netmanagerclient.ScanResults{ScannedAt: nsm.clock.Now(), AccessPoints: aps}
+	log.Printf("Scan found %d access points", len(aps))
+	if err := nsm.notifyScanResults(); err != nil {
+		log.Println(err)
+	}
+}
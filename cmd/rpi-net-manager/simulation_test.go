@@ -0,0 +1,994 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock that only moves when the test advances it.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock    *fakeClock
+	c        chan time.Time
+	deadline time.Time
+	active   bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	t.start(d)
+	return t
+}
+
+// start needs to be called with the clock locked.
+func (t *fakeTimer) start(d time.Duration) {
+	t.deadline = t.clock.now.Add(d)
+	t.active = true
+	if d <= 0 {
+		t.fire()
+	}
+}
+
+// fire needs to be called with the clock locked.
+func (t *fakeTimer) fire() {
+	t.active = false
+	select {
+	case t.c <- t.clock.now:
+	default:
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.start(d)
+	return wasActive
+}
+
+// nextDeadline returns when the next active timer will fire.
+func (c *fakeClock) nextDeadline() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deadlines := []time.Time{}
+	for _, t := range c.timers {
+		if t.active {
+			deadlines = append(deadlines, t.deadline)
+		}
+	}
+	if len(deadlines) == 0 {
+		return time.Time{}, false
+	}
+	sort.Slice(deadlines, func(i, j int) bool { return deadlines[i].Before(deadlines[j]) })
+	return deadlines[0], true
+}
+
+// setTime moves the clock and fires any timers that are due.
+func (c *fakeClock) setTime(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+	for _, t := range c.timers {
+		if t.active && !t.deadline.After(now) {
+			t.fire()
+		}
+	}
+}
+
+// pending returns the number of fired timers that haven't been read yet.
+func (c *fakeClock) pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, t := range c.timers {
+		n += len(t.c)
+	}
+	return n
+}
+
+// simulation runs the state machine against a fake backend and clock.
+// The state machine is parked each time it goes idle, and is only let go while there are
+// events for it to process, so each step of a scenario runs deterministically.
+type simulation struct {
+	t       *testing.T
+	nsm     *networkStateMachine
+	backend *fakeBackend
+	dhcp    *fakeDHCP
+	clock   *fakeClock
+	idle    chan struct{}
+	resume  chan struct{}
+	errChan chan error
+
+	mu                           sync.Mutex
+	states                       []netmanagerclient.NetworkState
+	errors                       []string
+	readyAt                      []time.Time
+	watchdogPings                []time.Time
+	scanNotifications            int
+	minutesSinceHumanInteraction uint8
+}
+
+func newSimulation(t *testing.T, setup func(b *fakeBackend)) *simulation {
+	return newSimulationWithConfig(t, defaultServiceConfig(), func(s *simulation) {
+		if setup != nil {
+			setup(s.backend)
+		}
+	})
+}
+
+// newSimulationWithConfig starts a simulation with the config, setup is called before the state machine starts.
+func newSimulationWithConfig(t *testing.T, conf *serviceConfig, setup func(s *simulation)) *simulation {
+	require.NoError(t, conf.Validate())
+	s := &simulation{
+		t:       t,
+		backend: newFakeBackend(),
+		dhcp:    &fakeDHCP{},
+		clock:   newFakeClock(),
+		idle:    make(chan struct{}),
+		resume:  make(chan struct{}),
+		errChan: make(chan error, 1),
+	}
+	s.backend.radioOn = true
+	s.nsm = newNetworkStateMachine(s.backend, s.dhcp, s.backend.updates, s.clock, conf)
+	s.nsm.minutesSinceHumanInteraction = func() (uint8, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.minutesSinceHumanInteraction, nil
+	}
+	s.nsm.notifyState = func(state netmanagerclient.NetworkState) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.states = append(s.states, state)
+		return nil
+	}
+	s.nsm.notifyError = func(op string, err error) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.errors = append(s.errors, op)
+		return nil
+	}
+	s.nsm.notifyReady = func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.readyAt = append(s.readyAt, s.clock.Now())
+		return nil
+	}
+	s.nsm.notifyScanResults = func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.scanNotifications++
+		return nil
+	}
+	s.nsm.notifyWatchdog = func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.watchdogPings = append(s.watchdogPings, s.clock.Now())
+		return nil
+	}
+	if setup != nil {
+		setup(s)
+	}
+	s.nsm.onIdle = func() {
+		s.idle <- struct{}{}
+		<-s.resume
+	}
+
+	go func() {
+		s.errChan <- s.nsm.runStateMachine()
+	}()
+	t.Cleanup(s.stop)
+	s.waitIdle()
+	s.settle()
+	return s
+}
+
+func (s *simulation) waitIdle() {
+	select {
+	case <-s.idle:
+	case err := <-s.errChan:
+		s.t.Fatalf("state machine stopped: %v", err)
+	}
+}
+
+func (s *simulation) pending() bool {
+	return len(s.nsm.NetworkUpdateChannel) > 0 || len(s.nsm.connectionFailures) > 0 || s.clock.pending() > 0
+}
+
+// settle lets the state machine run until it has processed all pending events.
+func (s *simulation) settle() {
+	for s.pending() {
+		s.resume <- struct{}{}
+		s.waitIdle()
+	}
+}
+
+// advance moves the clock forward, letting the state machine process each timer as it fires.
+func (s *simulation) advance(d time.Duration) {
+	end := s.clock.Now().Add(d)
+	for {
+		next, ok := s.clock.nextDeadline()
+		if !ok || next.After(end) {
+			break
+		}
+		s.clock.setTime(next)
+		s.settle()
+	}
+	s.clock.setTime(end)
+	s.settle()
+}
+
+// do runs an action, such as a D-Bus call or a change in the network, then lets the state machine process it.
+func (s *simulation) do(action func()) {
+	action()
+	s.settle()
+}
+
+func (s *simulation) stop() {
+	select {
+	case <-s.nsm.quit:
+		return
+	default:
+	}
+	close(s.nsm.quit)
+	for {
+		select {
+		case s.resume <- struct{}{}:
+		case <-s.idle:
+		case err := <-s.errChan:
+			assert.NoError(s.t, err)
+			return
+		}
+	}
+}
+
+func (s *simulation) setMinutesSinceHumanInteraction(minutes uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.minutesSinceHumanInteraction = minutes
+}
+
+func (s *simulation) assertState(state netmanagerclient.NetworkState) {
+	s.t.Helper()
+	assert.Equal(s.t, state, s.nsm.currentState(), "at %s", s.clock.Now().Format(time.TimeOnly))
+}
+
+func (s *simulation) assertStates(states ...netmanagerclient.NetworkState) {
+	s.t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Equal(s.t, states, s.states)
+}
+
+func TestSimulationWrongPassword(t *testing.T) {
+	s := newSimulation(t, func(b *fakeBackend) {
+		b.profiles["home"] = map[string]string{"connection.auth-retries": "2"}
+	})
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+
+	// NetworkManager tries to connect but the password is wrong.
+	s.do(func() { s.backend.connect("802-11-wireless", "home", "") })
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTING)
+	s.advance(2 * time.Second)
+	s.do(func() { s.backend.disconnect("home", true) })
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	assert.Equal(t, "1", s.backend.profile("home")["connection.auth-retries"])
+
+	// Falls back to the hotspot 10 seconds after going back to scanning.
+	s.advance(9 * time.Second)
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	s.advance(time.Second)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+	assert.True(t, s.dhcp.isRunning())
+
+	// Hotspot turns off after 5 minutes.
+	s.advance(5*time.Minute - time.Second)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+	s.advance(time.Second)
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	assert.False(t, s.dhcp.isRunning())
+
+	// The fallback only happens once, then the radio is turned off after 10 minutes of scanning.
+	s.advance(10*time.Minute - time.Second)
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	s.advance(time.Second)
+	s.assertState(netmanagerclient.NS_WIFI_OFF)
+
+	s.assertStates(
+		netmanagerclient.NS_WIFI_SCANNING,
+		netmanagerclient.NS_WIFI_CONNECTING,
+		netmanagerclient.NS_WIFI_SCANNING,
+		netmanagerclient.NS_HOTSPOT_STARTING,
+		netmanagerclient.NS_HOTSPOT_RUNNING,
+		netmanagerclient.NS_WIFI_SCANNING,
+		netmanagerclient.NS_WIFI_OFF,
+	)
+}
+
+func TestSimulationNetworkDisappears(t *testing.T) {
+	s := newSimulation(t, func(b *fakeBackend) {
+		b.profiles["home"] = map[string]string{"connection.auth-retries": "1"}
+		b.active = []ActiveConnection{{Type: "802-11-wireless", Name: "home"}}
+		b.ip4["home"] = "192.168.1.20/24"
+	})
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTED)
+	assert.Equal(t, "2", s.backend.profile("home")["connection.auth-retries"])
+
+	// Timers firing while connected don't change anything.
+	s.advance(time.Hour)
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTED)
+
+	// The access point goes away.
+	s.do(func() { s.backend.disconnect("home", false) })
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	assert.Equal(t, "2", s.backend.profile("home")["connection.auth-retries"])
+
+	s.advance(10 * time.Second)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+
+	// A user connecting the device back to wifi takes down the hotspot.
+	s.do(func() { assert.Nil(t, service{nsm: s.nsm}.EnableWifi(false)) })
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	s.do(func() { s.backend.connect("802-11-wireless", "home", "192.168.1.20/24") })
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTED)
+}
+
+func TestSimulationNoHumanInteraction(t *testing.T) {
+	s := newSimulation(t, nil)
+	s.setMinutesSinceHumanInteraction(90)
+
+	s.advance(10 * time.Second)
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	s.advance(10*time.Minute - 10*time.Second)
+	s.assertState(netmanagerclient.NS_WIFI_OFF)
+	s.assertStates(netmanagerclient.NS_WIFI_SCANNING, netmanagerclient.NS_WIFI_OFF)
+}
+
+func TestSimulationKeepHotspotOn(t *testing.T) {
+	s := newSimulation(t, nil)
+	s.advance(10 * time.Second)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+
+	// Extend the hotspot while the 5 minute timer is running.
+	s.advance(4 * time.Minute)
+	s.do(func() { assert.Nil(t, service{nsm: s.nsm}.KeepHotspotOnFor(600)) })
+	s.advance(10*time.Minute - time.Second)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+
+	// A shorter request doesn't cut the time down.
+	s.do(func() { assert.Nil(t, service{nsm: s.nsm}.KeepHotspotOnFor(0)) })
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+
+	s.advance(time.Second)
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+
+	// Can't keep the hotspot on when it isn't running.
+	assert.NotNil(t, service{nsm: s.nsm}.KeepHotspotOnFor(600))
+}
+
+func TestSimulationKeepHotspotOnWhileStarting(t *testing.T) {
+	s := newSimulation(t, nil)
+
+	// Keeping the hotspot on while it is starting isn't undone when it finishes starting.
+	s.do(func() {
+		assert.Nil(t, service{nsm: s.nsm}.EnableHotspot(false))
+		require.Equal(t, netmanagerclient.NS_HOTSPOT_STARTING, s.nsm.state)
+		assert.Nil(t, service{nsm: s.nsm}.KeepHotspotOnFor(1200))
+	})
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+	s.advance(20*time.Minute - time.Second)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+	s.advance(time.Second)
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+}
+
+func TestSimulationHotspotStaysOn(t *testing.T) {
+	// A device on a bench in the lab, where the hotspot should stay up and the radio never turns off.
+	conf := defaultServiceConfig()
+	conf.Policy.ScanConnectTimeout = 0
+	conf.Policy.HotspotTimeout = 0
+	conf.Policy.HumanInteractionCutoff = 0
+	s := newSimulationWithConfig(t, conf, nil)
+	s.setMinutesSinceHumanInteraction(255)
+
+	s.advance(10 * time.Second)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+	s.advance(24 * time.Hour)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+
+	// Keeping the hotspot on doesn't add a timeout.
+	s.do(func() { assert.Nil(t, service{nsm: s.nsm}.KeepHotspotOnFor(60)) })
+	s.advance(24 * time.Hour)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+}
+
+func TestSimulationNoHotspotFallback(t *testing.T) {
+	// A solar powered device that should save power by not hosting a hotspot and not scanning for long.
+	conf := defaultServiceConfig()
+	conf.Policy.HotspotFallback = false
+	conf.Policy.ScanConnectTimeout = 2 * time.Minute
+	s := newSimulationWithConfig(t, conf, nil)
+
+	s.advance(2*time.Minute - time.Second)
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	s.advance(time.Second)
+	s.assertState(netmanagerclient.NS_WIFI_OFF)
+	s.assertStates(netmanagerclient.NS_WIFI_SCANNING, netmanagerclient.NS_WIFI_OFF)
+
+	// Enabling wifi uses the policy instead of turning the fallback back on.
+	s.do(func() { assert.Nil(t, service{nsm: s.nsm}.EnableWifi(false)) })
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	s.advance(2 * time.Minute)
+	s.assertState(netmanagerclient.NS_WIFI_OFF)
+	assert.False(t, s.dhcp.isRunning())
+}
+
+func TestSimulationReloadConfig(t *testing.T) {
+	s := newSimulation(t, nil)
+	s.advance(10 * time.Second)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+	assert.Equal(t, "bushnet", s.backend.profile(bushnetHotspot)["ssid"])
+
+	// The running hotspot and DHCP server are updated, and the new hotspot timeout is used.
+	dir := writeConfig(t, `
+[hotspot]
+ssid = "camera-42"
+dhcp-range-end = "192.168.4.100"
+
+[network-policy]
+hotspot-timeout = "20m"
+`)
+	s.advance(time.Minute)
+	s.do(func() { assert.Nil(t, service{nsm: s.nsm, configDir: dir}.ReloadConfig()) })
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+	assert.Equal(t, "camera-42", s.backend.profile(bushnetHotspot)["ssid"])
+	assert.Equal(t, "ConnectionUp "+bushnetHotspot, s.backend.getCalls()[len(s.backend.getCalls())-1])
+	assert.Equal(t, "192.168.4.100", s.dhcp.hotspot.DHCPRangeEnd)
+
+	s.advance(20*time.Minute - time.Second)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+	s.advance(time.Second)
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+
+	// A shorter scan timeout applies to the scan that is already running.
+	dir = writeConfig(t, "[network-policy]\nscan-connect-timeout = \"1m\"")
+	s.advance(10 * time.Second)
+	s.do(func() { assert.Nil(t, service{nsm: s.nsm, configDir: dir}.ReloadConfig()) })
+	s.advance(time.Minute - time.Second)
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	s.advance(time.Second)
+	s.assertState(netmanagerclient.NS_WIFI_OFF)
+}
+
+func TestSimulationReloadBushnetConfig(t *testing.T) {
+	s := newSimulation(t, func(b *fakeBackend) {
+		require.NoError(t, setupBushnetNetworks(b, DefaultBushnet()))
+		b.profiles["home"] = map[string]string{"wifi.ssid": "home"}
+	})
+	s.advance(time.Second)
+	s.do(func() {
+		ids, err := service{nsm: s.nsm}.GetBushnetNetworks()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"bushnet", "Bushnet", bushnetHotspot}, ids)
+	})
+
+	// Profiles for bushnet networks no longer in the config are removed, and they can then be changed by the user.
+	dir := writeConfig(t, "[bushnet]\nssids = [\"bushnet\", \"fieldnet\"]")
+	s.do(func() { assert.Nil(t, service{nsm: s.nsm, configDir: dir}.ReloadConfig()) })
+	saved, err := s.backend.SavedWifiConnections()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bushnet", "fieldnet", "home"}, saved)
+	assert.Equal(t, "feathers", s.backend.profile("fieldnet")["wifi-sec.psk"])
+	s.do(func() {
+		assert.True(t, s.nsm.isBushnetConnection("fieldnet"))
+		assert.False(t, s.nsm.isBushnetConnection("Bushnet"))
+	})
+}
+
+func TestSimulationReloadInvalidConfig(t *testing.T) {
+	s := newSimulation(t, nil)
+	s.advance(10 * time.Second)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+	calls := s.backend.getCalls()
+
+	for _, content := range []string{
+		"[hotspot]\npsk = \"short\"",
+		"[network-policy]\nhotspot-timeout = \"soon\"",
+		"[hotspot",
+	} {
+		dir := writeConfig(t, content)
+		s.do(func() { assert.NotNil(t, service{nsm: s.nsm, configDir: dir}.ReloadConfig()) })
+	}
+	assert.Equal(t, calls, s.backend.getCalls())
+	assert.Equal(t, defaultServiceConfig(), s.nsm.config)
+
+	// Nothing was disturbed, the hotspot still turns off after 5 minutes.
+	s.advance(5*time.Minute - time.Second)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+	s.advance(time.Second)
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+}
+
+func TestSimulationStateHistory(t *testing.T) {
+	s := newSimulation(t, func(b *fakeBackend) {
+		b.profiles["home"] = map[string]string{}
+		b.bssid = "AA:BB:CC:DD:EE:FF"
+	})
+	start := s.clock.Now()
+
+	s.advance(5 * time.Second)
+	s.do(func() { s.backend.connect("802-11-wireless", "home", "192.168.1.20/24") })
+	s.advance(time.Minute)
+	s.do(func() { s.backend.disconnect("home", false) })
+	s.do(func() { assert.Nil(t, service{nsm: s.nsm}.EnableHotspot(false)) })
+	s.advance(5 * time.Minute)
+
+	type entry struct {
+		at       time.Duration
+		old, new netmanagerclient.NetworkState
+		conn     string
+		trigger  netmanagerclient.StateTrigger
+		detail   string
+	}
+	expected := []entry{
+		{0, netmanagerclient.NS_INIT, netmanagerclient.NS_WIFI_SCANNING, "", netmanagerclient.TRIGGER_STARTUP, ""},
+		{5 * time.Second, netmanagerclient.NS_WIFI_SCANNING, netmanagerclient.NS_WIFI_CONNECTED, "home", netmanagerclient.TRIGGER_NM_SIGNAL, ""},
+		{65 * time.Second, netmanagerclient.NS_WIFI_CONNECTED, netmanagerclient.NS_WIFI_SCANNING, "", netmanagerclient.TRIGGER_NM_SIGNAL, ""},
+		{65 * time.Second, netmanagerclient.NS_WIFI_SCANNING, netmanagerclient.NS_HOTSPOT_STARTING, "", netmanagerclient.TRIGGER_DBUS_CALL, "EnableHotspot"},
+		{65 * time.Second, netmanagerclient.NS_HOTSPOT_STARTING, netmanagerclient.NS_HOTSPOT_RUNNING, bushnetHotspot, netmanagerclient.TRIGGER_NM_SIGNAL, ""},
+		{365 * time.Second, netmanagerclient.NS_HOTSPOT_RUNNING, netmanagerclient.NS_WIFI_SCANNING, "", netmanagerclient.TRIGGER_TIMER, "hotspot timeout"},
+	}
+
+	history, err := service{nsm: s.nsm}.GetStateHistory()
+	require.Nil(t, err)
+	transitions := []netmanagerclient.StateTransition{}
+	require.NoError(t, json.Unmarshal([]byte(history), &transitions))
+	require.Len(t, transitions, len(expected))
+	for i, e := range expected {
+		tr := transitions[i]
+		assert.Equal(t, e, entry{tr.Time.Sub(start), tr.OldState, tr.NewState, tr.ConnectionName, tr.Trigger, tr.Detail}, "transition %d", i)
+		assert.Equal(t, "AA:BB:CC:DD:EE:FF", tr.BSSID)
+	}
+}
+
+func (s *simulation) getErrors() netmanagerclient.ServiceErrors {
+	s.t.Helper()
+	data, dbusErr := service{nsm: s.nsm}.GetErrors()
+	require.Nil(s.t, dbusErr)
+	errs := netmanagerclient.ServiceErrors{}
+	require.NoError(s.t, json.Unmarshal([]byte(data), &errs))
+	return errs
+}
+
+func TestSimulationRecoversFromStartupError(t *testing.T) {
+	s := newSimulation(t, func(b *fakeBackend) {
+		b.setErr("SetWifiRadio", errors.New("radio failure"))
+	})
+	s.assertState(netmanagerclient.NS_ERROR)
+	errs := s.getErrors()
+	assert.Equal(t, s.clock.Now().Add(5*time.Second), errs.RetryAt)
+	assert.Equal(t, 1, errs.Operations[opWifiRadioOn].Count)
+
+	// Retries back off while the error keeps happening.
+	s.advance(5 * time.Second)
+	s.assertState(netmanagerclient.NS_ERROR)
+	assert.Equal(t, s.clock.Now().Add(10*time.Second), s.getErrors().RetryAt)
+	s.advance(10 * time.Second)
+	s.assertState(netmanagerclient.NS_ERROR)
+	assert.Equal(t, s.clock.Now().Add(20*time.Second), s.getErrors().RetryAt)
+
+	s.backend.setErr("SetWifiRadio", nil)
+	s.advance(20*time.Second - time.Millisecond)
+	s.assertState(netmanagerclient.NS_ERROR)
+	s.advance(time.Millisecond)
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+
+	errs = s.getErrors()
+	assert.True(t, errs.RetryAt.IsZero())
+	assert.Equal(t, 3, errs.ConsecutiveErrors)
+	assert.Equal(t, 2, errs.Operations[opStartWifi].Count)
+	assert.Equal(t, "failed to start wifi: radio failure", errs.LastError)
+	assert.Equal(t, []string{opWifiRadioOn, opStartWifi, opStartWifi}, s.errors)
+
+	// After recovering the service carries on as normal.
+	s.advance(10 * time.Second)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+}
+
+func TestSimulationBackoffResetsWithMinorErrors(t *testing.T) {
+	s := newSimulation(t, nil)
+	s.do(func() {
+		s.backend.setErr("WifiRadioEnabled", errors.New("nm not running"))
+		s.backend.notify()
+	})
+	s.assertState(netmanagerclient.NS_ERROR)
+	s.backend.setErr("WifiRadioEnabled", nil)
+	s.advance(5 * time.Second)
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+
+	// Errors that the service carries on from don't stop the wait going back to the minimum.
+	for i := 0; i < 12; i++ {
+		s.advance(time.Minute)
+		s.do(func() { s.nsm.recordError(opErr(opScan, errors.New("scan failed"))) })
+	}
+	s.do(func() {
+		s.backend.setErr("WifiRadioEnabled", errors.New("nm not running"))
+		s.backend.notify()
+	})
+	s.assertState(netmanagerclient.NS_ERROR)
+	errs := s.getErrors()
+	assert.Equal(t, 1, errs.ConsecutiveErrors)
+	assert.Equal(t, s.clock.Now().Add(errorRetryMinDelay), errs.RetryAt)
+	assert.Equal(t, 12, errs.Operations[opScan].Count)
+}
+
+func TestSimulationHotspotFailure(t *testing.T) {
+	s := newSimulation(t, nil)
+	s.backend.setErr("ModifyConnection", errors.New("bad hotspot config"))
+
+	s.advance(10 * time.Second)
+	s.assertState(netmanagerclient.NS_ERROR)
+	assert.True(t, s.nsm.hotspotFallback)
+
+	// The fallback to the hotspot happens again once the service has recovered.
+	s.backend.setErr("ModifyConnection", nil)
+	s.advance(5 * time.Second)
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	s.advance(10 * time.Second)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+	s.assertStates(
+		netmanagerclient.NS_WIFI_SCANNING,
+		netmanagerclient.NS_HOTSPOT_STARTING,
+		netmanagerclient.NS_ERROR,
+		netmanagerclient.NS_WIFI_SCANNING,
+		netmanagerclient.NS_HOTSPOT_STARTING,
+		netmanagerclient.NS_HOTSPOT_RUNNING,
+	)
+}
+
+func TestSimulationDBusCallsRecover(t *testing.T) {
+	s := newSimulation(t, nil)
+	s.do(func() {
+		s.backend.setErr("ActiveConnections", errors.New("nm not running"))
+		s.backend.notify()
+	})
+	s.assertState(netmanagerclient.NS_ERROR)
+
+	// The error is returned to the caller while it can't recover.
+	s.do(func() { assert.NotNil(t, service{nsm: s.nsm}.EnableHotspot(false)) })
+	s.assertState(netmanagerclient.NS_ERROR)
+	assert.Equal(t, 2, s.getErrors().ConsecutiveErrors)
+
+	// Recovers straight away when asked to start the hotspot without waiting for the retry.
+	s.backend.setErr("ActiveConnections", nil)
+	s.do(func() { assert.Nil(t, service{nsm: s.nsm}.EnableHotspot(false)) })
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+
+	// The retry timer firing later doesn't change anything.
+	s.advance(time.Minute)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+}
+
+func TestSimulationHumanInteractionError(t *testing.T) {
+	s := newSimulation(t, nil)
+	s.do(func() {
+		s.nsm.minutesSinceHumanInteraction = func() (uint8, error) { return 0, errors.New("ATtiny not found") }
+	})
+
+	// Not knowing when there was a human interaction still lets the hotspot start.
+	s.advance(10 * time.Second)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+	assert.Equal(t, 1, s.getErrors().Operations[opHumanInteraction].Count)
+	assert.Equal(t, 0, s.getErrors().ConsecutiveErrors)
+}
+
+func TestSimulationReadyAndWatchdog(t *testing.T) {
+	s := newSimulationWithConfig(t, defaultServiceConfig(), func(s *simulation) {
+		s.backend.setErr("ActiveConnections", errors.New("nm not running"))
+		s.nsm.watchdogInterval = 30 * time.Second
+	})
+	start := s.clock.Now()
+	s.assertState(netmanagerclient.NS_ERROR)
+
+	// Not ready until the state has been detected.
+	s.backend.setErr("ActiveConnections", nil)
+	s.advance(5 * time.Second)
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	s.advance(5 * time.Minute)
+	s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Equal(t, []time.Time{start.Add(5 * time.Second)}, s.readyAt)
+
+	// The watchdog is pinged on every loop, and at least every interval when nothing else is happening.
+	require.NotEmpty(t, s.watchdogPings)
+	assert.Equal(t, start, s.watchdogPings[0])
+	for i := 1; i < len(s.watchdogPings); i++ {
+		assert.LessOrEqual(t, s.watchdogPings[i].Sub(s.watchdogPings[i-1]), 30*time.Second)
+	}
+	assert.LessOrEqual(t, s.clock.Now().Sub(s.watchdogPings[len(s.watchdogPings)-1]), 30*time.Second)
+}
+
+func TestSimulationShutdown(t *testing.T) {
+	for _, test := range []struct {
+		onShutdown     string
+		hotspotRunning bool
+	}{
+		{ShutdownLeave, true},
+		{ShutdownStopHotspot, false},
+	} {
+		t.Run(test.onShutdown, func(t *testing.T) {
+			conf := defaultServiceConfig()
+			conf.Policy.OnShutdown = test.onShutdown
+			s := newSimulationWithConfig(t, conf, nil)
+			s.advance(10 * time.Second)
+			s.assertState(netmanagerclient.NS_HOTSPOT_RUNNING)
+
+			s.stop()
+			require.NoError(t, s.nsm.shutdown())
+			assert.Equal(t, test.hotspotRunning, s.dhcp.isRunning())
+			active, err := s.backend.ActiveConnections()
+			require.NoError(t, err)
+			if test.hotspotRunning {
+				assert.Equal(t, []ActiveConnection{{Type: "802-11-wireless", Name: bushnetHotspot}}, active)
+			} else {
+				assert.Empty(t, active)
+			}
+		})
+	}
+}
+
+func TestSimulationProbeHiddenNetworks(t *testing.T) {
+	conf := defaultServiceConfig()
+	conf.Policy.HotspotFallback = false
+	s := newSimulationWithConfig(t, conf, func(s *simulation) {
+		s.backend.profiles["home"] = map[string]string{"wifi.ssid": "home"}
+		s.backend.profiles["office"] = map[string]string{"wifi.ssid": "office", "802-11-wireless.hidden": "yes"}
+	})
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	// Probes as soon as it starts scanning, then keeps on probing while it is scanning.
+	assert.Equal(t, [][]string{{"office"}}, s.backend.getScans())
+	s.advance(hiddenProbeInterval)
+	assert.Len(t, s.backend.getScans(), 2)
+
+	// Doesn't probe while connected.
+	s.do(func() { s.backend.connect("802-11-wireless", "office", "192.168.1.20/24") })
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTED)
+	s.advance(5 * hiddenProbeInterval)
+	assert.Len(t, s.backend.getScans(), 2)
+
+	// Failing to probe is recorded but doesn't stop the service.
+	s.backend.setErr("RequestWifiScan", errors.New("scanning not allowed"))
+	s.do(func() { s.backend.disconnect("office", false) })
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	assert.Equal(t, 1, s.nsm.operationErrors[opProbeHidden].Count)
+
+	// No scans are asked for if there are no hidden networks.
+	s.backend.setErr("RequestWifiScan", nil)
+	s.do(func() { s.backend.profiles["office"]["802-11-wireless.hidden"] = "no" })
+	s.advance(hiddenProbeInterval)
+	assert.Len(t, s.backend.getScans(), 2)
+}
+
+func TestSimulationStaticAddresses(t *testing.T) {
+	s := newSimulation(t, func(b *fakeBackend) {
+		b.profiles["office"] = map[string]string{"ipv4.method": "manual", "ipv4.addresses": "192.168.1.5/24"}
+		b.profiles["lab"] = map[string]string{"ipv4.method": "disabled", "ipv6.method": "manual", "ipv6.addresses": "2001:db8::5/64"}
+	})
+	s.do(func() { s.backend.connect("802-11-wireless", "office", "") })
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTING)
+	s.do(func() { s.backend.connect("802-11-wireless", "office", "192.168.1.5/24") })
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTED)
+
+	// A network with only IPv6 addresses is connected once it has a global address.
+	s.do(func() { s.backend.disconnect("office", false) })
+	s.do(func() { s.backend.connect("802-11-wireless", "lab", "") })
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTING)
+	s.do(func() { s.backend.connect("802-11-wireless", "lab", "2001:db8::5/64") })
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTED)
+	assert.Equal(t, "lab", s.nsm.connName)
+}
+
+func (s *simulation) scanResults(maxAge time.Duration) netmanagerclient.ScanResults {
+	s.nsm.mux.Lock()
+	defer s.nsm.mux.Unlock()
+	return s.nsm.scanResultsFor(maxAge)
+}
+
+func (s *simulation) getScanNotifications() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scanNotifications
+}
+
+func TestSimulationScanResults(t *testing.T) {
+	conf := defaultServiceConfig()
+	conf.Policy.HotspotFallback = false
+	home := netmanagerclient.AccessPoint{BSSID: "AA:BB:CC:00:00:01", SSID: "home", Signal: 70}
+	s := newSimulationWithConfig(t, conf, func(s *simulation) {
+		s.backend.aps = []netmanagerclient.AccessPoint{home}
+	})
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	assert.Empty(t, s.backend.getScans())
+
+	// Asking for results when there are none starts a scan, and callers asking while it is running share it.
+	var results netmanagerclient.ScanResults
+	s.do(func() { results = s.scanResults(time.Minute) })
+	assert.True(t, results.Scanning)
+	assert.Empty(t, results.AccessPoints)
+	s.do(func() { results = s.scanResults(time.Minute) })
+	assert.True(t, results.Scanning)
+	assert.Len(t, s.backend.getScans(), 1)
+
+	s.advance(scanResultsDelay)
+	assert.Equal(t, 1, s.getScanNotifications())
+	scannedAt := s.clock.Now()
+
+	// Results newer than the max age are served from the cache.
+	s.advance(20 * time.Second)
+	s.do(func() { results = s.scanResults(time.Minute) })
+	assert.False(t, results.Scanning)
+	assert.Equal(t, scannedAt, results.ScannedAt)
+	assert.Equal(t, 20*time.Second, results.Age)
+	assert.Equal(t, []netmanagerclient.AccessPoint{home}, results.AccessPoints)
+	assert.Len(t, s.backend.getScans(), 1)
+
+	// No scans while connecting, the scan is started once connected.
+	s.do(func() { s.backend.connect("802-11-wireless", "home", "") })
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTING)
+	s.do(func() { results = s.scanResults(10 * time.Second) })
+	assert.False(t, results.Scanning)
+	assert.Equal(t, scannedAt, results.ScannedAt)
+	assert.Len(t, s.backend.getScans(), 1)
+	s.do(func() { s.backend.connect("802-11-wireless", "home", "192.168.1.20/24") })
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTED)
+	assert.Len(t, s.backend.getScans(), 2)
+	s.advance(scanResultsDelay)
+	assert.Equal(t, 2, s.getScanNotifications())
+
+	// A scan that is interrupted by the radio being turned off is started again once the radio is back on.
+	s.do(func() { results = s.scanResults(0) })
+	assert.True(t, results.Scanning)
+	assert.Len(t, s.backend.getScans(), 3)
+	s.do(func() { require.NoError(t, s.backend.SetWifiRadio(false)) })
+	s.assertState(netmanagerclient.NS_WIFI_OFF)
+	s.advance(scanResultsDelay)
+	assert.Equal(t, 2, s.getScanNotifications())
+	s.do(func() { require.NoError(t, s.backend.SetWifiRadio(true)) })
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	assert.Len(t, s.backend.getScans(), 4)
+	s.advance(scanResultsDelay)
+	assert.Equal(t, 3, s.getScanNotifications())
+
+	// Failing to scan is recorded and the cached results are still served.
+	s.backend.setErr("RequestWifiScan", errors.New("scanning not allowed"))
+	s.do(func() { results = s.scanResults(0) })
+	assert.False(t, results.Scanning)
+	assert.Equal(t, []netmanagerclient.AccessPoint{home}, results.AccessPoints)
+	assert.Equal(t, 1, s.nsm.operationErrors[opScan].Count)
+}
+
+func TestSimulationPeriodicScans(t *testing.T) {
+	conf := defaultServiceConfig()
+	conf.Policy.HotspotFallback = false
+	conf.Policy.ScanConnectTimeout = 0
+	home := netmanagerclient.AccessPoint{BSSID: "AA:BB:CC:00:00:01", SSID: "home", Signal: 70}
+	s := newSimulationWithConfig(t, conf, func(s *simulation) {
+		s.backend.aps = []netmanagerclient.AccessPoint{home}
+	})
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	assert.Empty(t, s.backend.getScans())
+
+	// Scans often while searching for a network, letting clients know each time there are new results.
+	s.advance(scanIntervalSearching)
+	assert.Len(t, s.backend.getScans(), 1)
+	s.advance(scanResultsDelay)
+	assert.Equal(t, 1, s.getScanNotifications())
+	assert.Equal(t, []netmanagerclient.AccessPoint{home}, s.scanResults(time.Hour).AccessPoints)
+	s.advance(scanIntervalSearching - scanResultsDelay)
+	assert.Len(t, s.backend.getScans(), 2)
+
+	// A scan asked for by a client puts off the next periodic scan.
+	s.advance(scanResultsDelay)
+	s.advance(30 * time.Second)
+	s.do(func() { s.scanResults(0) })
+	assert.Len(t, s.backend.getScans(), 3)
+	s.advance(scanIntervalSearching - time.Second)
+	assert.Len(t, s.backend.getScans(), 3)
+	s.advance(time.Second)
+	assert.Len(t, s.backend.getScans(), 4)
+
+	// Doesn't scan while connecting.
+	s.do(func() { s.backend.connect("802-11-wireless", "home", "") })
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTING)
+	s.advance(2 * scanIntervalSearching)
+	assert.Len(t, s.backend.getScans(), 4)
+
+	// Scans rarely once connected.
+	s.do(func() { s.backend.connect("802-11-wireless", "home", "192.168.1.20/24") })
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTED)
+	s.advance(scanIntervalConnected - time.Second)
+	assert.Len(t, s.backend.getScans(), 4)
+	s.advance(time.Second)
+	assert.Len(t, s.backend.getScans(), 5)
+
+	// Keeps on scanning after a scan fails to start.
+	s.backend.setErr("RequestWifiScan", errors.New("scanning not allowed"))
+	s.advance(scanIntervalConnected)
+	assert.Equal(t, 1, s.nsm.operationErrors[opScan].Count)
+	s.backend.setErr("RequestWifiScan", nil)
+	s.advance(scanIntervalConnected)
+	assert.Len(t, s.backend.getScans(), 6)
+	s.advance(scanResultsDelay)
+	assert.Equal(t, 6, s.getScanNotifications())
+}
+
+func TestSimulationScanDuringError(t *testing.T) {
+	conf := defaultServiceConfig()
+	conf.Policy.HotspotFallback = false
+	s := newSimulationWithConfig(t, conf, nil)
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+
+	var results netmanagerclient.ScanResults
+	s.do(func() { results = s.scanResults(0) })
+	assert.True(t, results.Scanning)
+	assert.Len(t, s.backend.getScans(), 1)
+
+	// The scan is no longer pending once its results were due, even though the service is in the error state.
+	s.do(func() {
+		s.backend.setErr("ActiveConnections", errors.New("nm not running"))
+		s.backend.notify()
+	})
+	s.assertState(netmanagerclient.NS_ERROR)
+	s.advance(scanResultsDelay)
+	s.assertState(netmanagerclient.NS_ERROR)
+	s.do(func() { results = s.scanResults(0) })
+	assert.False(t, results.Scanning)
+	assert.Equal(t, 0, s.getScanNotifications())
+
+	// The scan is started again once the service has recovered.
+	s.backend.setErr("ActiveConnections", nil)
+	s.advance(s.getErrors().RetryAt.Sub(s.clock.Now()))
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	assert.Len(t, s.backend.getScans(), 2)
+	s.advance(scanResultsDelay)
+	assert.Equal(t, 1, s.getScanNotifications())
+}
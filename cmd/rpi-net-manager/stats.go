@@ -0,0 +1,107 @@
+package main
+
+import (
+	"time"
+
+	netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+)
+
+// updateNetworkStats counts the connection attempts and successes, and the time spent connected, from a state transition.
+// Needs to be called with the mutex locked.
+func (nsm *networkStateMachine) updateNetworkStats(newState netmanagerclient.NetworkState, newConName string) {
+	stillConnected := newState == netmanagerclient.NS_WIFI_CONNECTED && newConName == nsm.connectedTo
+	if !stillConnected && newState != netmanagerclient.NS_ERROR {
+		nsm.endConnectedSession()
+	}
+
+	switch newState {
+	case netmanagerclient.NS_WIFI_CONNECTING:
+		nsm.countAttempt(newConName)
+	case netmanagerclient.NS_ERROR:
+		// Carry on with the attempt once recovered.
+	default:
+		nsm.attempt = ""
+
+	case netmanagerclient.NS_WIFI_CONNECTED:
+		// The connection can stay up while the service recovers from an error or restarts.
+		if stillConnected {
+			return
+		}
+		nsm.countAttempt(newConName)
+		nsm.attempt = ""
+		stats := nsm.networkStats[newConName]
+		stats.Successes++
+		nsm.networkStats[newConName] = stats
+		nsm.connectedTo = newConName
+		nsm.connectedSince = nsm.clock.Now()
+		nsm.recordSignalStrength(newConName)
+	}
+}
+
+// countAttempt counts an attempt to connect to the network, if it hasn't already been counted.
+func (nsm *networkStateMachine) countAttempt(id string) {
+	if nsm.attempt == id {
+		return
+	}
+	nsm.attempt = id
+	stats := nsm.networkStats[id]
+	stats.Attempts++
+	nsm.networkStats[id] = stats
+}
+
+// recordFailureStats records a failed attempt to connect to the network. The attempt was counted when the
+// state machine saw it connecting.
+func (nsm *networkStateMachine) recordFailureStats(f ConnectionFailure) {
+	stats := nsm.networkStats[f.ID]
+	stats.LastFailure = nsm.clock.Now()
+	stats.LastFailureReason = f.Reason
+	nsm.networkStats[f.ID] = stats
+}
+
+// countConnectedTime adds the time since connectedSince to the total connected time of the network.
+func (nsm *networkStateMachine) countConnectedTime() {
+	if nsm.connectedTo == "" {
+		return
+	}
+	now := nsm.clock.Now()
+	stats := nsm.networkStats[nsm.connectedTo]
+	stats.ConnectedTime += now.Sub(nsm.connectedSince)
+	nsm.networkStats[nsm.connectedTo] = stats
+	nsm.connectedSince = now
+}
+
+func (nsm *networkStateMachine) endConnectedSession() {
+	nsm.countConnectedTime()
+	nsm.connectedTo = ""
+	nsm.connectedSince = time.Time{}
+}
+
+func (nsm *networkStateMachine) recordSignalStrength(id string) {
+	signal, err := nsm.backend.ActiveSignalStrength("wlan0")
+	if err != nil {
+		log.Printf("failed to get signal strength: %v", err)
+		return
+	}
+	stats := nsm.networkStats[id]
+	stats.LastSignal = signal
+	stats.LastSignalTime = nsm.clock.Now()
+	nsm.networkStats[id] = stats
+}
+
+// currentNetworkStats returns the statistics of each network, including the current signal strength and
+// time connected of the network it is connected to. Needs to be called with the mutex locked.
+func (nsm *networkStateMachine) currentNetworkStats() map[string]netmanagerclient.NetworkStats {
+	if nsm.state == netmanagerclient.NS_WIFI_CONNECTED {
+		nsm.recordSignalStrength(nsm.connectedTo)
+	}
+	stats := map[string]netmanagerclient.NetworkStats{}
+	for id, s := range nsm.networkStats {
+		stats[id] = s
+	}
+	if nsm.connectedTo != "" {
+		s := stats[nsm.connectedTo]
+		s.ConnectedTime += nsm.clock.Now().Sub(nsm.connectedSince)
+		stats[nsm.connectedTo] = s
+	}
+	return stats
+}
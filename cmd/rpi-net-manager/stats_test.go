@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	netmanagerclient "github.com/TheCacophonyProject/rpi-net-manager/netmanagerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulationNetworkStats(t *testing.T) {
+	s := newSimulation(t, func(b *fakeBackend) {
+		b.profiles["home"] = map[string]string{}
+		b.bssid = "AA:BB:CC:DD:EE:FF"
+		b.signal = 70
+	})
+
+	// A failed attempt.
+	s.do(func() { s.backend.connect("802-11-wireless", "home", "") })
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTING)
+	s.do(func() { s.backend.fail("home", netmanagerclient.FAILURE_NO_AP) })
+	failedAt := s.clock.Now()
+
+	// A successful attempt.
+	s.advance(2 * time.Second)
+	s.do(func() { s.backend.connect("802-11-wireless", "home", "") })
+	s.do(func() { s.backend.connect("802-11-wireless", "home", "192.168.1.20/24") })
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTED)
+	s.advance(10 * time.Minute)
+
+	stats := s.nsm.networkStats["home"]
+	assert.Equal(t, 2, stats.Attempts)
+	assert.Equal(t, 1, stats.Successes)
+	assert.Equal(t, failedAt, stats.LastFailure)
+	assert.Equal(t, netmanagerclient.FAILURE_NO_AP, stats.LastFailureReason)
+	assert.Equal(t, 70, stats.LastSignal)
+	assert.Equal(t, time.Duration(0), stats.ConnectedTime)
+
+	// The current connection is included in the stats, with the current signal.
+	s.backend.mu.Lock()
+	s.backend.signal = 55
+	s.backend.mu.Unlock()
+	s.nsm.mux.Lock()
+	current := s.nsm.currentNetworkStats()["home"]
+	s.nsm.mux.Unlock()
+	assert.Equal(t, 10*time.Minute, current.ConnectedTime)
+	assert.Equal(t, 55, current.LastSignal)
+	assert.Equal(t, s.clock.Now(), current.LastSignalTime)
+
+	s.do(func() { s.backend.disconnect("home", false) })
+	s.assertState(netmanagerclient.NS_WIFI_SCANNING)
+	assert.Equal(t, 10*time.Minute, s.nsm.networkStats["home"].ConnectedTime)
+	assert.Equal(t, 2, s.nsm.networkStats["home"].Attempts)
+}
+
+func TestNetworkStatsAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	setup := func(s *simulation) {
+		s.backend.profiles["home"] = map[string]string{}
+		s.backend.active = []ActiveConnection{{Type: "802-11-wireless", Name: "home"}}
+		s.backend.ip4["home"] = "192.168.1.20/24"
+		s.nsm.store = &stateStore{path: path, bootID: "boot-1"}
+		s.nsm.restoreState()
+	}
+	s := newSimulationWithConfig(t, defaultServiceConfig(), setup)
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTED)
+	s.advance(time.Hour)
+	s.stop()
+	require.NoError(t, s.nsm.shutdown())
+	assert.Equal(t, 1, s.nsm.networkStats["home"].Successes)
+	assert.Equal(t, time.Hour, s.nsm.networkStats["home"].ConnectedTime)
+
+	// Still being connected after the service restarts isn't counted as connecting again.
+	s = newSimulationWithConfig(t, defaultServiceConfig(), setup)
+	s.assertState(netmanagerclient.NS_WIFI_CONNECTED)
+	s.advance(time.Hour)
+	s.do(func() { s.backend.disconnect("home", false) })
+	assert.Equal(t, 1, s.nsm.networkStats["home"].Attempts)
+	assert.Equal(t, 1, s.nsm.networkStats["home"].Successes)
+	assert.Equal(t, 2*time.Hour, s.nsm.networkStats["home"].ConnectedTime)
+}
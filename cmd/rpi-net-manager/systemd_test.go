@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	assert.NoError(t, sdNotify("READY=1"))
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	require.NoError(t, sdNotifyReady())
+	require.NoError(t, sdNotifyWatchdog())
+	buf := make([]byte, 64)
+	for _, expected := range []string{"READY=1", "WATCHDOG=1"} {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(buf[:n]))
+	}
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing.sock"))
+	assert.Error(t, sdNotify("READY=1"))
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	for _, test := range []struct {
+		usec, pid string
+		interval  time.Duration
+		err       bool
+	}{
+		{"", "", 0, false},
+		{"60000000", "", 30 * time.Second, false},
+		{"60000000", strconv.Itoa(os.Getpid()), 30 * time.Second, false},
+		{"60000000", strconv.Itoa(os.Getpid() + 1), 0, false},
+		{"a minute", "", 0, true},
+		{"60000000", "me", 0, true},
+	} {
+		t.Setenv("WATCHDOG_USEC", test.usec)
+		t.Setenv("WATCHDOG_PID", test.pid)
+		interval, err := sdWatchdogInterval()
+		if test.err {
+			assert.Error(t, err, test)
+		} else {
+			assert.NoError(t, err, test)
+			assert.Equal(t, test.interval, interval, test)
+		}
+	}
+}
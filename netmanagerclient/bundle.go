@@ -0,0 +1,408 @@
+package netmanagerclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// NetworkBundleVersion is the version of the export format. It is increased when a change to the
+// format would mean an older version can't import it correctly.
+const NetworkBundleVersion = 1
+
+// NetworkBundle is the saved user networks of a device, so they can be moved to another device.
+// It has the credentials of the networks so needs to be kept private.
+type NetworkBundle struct {
+	Version    int               `json:"version"`
+	ExportedAt time.Time         `json:"exportedAt"`
+	Networks   []ExportedNetwork `json:"networks"`
+}
+
+// ExportedNetwork is a saved network with everything needed to add it again.
+type ExportedNetwork struct {
+	ID         string              `json:"id"`
+	SSID       string              `json:"ssid"`              // The display form of the SSID.
+	SSIDHex    string              `json:"ssidHex,omitempty"` // Only set for SSIDs that aren't UTF-8, as JSON has to be.
+	Security   WifiSecurity        `json:"security"`
+	PSK        string              `json:"psk,omitempty"`
+	Enterprise *ExportedEnterprise `json:"enterprise,omitempty"` // Only set for enterprise networks.
+	Hidden     bool                `json:"hidden,omitempty"`
+	Priority   int                 `json:"priority"`
+	IP         NetworkIPConfig     `json:"ip"`
+}
+
+// ExportedEnterprise is the login details of an enterprise network.
+type ExportedEnterprise struct {
+	EAPMethod         EAPMethod `json:"eapMethod"`
+	Phase2Auth        string    `json:"phase2Auth"`
+	Identity          string    `json:"identity"`
+	AnonymousIdentity string    `json:"anonymousIdentity,omitempty"`
+	Password          string    `json:"password"`
+	CACert            string    `json:"caCert,omitempty"` // PEM encoded.
+}
+
+// ConflictPolicy is what to do when importing a network with the same ID as a saved network.
+type ConflictPolicy string
+
+const (
+	CONFLICT_SKIP      ConflictPolicy = "skip"      // Keep the saved network.
+	CONFLICT_OVERWRITE ConflictPolicy = "overwrite" // Replace the saved network. It is disconnected if in use and the security type changes.
+	CONFLICT_RENAME    ConflictPolicy = "rename"    // Add the network with a new ID, e.g. 'home (2)'.
+)
+
+// ImportAction is what was done, or for a dry run what would be done, with an imported network.
+type ImportAction string
+
+const (
+	IMPORT_ADDED       ImportAction = "added"
+	IMPORT_OVERWRITTEN ImportAction = "overwritten"
+	IMPORT_RENAMED     ImportAction = "renamed"
+	IMPORT_SKIPPED     ImportAction = "skipped"
+	IMPORT_FAILED      ImportAction = "failed"
+)
+
+// ImportOptions are how to import a bundle.
+type ImportOptions struct {
+	Conflict ConflictPolicy
+	// DryRun checks the bundle and reports what would be done without changing any networks.
+	DryRun bool
+	// Bushnet is the IDs of the bushnet networks, which aren't imported. They are got from the service if
+	// not given, the service gives its own so it doesn't call itself.
+	Bushnet []string
+}
+
+// ImportResult is the outcome of importing one network.
+type ImportResult struct {
+	ID     string       `json:"id"`
+	NewID  string       `json:"newID,omitempty"` // The ID it was added with when renamed.
+	Action ImportAction `json:"action"`
+	Reason string       `json:"reason,omitempty"` // Why it was skipped or failed.
+	// Retry is set when it failed for a reason that might not happen again, such as NetworkManager not responding.
+	Retry bool `json:"retry,omitempty"`
+}
+
+var ErrUnknownConflictPolicy = InputError{Message: fmt.Sprintf("conflict policy must be '%s', '%s' or '%s'", CONFLICT_SKIP, CONFLICT_OVERWRITE, CONFLICT_RENAME)}
+
+// ExportWifiNetworks gets the saved user networks, with their credentials, priority and IP config.
+// Bushnet networks are left out as every device already has them. Needs to be run as root to read the credentials.
+func ExportWifiNetworks() (*NetworkBundle, error) {
+	networks, err := ListUserSavedWifiNetworks()
+	if err != nil {
+		return nil, err
+	}
+	bundle := &NetworkBundle{
+		Version:    NetworkBundleVersion,
+		ExportedAt: time.Now(),
+		Networks:   []ExportedNetwork{},
+	}
+	for _, network := range networks {
+		exported, err := exportWifiNetwork(network)
+		if err != nil {
+			return nil, err
+		}
+		if exported == nil {
+			log.Printf("Not exporting '%s' as its security type isn't supported", network.ID)
+			continue
+		}
+		bundle.Networks = append(bundle.Networks, *exported)
+	}
+	return bundle, nil
+}
+
+func exportWifiNetwork(network WiFiNetwork) (*ExportedNetwork, error) {
+	exported := &ExportedNetwork{
+		ID:       network.ID,
+		Security: network.Security,
+		Hidden:   network.Hidden,
+		Priority: network.Priority,
+		IP:       network.IP,
+	}
+	exported.SetSSID(network.RawSSID)
+	switch network.Security {
+	case SECURITY_OPEN:
+	case SECURITY_WPA2_PSK, SECURITY_WPA3_SAE, SECURITY_WPA2_WPA3:
+		secrets, err := getConnectionSecrets(network.ID, []string{"802-11-wireless-security.psk"})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PSK of '%s': %v", network.ID, err)
+		}
+		exported.PSK = secrets["802-11-wireless-security.psk"]
+	case SECURITY_WPA2_EAP, SECURITY_WPA3_EAP:
+		secrets, err := getConnectionSecrets(network.ID, []string{
+			"802-1x.eap", "802-1x.phase2-auth", "802-1x.identity", "802-1x.anonymous-identity", "802-1x.password", "802-1x.ca-cert",
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read login details of '%s': %v", network.ID, err)
+		}
+		exported.Enterprise = &ExportedEnterprise{
+			EAPMethod:         EAPMethod(secrets["802-1x.eap"]),
+			Phase2Auth:        secrets["802-1x.phase2-auth"],
+			Identity:          secrets["802-1x.identity"],
+			AnonymousIdentity: secrets["802-1x.anonymous-identity"],
+			Password:          secrets["802-1x.password"],
+		}
+		if path := secrets["802-1x.ca-cert"]; path != "" {
+			cert, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA certificate of '%s': %v", network.ID, err)
+			}
+			exported.Enterprise.CACert = string(cert)
+		}
+	default:
+		return nil, nil
+	}
+	return exported, nil
+}
+
+// SetSSID sets the SSID of the network, SSIDHex is set too if it isn't UTF-8.
+func (n *ExportedNetwork) SetSSID(ssid SSID) {
+	n.SSID = ssid.String()
+	n.SSIDHex = ""
+	if !ssid.IsUTF8() {
+		n.SSIDHex = ssid.Hex()
+	}
+}
+
+// RawSSID gets the bytes of the SSID, from SSIDHex if it is set.
+func (n ExportedNetwork) RawSSID() (SSID, error) {
+	if n.SSIDHex == "" {
+		return SSID(n.SSID), nil
+	}
+	return ParseSSIDHex(n.SSIDHex)
+}
+
+// ssid is the bytes of the SSID as a string, for adding the network. It is empty if SSIDHex isn't valid,
+// which validate checks for.
+func (n ExportedNetwork) ssid() string {
+	ssid, err := n.RawSSID()
+	if err != nil {
+		return ""
+	}
+	return string(ssid)
+}
+
+// ParseNetworkBundle reads a bundle made by ExportWifiNetworks.
+func ParseNetworkBundle(data []byte) (*NetworkBundle, error) {
+	bundle := &NetworkBundle{}
+	if err := json.Unmarshal(data, bundle); err != nil {
+		return nil, InputError{Message: fmt.Sprintf("failed to parse network bundle: %v", err)}
+	}
+	if bundle.Version < 1 || bundle.Version > NetworkBundleVersion {
+		return nil, InputError{Message: fmt.Sprintf("unsupported network bundle version %d", bundle.Version)}
+	}
+	return bundle, nil
+}
+
+// ImportWifiNetworks adds the networks from the bundle. A network that can't be imported doesn't stop
+// the others from being imported, the result for each network says what was done with it.
+func ImportWifiNetworks(bundle *NetworkBundle, options ImportOptions) ([]ImportResult, error) {
+	if options.Conflict != CONFLICT_SKIP && options.Conflict != CONFLICT_OVERWRITE && options.Conflict != CONFLICT_RENAME {
+		return nil, ErrUnknownConflictPolicy
+	}
+	saved, err := savedWifiNetworks()
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	savedSecurity := map[string]WifiSecurity{}
+	for _, network := range saved {
+		ids = append(ids, network.ID)
+		savedSecurity[network.ID] = network.Security
+	}
+
+	bushnet := bushnetIDs(options.Bushnet)
+	if len(bushnet) == 0 {
+		bushnet = bushnetNetworks()
+	}
+	results := planImport(bundle.Networks, ids, bushnet, options.Conflict)
+	if options.DryRun {
+		return results, nil
+	}
+	for i, result := range results {
+		if result.Action == IMPORT_SKIPPED || result.Action == IMPORT_FAILED {
+			continue
+		}
+		if err := applyImport(bundle.Networks[i], result, savedSecurity[result.ID], bushnet); err != nil {
+			results[i].Action = IMPORT_FAILED
+			results[i].Reason = err.Error()
+			// Invalid networks will fail again, others failed because of NetworkManager.
+			var inputErr InputError
+			results[i].Retry = !errors.As(err, &inputErr)
+		}
+	}
+	return results, nil
+}
+
+// planImport works out what to do with each network, without changing anything.
+func planImport(networks []ExportedNetwork, savedIDs []string, bushnet bushnetIDs, conflict ConflictPolicy) []ImportResult {
+	taken := map[string]bool{}
+	for _, id := range savedIDs {
+		taken[id] = true
+	}
+	imported := map[string]bool{}
+	results := []ImportResult{}
+	for _, network := range networks {
+		result := ImportResult{ID: network.ID, Action: IMPORT_ADDED}
+		switch {
+		case bushnet.check(network.ID) != nil || bushnet.check(network.SSID) != nil:
+			result.Action = IMPORT_SKIPPED
+			result.Reason = "bushnet networks are not imported"
+		case imported[network.ID]:
+			result.Action = IMPORT_FAILED
+			result.Reason = "network is in the bundle more than once"
+		default:
+			if err := network.validate(); err != nil {
+				result.Action = IMPORT_FAILED
+				result.Reason = err.Error()
+			}
+		}
+		if result.Action == IMPORT_ADDED && taken[network.ID] {
+			switch conflict {
+			case CONFLICT_SKIP:
+				result.Action = IMPORT_SKIPPED
+				result.Reason = "a network with the same ID is already saved"
+			case CONFLICT_OVERWRITE:
+				result.Action = IMPORT_OVERWRITTEN
+			case CONFLICT_RENAME:
+				result.Action = IMPORT_RENAMED
+				result.NewID = freeID(network.ID, taken, bushnet)
+			}
+		}
+		if result.Action != IMPORT_FAILED {
+			imported[network.ID] = true
+		}
+		if result.Action != IMPORT_SKIPPED && result.Action != IMPORT_FAILED {
+			taken[result.ID] = true
+			if result.NewID != "" {
+				taken[result.NewID] = true
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// freeID finds an ID, based on the given one, that isn't taken.
+func freeID(id string, taken map[string]bool, bushnet bushnetIDs) string {
+	for i := 2; ; i++ {
+		newID := id + " (" + strconv.Itoa(i) + ")"
+		if !taken[newID] && bushnet.check(newID) == nil {
+			return newID
+		}
+	}
+}
+
+// validate checks the network can be added, the same as when adding it by hand.
+func (n ExportedNetwork) validate() error {
+	if n.ID == "" {
+		return InputError{Message: "network has no ID"}
+	}
+	ssid, err := n.RawSSID()
+	if err != nil {
+		return err
+	}
+	if err := checkSSID(string(ssid)); err != nil {
+		return err
+	}
+	if n.Enterprise != nil {
+		if err := n.enterpriseNetwork().Validate(); err != nil {
+			return err
+		}
+	} else if err := CheckWifiSecurity(n.Security, n.PSK); err != nil {
+		return err
+	}
+	if err := CheckWifiNetworkPriority(n.Priority); err != nil {
+		return err
+	}
+	return n.IP.Validate()
+}
+
+func (n ExportedNetwork) enterpriseNetwork() EnterpriseNetwork {
+	e := n.Enterprise
+	return EnterpriseNetwork{
+		SSID:              n.ssid(),
+		Security:          n.Security,
+		EAPMethod:         e.EAPMethod,
+		Phase2Auth:        e.Phase2Auth,
+		Identity:          e.Identity,
+		AnonymousIdentity: e.AnonymousIdentity,
+		Password:          e.Password,
+		CACert:            []byte(e.CACert),
+		Hidden:            n.Hidden,
+	}
+}
+
+// importSettings are the properties set when the network is added, on top of its SSID and credentials.
+func (n ExportedNetwork) importSettings() map[string]string {
+	c := ipConfigSettings(n.IP)
+	c["connection.autoconnect-priority"] = strconv.Itoa(n.Priority)
+	c["802-11-wireless.hidden"] = nmBool(n.Hidden)
+	return c
+}
+
+func applyImport(n ExportedNetwork, result ImportResult, savedSecurity WifiSecurity, bushnet bushnetIDs) error {
+	id := n.ID
+	switch result.Action {
+	case IMPORT_RENAMED:
+		id = result.NewID
+	case IMPORT_OVERWRITTEN:
+		// A network with a PSK of the same type can be modified, so it isn't disconnected if it is in use.
+		if n.Security == savedSecurity && n.PSK != "" && n.Enterprise == nil {
+			// The PSK is checked for its security type, WPA3-SAE passwords can be shorter than WPA2 ones.
+			if err := CheckWifiSecurity(n.Security, n.PSK); err != nil {
+				return err
+			}
+			if err := bushnet.check(id); err != nil {
+				return err
+			}
+			settings := n.importSettings()
+			settings["wifi.ssid"] = n.ssid()
+			settings["wifi-sec.psk"] = n.PSK
+			return ModifyNetworkConfig(id, settings)
+		}
+		// Otherwise the security settings would need to be changed, so add it again.
+		return replaceWifiNetwork(id, n, bushnet)
+	case IMPORT_ADDED:
+	default:
+		return errors.New("nothing to import")
+	}
+	return addImportedNetwork(id, n, bushnet)
+}
+
+func addImportedNetwork(id string, n ExportedNetwork, bushnet bushnetIDs) error {
+	if n.Enterprise != nil {
+		return addEnterpriseWifiNetwork(id, n.enterpriseNetwork(), n.importSettings(), bushnet)
+	}
+	return addWifiNetwork(id, n.ssid(), n.PSK, n.Security, n.importSettings(), bushnet)
+}
+
+// replaceWifiNetwork replaces the saved network with the ID. The network is added under a temporary ID first,
+// so the saved network is only removed once the new one has been added.
+func replaceWifiNetwork(id string, n ExportedNetwork, bushnet bushnetIDs) error {
+	tempID := id + " (importing)"
+	if err := addImportedNetwork(tempID, n, bushnet); err != nil {
+		return err
+	}
+	if err := removeWifiNetwork(id); err != nil {
+		if err := removeWifiNetwork(tempID); err != nil {
+			log.Printf("Failed to remove '%s': %v", tempID, err)
+		}
+		return err
+	}
+	rename := map[string]string{"connection.id": id}
+	// CA certificates are stored by the connection ID, so it is saved again for the new ID.
+	if n.Enterprise != nil && n.Enterprise.CACert != "" {
+		path, err := saveCACert(id, []byte(n.Enterprise.CACert))
+		if err != nil {
+			return err
+		}
+		rename["802-1x.ca-cert"] = path
+	}
+	if err := ModifyNetworkConfig(tempID, rename); err != nil {
+		return fmt.Errorf("failed to rename '%s' to '%s': %v", tempID, id, err)
+	}
+	removeCACert(tempID)
+	return nil
+}
@@ -0,0 +1,129 @@
+package netmanagerclient
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testBundle() *NetworkBundle {
+	return &NetworkBundle{
+		Version:    NetworkBundleVersion,
+		ExportedAt: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		Networks: []ExportedNetwork{
+			{ID: "home", SSID: "home", Security: SECURITY_WPA2_PSK, PSK: "password", Priority: 5, IP: DefaultIPConfig()},
+			{ID: "cafe", SSID: "cafe", Security: SECURITY_OPEN, IP: DefaultIPConfig()},
+			{ID: "office", SSID: "office", Security: SECURITY_WPA2_EAP, Hidden: true, IP: NetworkIPConfig{
+				IPv4: IPConfig{Method: IP_METHOD_MANUAL, Addresses: []string{"192.168.1.10/24"}, Gateway: "192.168.1.1"},
+				IPv6: IPConfig{Method: IP_METHOD_AUTO},
+			}, Enterprise: &ExportedEnterprise{EAPMethod: EAP_PEAP, Phase2Auth: "mschapv2", Identity: "user", Password: "secret"}},
+		},
+	}
+}
+
+func TestParseNetworkBundle(t *testing.T) {
+	data, err := json.Marshal(testBundle())
+	require.NoError(t, err)
+	bundle, err := ParseNetworkBundle(data)
+	require.NoError(t, err)
+	assert.Equal(t, testBundle(), bundle)
+
+	for _, data := range []string{`{"networks": []}`, `{"version": 99, "networks": []}`, `{"version": 1, "networks": [`} {
+		_, err := ParseNetworkBundle([]byte(data))
+		assert.IsType(t, InputError{}, err, data)
+	}
+}
+
+func TestPlanImport(t *testing.T) {
+	networks := testBundle().Networks
+
+	results := planImport(networks, []string{"cafe", "other"}, defaultBushnetNetworks, CONFLICT_SKIP)
+	assert.Equal(t, []ImportAction{IMPORT_ADDED, IMPORT_SKIPPED, IMPORT_ADDED}, actions(results))
+
+	results = planImport(networks, []string{"cafe"}, defaultBushnetNetworks, CONFLICT_OVERWRITE)
+	assert.Equal(t, []ImportAction{IMPORT_ADDED, IMPORT_OVERWRITTEN, IMPORT_ADDED}, actions(results))
+
+	results = planImport(networks, []string{"cafe", "cafe (2)"}, defaultBushnetNetworks, CONFLICT_RENAME)
+	assert.Equal(t, []ImportAction{IMPORT_ADDED, IMPORT_RENAMED, IMPORT_ADDED}, actions(results))
+	assert.Equal(t, "cafe (3)", results[1].NewID)
+	assert.Empty(t, results[0].NewID)
+}
+
+func TestPlanImportInvalidNetworks(t *testing.T) {
+	networks := []ExportedNetwork{
+		{ID: "bushnet", SSID: "bushnet", Security: SECURITY_WPA2_PSK, PSK: "feathers", IP: DefaultIPConfig()},
+		{ID: "short", SSID: "short", Security: SECURITY_WPA2_PSK, PSK: "short", IP: DefaultIPConfig()},
+		{ID: "priority", SSID: "priority", Security: SECURITY_OPEN, Priority: 5000, IP: DefaultIPConfig()},
+		{ID: "ip", SSID: "ip", Security: SECURITY_OPEN, IP: NetworkIPConfig{IPv4: IPConfig{Method: IP_METHOD_MANUAL}, IPv6: IPConfig{Method: IP_METHOD_AUTO}}},
+		{ID: "eap", SSID: "eap", Security: SECURITY_WPA2_EAP, IP: DefaultIPConfig(), Enterprise: &ExportedEnterprise{EAPMethod: EAP_PEAP, Phase2Auth: "mschapv2"}},
+		{ID: "home", SSID: "home", Security: SECURITY_OPEN, IP: DefaultIPConfig()},
+		{ID: "home", SSID: "home", Security: SECURITY_OPEN, IP: DefaultIPConfig()},
+	}
+	results := planImport(networks, nil, defaultBushnetNetworks, CONFLICT_RENAME)
+	assert.Equal(t, []ImportAction{
+		IMPORT_SKIPPED, IMPORT_FAILED, IMPORT_FAILED, IMPORT_FAILED, IMPORT_FAILED, IMPORT_ADDED, IMPORT_FAILED,
+	}, actions(results))
+	for _, result := range results[1:5] {
+		assert.NotEmpty(t, result.Reason)
+	}
+}
+
+func TestPlanImportConfiguredBushnet(t *testing.T) {
+	networks := []ExportedNetwork{
+		{ID: "fieldnet", SSID: "fieldnet", Security: SECURITY_WPA2_PSK, PSK: "feathers", IP: DefaultIPConfig()},
+		{ID: "bushnet", SSID: "bushnet", Security: SECURITY_WPA2_PSK, PSK: "feathers", IP: DefaultIPConfig()},
+		{ID: "home", SSID: "home", Security: SECURITY_OPEN, IP: DefaultIPConfig()},
+	}
+	results := planImport(networks, []string{"home"}, bushnetIDs{"fieldnet", "home (2)"}, CONFLICT_RENAME)
+	assert.Equal(t, []ImportAction{IMPORT_SKIPPED, IMPORT_ADDED, IMPORT_RENAMED}, actions(results))
+	assert.Equal(t, "home (3)", results[2].NewID)
+}
+
+func TestExportedNetworkSSID(t *testing.T) {
+	n := ExportedNetwork{ID: "cafe", Security: SECURITY_OPEN, IP: DefaultIPConfig()}
+	n.SetSSID(SSID("Caf\xe9"))
+	assert.Equal(t, `Caf\xe9`, n.SSID)
+	assert.Equal(t, "436166E9", n.SSIDHex)
+
+	// The bytes of the SSID are kept through JSON.
+	data, err := json.Marshal(n)
+	require.NoError(t, err)
+	read := ExportedNetwork{}
+	require.NoError(t, json.Unmarshal(data, &read))
+	ssid, err := read.RawSSID()
+	require.NoError(t, err)
+	assert.Equal(t, SSID("Caf\xe9"), ssid)
+	assert.NoError(t, read.validate())
+
+	n.SetSSID(SSID("home"))
+	assert.Equal(t, "home", n.SSID)
+	assert.Empty(t, n.SSIDHex)
+
+	for _, bad := range []ExportedNetwork{
+		{ID: "bad", SSID: "bad", SSIDHex: "not hex", Security: SECURITY_OPEN, IP: DefaultIPConfig()},
+		{ID: "long", SSID: "this SSID is longer than 32 bytes", Security: SECURITY_OPEN, IP: DefaultIPConfig()},
+		{ID: "nul", SSIDHex: "610062", Security: SECURITY_OPEN, IP: DefaultIPConfig()},
+		{ID: "empty", Security: SECURITY_OPEN, IP: DefaultIPConfig()},
+	} {
+		assert.Error(t, bad.validate(), bad.ID)
+	}
+}
+
+func actions(results []ImportResult) []ImportAction {
+	actions := []ImportAction{}
+	for _, result := range results {
+		actions = append(actions, result.Action)
+	}
+	return actions
+}
+
+func TestImportSettings(t *testing.T) {
+	settings := testBundle().Networks[2].importSettings()
+	assert.Equal(t, "0", settings["connection.autoconnect-priority"])
+	assert.Equal(t, "yes", settings["802-11-wireless.hidden"])
+	assert.Equal(t, "manual", settings["ipv4.method"])
+	assert.Equal(t, "192.168.1.10/24", settings["ipv4.addresses"])
+}
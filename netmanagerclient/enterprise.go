@@ -0,0 +1,180 @@
+package netmanagerclient
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// EAPMethod is the outer authentication method used by an enterprise network.
+type EAPMethod string
+
+const (
+	EAP_PEAP EAPMethod = "peap"
+	EAP_TTLS EAPMethod = "ttls"
+)
+
+// phase2Methods are the inner authentication methods that can be used with each EAP method.
+var phase2Methods = map[EAPMethod][]string{
+	EAP_PEAP: {"mschapv2", "gtc", "md5"},
+	EAP_TTLS: {"pap", "chap", "mschap", "mschapv2"},
+}
+
+// CACertDir is where the CA certificates of enterprise networks are stored. Only root can read them.
+const CACertDir = "/var/lib/rpi-net-manager/certs"
+
+// caCertDir is a variable so tests can change it.
+var caCertDir = CACertDir
+
+// EnterpriseNetwork is a WPA2 or WPA3 Enterprise (802.1X) network.
+type EnterpriseNetwork struct {
+	SSID              string
+	Security          WifiSecurity // SECURITY_WPA2_EAP or SECURITY_WPA3_EAP.
+	EAPMethod         EAPMethod
+	Phase2Auth        string // The inner authentication, e.g. mschapv2 for PEAP or pap for TTLS.
+	Identity          string
+	AnonymousIdentity string // Optional, the identity sent outside of the encrypted tunnel.
+	Password          string
+	CACert            []byte // Optional, PEM encoded certificate to check the authentication server with.
+	Hidden            bool   // If the network doesn't broadcast its SSID.
+}
+
+var (
+	ErrIdentityRequired = InputError{Message: "an identity is required for enterprise networks"}
+	ErrPasswordRequired = InputError{Message: "a password is required for enterprise networks"}
+	ErrUnknownEAPMethod = InputError{Message: "EAP method must be 'peap' or 'ttls'"}
+	ErrInvalidCACert    = InputError{Message: "the CA certificate is not a valid PEM encoded certificate"}
+)
+
+// Validate checks that the network can be added.
+func (n EnterpriseNetwork) Validate() error {
+	if err := checkSSID(n.SSID); err != nil {
+		return err
+	}
+	if n.Security != SECURITY_WPA2_EAP && n.Security != SECURITY_WPA3_EAP {
+		return ErrUnknownSecurity
+	}
+	methods, ok := phase2Methods[n.EAPMethod]
+	if !ok {
+		return ErrUnknownEAPMethod
+	}
+	if !slices.Contains(methods, n.Phase2Auth) {
+		return InputError{Message: fmt.Sprintf("phase 2 auth for %s must be one of %v", n.EAPMethod, methods)}
+	}
+	if n.Identity == "" {
+		return ErrIdentityRequired
+	}
+	if n.Password == "" {
+		return ErrPasswordRequired
+	}
+	if len(n.CACert) > 0 {
+		if err := checkCACert(n.CACert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkCACert(data []byte) error {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return ErrInvalidCACert
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return ErrInvalidCACert
+	}
+	return nil
+}
+
+// AddEnterpriseWifiNetwork adds a WPA2 or WPA3 Enterprise network.
+func AddEnterpriseWifiNetwork(n EnterpriseNetwork) error {
+	return addEnterpriseWifiNetwork(connectionID(n.SSID), n, nil, bushnetNetworks())
+}
+
+// addEnterpriseWifiNetwork adds the network with the given connection ID and any extra properties.
+func addEnterpriseWifiNetwork(id string, n EnterpriseNetwork, extra map[string]string, bushnet bushnetIDs) error {
+	alreadyExists, err := CheckIfNetworkExists(id)
+	if err != nil {
+		return err
+	}
+	if alreadyExists {
+		return ErrNetworkAlreadyExists
+	}
+	if err := n.Validate(); err != nil {
+		return err
+	}
+	if err := bushnet.check(n.SSID); err != nil {
+		return err
+	}
+	if err := bushnet.check(id); err != nil {
+		return err
+	}
+
+	c := newWifiConnectionConfig(id, n.SSID)
+	c["802-11-wireless.hidden"] = nmBool(n.Hidden)
+	c["wifi-sec.key-mgmt"] = "wpa-eap"
+	c["802-1x.eap"] = string(n.EAPMethod)
+	c["802-1x.phase2-auth"] = n.Phase2Auth
+	c["802-1x.identity"] = n.Identity
+	c["802-1x.password"] = n.Password
+	if n.Security == SECURITY_WPA3_EAP {
+		c["wifi-sec.pmf"] = "required"
+	}
+	if n.AnonymousIdentity != "" {
+		c["802-1x.anonymous-identity"] = n.AnonymousIdentity
+	}
+	for k, v := range extra {
+		c[k] = v
+	}
+	if len(n.CACert) > 0 {
+		path, err := saveCACert(id, n.CACert)
+		if err != nil {
+			return err
+		}
+		c["802-1x.ca-cert"] = path
+	}
+
+	if err := ModifyNetworkConfig(id, c); err != nil {
+		removeCACert(id)
+		return fmt.Errorf("failed to add network: %v", err)
+	}
+	return nil
+}
+
+// caCertPath is where the CA certificate for the connection is stored. The ID is hashed as it can have any characters.
+func caCertPath(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(caCertDir, "ca-"+hex.EncodeToString(sum[:8])+".pem")
+}
+
+// saveCACert saves the CA certificate so only root, and so NetworkManager, can read it.
+func saveCACert(id string, data []byte) (string, error) {
+	if err := os.MkdirAll(caCertDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to make certificate directory: %v", err)
+	}
+	if err := os.Chmod(caCertDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to make certificate directory: %v", err)
+	}
+	path := caCertPath(id)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return "", fmt.Errorf("failed to save CA certificate: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", fmt.Errorf("failed to save CA certificate: %v", err)
+	}
+	return path, nil
+}
+
+// removeCACert removes the CA certificate of the connection if it has one.
+func removeCACert(id string) {
+	if err := os.Remove(caCertPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Failed to remove CA certificate of '%s': %v", id, err)
+	}
+}
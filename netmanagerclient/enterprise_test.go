@@ -0,0 +1,105 @@
+package netmanagerclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testCACert(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestEnterpriseNetworkValidate(t *testing.T) {
+	valid := EnterpriseNetwork{
+		SSID:       "work",
+		Security:   SECURITY_WPA2_EAP,
+		EAPMethod:  EAP_PEAP,
+		Phase2Auth: "mschapv2",
+		Identity:   "user",
+		Password:   "password",
+		CACert:     testCACert(t),
+	}
+	assert.NoError(t, valid.Validate())
+
+	ttls := valid
+	ttls.EAPMethod = EAP_TTLS
+	ttls.Phase2Auth = "pap"
+	ttls.Security = SECURITY_WPA3_EAP
+	ttls.CACert = nil
+	assert.NoError(t, ttls.Validate())
+
+	tests := map[string]struct {
+		change func(n *EnterpriseNetwork)
+		err    error
+	}{
+		"psk security":    {func(n *EnterpriseNetwork) { n.Security = SECURITY_WPA2_PSK }, ErrUnknownSecurity},
+		"unknown method":  {func(n *EnterpriseNetwork) { n.EAPMethod = "tls" }, ErrUnknownEAPMethod},
+		"no identity":     {func(n *EnterpriseNetwork) { n.Identity = "" }, ErrIdentityRequired},
+		"no password":     {func(n *EnterpriseNetwork) { n.Password = "" }, ErrPasswordRequired},
+		"invalid cert":    {func(n *EnterpriseNetwork) { n.CACert = []byte("not a cert") }, ErrInvalidCACert},
+		"wrong phase 2":   {func(n *EnterpriseNetwork) { n.Phase2Auth = "pap" }, nil},
+		"missing phase 2": {func(n *EnterpriseNetwork) { n.Phase2Auth = "" }, nil},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			n := valid
+			test.change(&n)
+			err := n.Validate()
+			require.Error(t, err)
+			assert.IsType(t, InputError{}, err)
+			if test.err != nil {
+				assert.Equal(t, test.err, err)
+			}
+		})
+	}
+}
+
+func TestSaveCACert(t *testing.T) {
+	caCertDir = filepath.Join(t.TempDir(), "certs")
+	defer func() { caCertDir = CACertDir }()
+
+	cert := testCACert(t)
+	path, err := saveCACert("work", cert)
+	require.NoError(t, err)
+	assert.Equal(t, caCertPath("work"), path)
+	assert.NotEqual(t, caCertPath("work"), caCertPath("home"))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, cert, data)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(caCertDir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	removeCACert("work")
+	assert.NoFileExists(t, path)
+	// Removing a network without a certificate is fine.
+	removeCACert("home")
+}
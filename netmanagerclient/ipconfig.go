@@ -0,0 +1,215 @@
+package netmanagerclient
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IPMethod is how a saved network gets its IP addresses.
+type IPMethod string
+
+const (
+	IP_METHOD_AUTO     IPMethod = "auto"     // Addresses from DHCP, or from SLAAC or DHCPv6 for IPv6.
+	IP_METHOD_MANUAL   IPMethod = "manual"   // Static addresses.
+	IP_METHOD_DISABLED IPMethod = "disabled" // IPv4 or IPv6 isn't used on the network.
+)
+
+// IPConfig is the IPv4 or IPv6 settings of a saved network.
+type IPConfig struct {
+	Method    IPMethod `json:"method"`
+	Addresses []string `json:"addresses,omitempty"` // Static addresses with their prefix length, e.g. 192.168.1.10/24.
+	Gateway   string   `json:"gateway,omitempty"`
+	DNS       []string `json:"dns,omitempty"` // DNS servers, used instead of any from DHCP when set.
+}
+
+// NetworkIPConfig is the IP settings of a saved network.
+type NetworkIPConfig struct {
+	IPv4 IPConfig `json:"ipv4"`
+	IPv6 IPConfig `json:"ipv6"`
+}
+
+// DefaultIPConfig gets the addresses and DNS servers automatically.
+func DefaultIPConfig() NetworkIPConfig {
+	return NetworkIPConfig{
+		IPv4: IPConfig{Method: IP_METHOD_AUTO},
+		IPv6: IPConfig{Method: IP_METHOD_AUTO},
+	}
+}
+
+// Validate checks the settings can be used for a network.
+func (c NetworkIPConfig) Validate() error {
+	if err := c.IPv4.validate(false); err != nil {
+		return err
+	}
+	if err := c.IPv6.validate(true); err != nil {
+		return err
+	}
+	if c.IPv4.Method == IP_METHOD_DISABLED && c.IPv6.Method == IP_METHOD_DISABLED {
+		return InputError{Message: "IPv4 and IPv6 can't both be disabled"}
+	}
+	return nil
+}
+
+func (c IPConfig) validate(ipv6 bool) error {
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+	switch c.Method {
+	case IP_METHOD_AUTO, IP_METHOD_DISABLED:
+		if len(c.Addresses) > 0 || c.Gateway != "" {
+			return InputError{Message: fmt.Sprintf("%s addresses and gateway can only be set with the '%s' method", family, IP_METHOD_MANUAL)}
+		}
+		if c.Method == IP_METHOD_DISABLED && len(c.DNS) > 0 {
+			return InputError{Message: fmt.Sprintf("%s DNS servers can't be set when it is disabled", family)}
+		}
+	case IP_METHOD_MANUAL:
+		if len(c.Addresses) == 0 {
+			return InputError{Message: fmt.Sprintf("an %s address is needed with the '%s' method", family, IP_METHOD_MANUAL)}
+		}
+	default:
+		return InputError{Message: fmt.Sprintf("%s method must be '%s', '%s' or '%s', got '%s'", family, IP_METHOD_AUTO, IP_METHOD_MANUAL, IP_METHOD_DISABLED, c.Method)}
+	}
+
+	subnets := []*net.IPNet{}
+	for _, address := range c.Addresses {
+		ip, subnet, err := net.ParseCIDR(address)
+		if err != nil || isIPv6(ip) != ipv6 {
+			return InputError{Message: fmt.Sprintf("'%s' is not an %s address with a prefix length, e.g. %s", address, family, exampleAddress(ipv6))}
+		}
+		if ones, _ := subnet.Mask.Size(); ones == 0 {
+			return InputError{Message: fmt.Sprintf("'%s' needs a prefix length above 0", address)}
+		}
+		if ip.IsUnspecified() || ip.IsLoopback() || ip.IsMulticast() || (!ipv6 && ip.Equal(subnet.IP) && !isHostPrefix(subnet)) {
+			return InputError{Message: fmt.Sprintf("'%s' can't be used as an address", address)}
+		}
+		subnets = append(subnets, subnet)
+	}
+
+	if c.Gateway != "" {
+		gateway := net.ParseIP(c.Gateway)
+		if gateway == nil || isIPv6(gateway) != ipv6 {
+			return InputError{Message: fmt.Sprintf("gateway '%s' is not an %s address", c.Gateway, family)}
+		}
+		// An IPv6 gateway is usually a link-local address so isn't in the subnet of the addresses.
+		if !ipv6 && !containsIP(subnets, gateway) {
+			return InputError{Message: fmt.Sprintf("gateway '%s' is not in the subnet of any of the addresses", c.Gateway)}
+		}
+	}
+
+	for _, dns := range c.DNS {
+		ip := net.ParseIP(dns)
+		if ip == nil || isIPv6(ip) != ipv6 {
+			return InputError{Message: fmt.Sprintf("DNS server '%s' is not an %s address", dns, family)}
+		}
+	}
+	return nil
+}
+
+func isIPv6(ip net.IP) bool {
+	return ip.To4() == nil
+}
+
+// isHostPrefix is true for a /32 or /31, where the network address can be used by a host.
+func isHostPrefix(subnet *net.IPNet) bool {
+	ones, bits := subnet.Mask.Size()
+	return bits-ones <= 1
+}
+
+func containsIP(subnets []*net.IPNet, ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func exampleAddress(ipv6 bool) string {
+	if ipv6 {
+		return "2001:db8::10/64"
+	}
+	return "192.168.1.10/24"
+}
+
+// SetWifiNetworkIPConfig sets how a saved network gets its IP addresses and DNS servers.
+// The new settings are used the next time the network is connected to.
+func SetWifiNetworkIPConfig(id string, config NetworkIPConfig) error {
+	if err := checkIfBushnetNetwork(id); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	exists, err := CheckIfNetworkExists(id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return InputError{Message: fmt.Sprintf("no saved network '%s'", id)}
+	}
+	if err := ModifyNetworkConfig(id, ipConfigSettings(config)); err != nil {
+		return fmt.Errorf("failed to set IP config: %v", err)
+	}
+	return nil
+}
+
+// ipConfigSettings converts the IP config into nmcli properties. Properties that aren't used are cleared.
+func ipConfigSettings(config NetworkIPConfig) map[string]string {
+	c := map[string]string{}
+	for setting, ip := range map[string]IPConfig{"ipv4": config.IPv4, "ipv6": config.IPv6} {
+		c[setting+".method"] = string(ip.Method)
+		c[setting+".addresses"] = strings.Join(ip.Addresses, ",")
+		c[setting+".gateway"] = ip.Gateway
+		c[setting+".dns"] = strings.Join(ip.DNS, ",")
+		c[setting+".ignore-auto-dns"] = nmBool(len(ip.DNS) > 0)
+	}
+	return c
+}
+
+// ipConfigProperties are the properties of a connection that ipConfigFromProperties needs.
+var ipConfigProperties = []string{
+	"ipv4.method", "ipv4.addresses", "ipv4.gateway", "ipv4.dns",
+	"ipv6.method", "ipv6.addresses", "ipv6.gateway", "ipv6.dns",
+}
+
+// ipConfigFromProperties reads the IP config from the properties of a connection.
+func ipConfigFromProperties(props map[string]string) NetworkIPConfig {
+	read := func(setting string) IPConfig {
+		method := IPMethod(props[setting+".method"])
+		// NetworkManager uses 'ignore' for IPv6 not being used on older versions.
+		if method == "ignore" {
+			method = IP_METHOD_DISABLED
+		}
+		gateway := props[setting+".gateway"]
+		if gateway == "--" {
+			gateway = ""
+		}
+		return IPConfig{
+			Method:    method,
+			Addresses: splitList(props[setting+".addresses"]),
+			Gateway:   gateway,
+			DNS:       splitList(props[setting+".dns"]),
+		}
+	}
+	return NetworkIPConfig{IPv4: read("ipv4"), IPv6: read("ipv6")}
+}
+
+// splitList splits a nmcli list value, returning nil if it is empty.
+func splitList(value string) []string {
+	values := strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+// GetWifiNetworkIPConfig gets how a saved network gets its IP addresses and DNS servers.
+func GetWifiNetworkIPConfig(id string) (NetworkIPConfig, error) {
+	props, err := getConnectionProperties(id, ipConfigProperties)
+	if err != nil {
+		return NetworkIPConfig{}, fmt.Errorf("failed to get IP config of '%s': %v", id, err)
+	}
+	return ipConfigFromProperties(props), nil
+}
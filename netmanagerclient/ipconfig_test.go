@@ -0,0 +1,88 @@
+package netmanagerclient
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPConfigValidate(t *testing.T) {
+	manual4 := IPConfig{Method: IP_METHOD_MANUAL, Addresses: []string{"192.168.1.10/24"}, Gateway: "192.168.1.1", DNS: []string{"1.1.1.1"}}
+	manual6 := IPConfig{Method: IP_METHOD_MANUAL, Addresses: []string{"2001:db8::10/64"}, Gateway: "fe80::1", DNS: []string{"2606:4700:4700::1111"}}
+	auto := IPConfig{Method: IP_METHOD_AUTO}
+
+	valid := []NetworkIPConfig{
+		DefaultIPConfig(),
+		{IPv4: manual4, IPv6: auto},
+		{IPv4: auto, IPv6: manual6},
+		{IPv4: IPConfig{Method: IP_METHOD_DISABLED}, IPv6: manual6},
+		{IPv4: IPConfig{Method: IP_METHOD_AUTO, DNS: []string{"8.8.8.8"}}, IPv6: auto},
+		{IPv4: IPConfig{Method: IP_METHOD_MANUAL, Addresses: []string{"10.0.0.5/32"}}, IPv6: auto},
+	}
+	for _, config := range valid {
+		assert.NoError(t, config.Validate(), "%+v", config)
+	}
+
+	invalid := map[string]NetworkIPConfig{
+		"no method":                {IPv4: IPConfig{}, IPv6: auto},
+		"unknown method":           {IPv4: IPConfig{Method: "dhcp"}, IPv6: auto},
+		"both disabled":            {IPv4: IPConfig{Method: IP_METHOD_DISABLED}, IPv6: IPConfig{Method: IP_METHOD_DISABLED}},
+		"manual without address":   {IPv4: IPConfig{Method: IP_METHOD_MANUAL}, IPv6: auto},
+		"auto with address":        {IPv4: IPConfig{Method: IP_METHOD_AUTO, Addresses: []string{"192.168.1.10/24"}}, IPv6: auto},
+		"auto with gateway":        {IPv4: IPConfig{Method: IP_METHOD_AUTO, Gateway: "192.168.1.1"}, IPv6: auto},
+		"disabled with dns":        {IPv4: IPConfig{Method: IP_METHOD_DISABLED, DNS: []string{"1.1.1.1"}}, IPv6: auto},
+		"no prefix":                {IPv4: IPConfig{Method: IP_METHOD_MANUAL, Addresses: []string{"192.168.1.10"}}, IPv6: auto},
+		"zero prefix":              {IPv4: IPConfig{Method: IP_METHOD_MANUAL, Addresses: []string{"192.168.1.10/0"}}, IPv6: auto},
+		"network address":          {IPv4: IPConfig{Method: IP_METHOD_MANUAL, Addresses: []string{"192.168.1.0/24"}}, IPv6: auto},
+		"loopback":                 {IPv4: IPConfig{Method: IP_METHOD_MANUAL, Addresses: []string{"127.0.0.1/8"}}, IPv6: auto},
+		"ipv6 address for ipv4":    {IPv4: IPConfig{Method: IP_METHOD_MANUAL, Addresses: []string{"2001:db8::10/64"}}, IPv6: auto},
+		"ipv4 address for ipv6":    {IPv4: auto, IPv6: IPConfig{Method: IP_METHOD_MANUAL, Addresses: []string{"192.168.1.10/24"}}},
+		"gateway outside subnet":   {IPv4: IPConfig{Method: IP_METHOD_MANUAL, Addresses: []string{"192.168.1.10/24"}, Gateway: "192.168.2.1"}, IPv6: auto},
+		"invalid gateway":          {IPv4: IPConfig{Method: IP_METHOD_MANUAL, Addresses: []string{"192.168.1.10/24"}, Gateway: "router"}, IPv6: auto},
+		"ipv4 gateway for ipv6":    {IPv4: auto, IPv6: IPConfig{Method: IP_METHOD_MANUAL, Addresses: []string{"2001:db8::10/64"}, Gateway: "192.168.1.1"}},
+		"invalid dns":              {IPv4: IPConfig{Method: IP_METHOD_AUTO, DNS: []string{"dns.example.com"}}, IPv6: auto},
+		"ipv6 dns for ipv4":        {IPv4: IPConfig{Method: IP_METHOD_AUTO, DNS: []string{"2606:4700:4700::1111"}}, IPv6: auto},
+		"ipv6 multicast":           {IPv4: auto, IPv6: IPConfig{Method: IP_METHOD_MANUAL, Addresses: []string{"ff02::1/64"}}},
+		"ipv4 address is not cidr": {IPv4: IPConfig{Method: IP_METHOD_MANUAL, Addresses: []string{"192.168.1.300/24"}}, IPv6: auto},
+	}
+	for name, config := range invalid {
+		err := config.Validate()
+		assert.Error(t, err, name)
+		assert.IsType(t, InputError{}, err, name)
+	}
+}
+
+func TestIPConfigSettings(t *testing.T) {
+	config := NetworkIPConfig{
+		IPv4: IPConfig{Method: IP_METHOD_MANUAL, Addresses: []string{"192.168.1.10/24", "10.0.0.5/8"}, Gateway: "192.168.1.1", DNS: []string{"1.1.1.1", "8.8.8.8"}},
+		IPv6: IPConfig{Method: IP_METHOD_AUTO},
+	}
+	settings := ipConfigSettings(config)
+	assert.Equal(t, map[string]string{
+		"ipv4.method":          "manual",
+		"ipv4.addresses":       "192.168.1.10/24,10.0.0.5/8",
+		"ipv4.gateway":         "192.168.1.1",
+		"ipv4.dns":             "1.1.1.1,8.8.8.8",
+		"ipv4.ignore-auto-dns": "yes",
+		"ipv6.method":          "auto",
+		"ipv6.addresses":       "",
+		"ipv6.gateway":         "",
+		"ipv6.dns":             "",
+		"ipv6.ignore-auto-dns": "no",
+	}, settings)
+
+	// Reading back what nmcli shows for those settings.
+	props := map[string]string{
+		"ipv4.method":    "manual",
+		"ipv4.addresses": "192.168.1.10/24, 10.0.0.5/8",
+		"ipv4.gateway":   "192.168.1.1",
+		"ipv4.dns":       "1.1.1.1,8.8.8.8",
+		"ipv6.method":    "auto",
+		"ipv6.addresses": "",
+		"ipv6.gateway":   "--",
+		"ipv6.dns":       "",
+	}
+	assert.Equal(t, config, ipConfigFromProperties(props))
+	props["ipv6.method"] = "ignore"
+	assert.Equal(t, IP_METHOD_DISABLED, ipConfigFromProperties(props).IPv6.Method)
+}
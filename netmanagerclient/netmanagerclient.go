@@ -1,14 +1,18 @@
 package netmanagerclient
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os/exec"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/TheCacophonyProject/go-utils/logging"
+	"github.com/TheCacophonyProject/rpi-net-manager/nmcli"
 	"github.com/godbus/dbus/v5"
 )
 
@@ -53,6 +57,74 @@ func stringToNetworkState(s string) (NetworkState, error) {
 	}
 }
 
+// StateTrigger is what caused a state transition.
+type StateTrigger string
+
+const (
+	TRIGGER_STARTUP   StateTrigger = "startup"   // The state was detected when the service started.
+	TRIGGER_TIMER     StateTrigger = "timer"     // A timer in the service, such as the hotspot timing out.
+	TRIGGER_NM_SIGNAL StateTrigger = "nm-signal" // A change reported by NetworkManager.
+	TRIGGER_DBUS_CALL StateTrigger = "dbus-call" // A D-Bus call to the service.
+)
+
+// StateTransition is a change of state recorded by the service.
+type StateTransition struct {
+	Time           time.Time    `json:"time"`
+	OldState       NetworkState `json:"oldState"`
+	NewState       NetworkState `json:"newState"`
+	ConnectionName string       `json:"connectionName"`
+	BSSID          string       `json:"bssid"`
+	Trigger        StateTrigger `json:"trigger"`
+	// Detail is which timer or D-Bus method triggered the transition.
+	Detail string `json:"detail"`
+}
+
+// ConnectionFailureReason is why NetworkManager failed to activate a connection.
+type ConnectionFailureReason string
+
+const (
+	FAILURE_BAD_SECRETS        ConnectionFailureReason = "bad-secrets"        // The password or other secrets are wrong.
+	FAILURE_NO_AP              ConnectionFailureReason = "no-ap"              // No access point with the SSID was found.
+	FAILURE_DHCP_TIMEOUT       ConnectionFailureReason = "dhcp-timeout"       // Associated with the access point but didn't get an IP address.
+	FAILURE_SUPPLICANT_TIMEOUT ConnectionFailureReason = "supplicant-timeout" // Authenticating with the access point timed out.
+	FAILURE_OTHER              ConnectionFailureReason = "other"
+)
+
+// NetworkFailure is the failed attempts to connect to a saved network since it last connected.
+type NetworkFailure struct {
+	Count       int                     `json:"count"`
+	LastFailure time.Time               `json:"lastFailure"`
+	Reason      ConnectionFailureReason `json:"reason"`
+}
+
+// NetworkStats is the connection statistics the service has kept for a saved network.
+type NetworkStats struct {
+	Attempts          int                     `json:"attempts"`
+	Successes         int                     `json:"successes"`
+	LastFailure       time.Time               `json:"lastFailure"`
+	LastFailureReason ConnectionFailureReason `json:"lastFailureReason"`
+	LastSignal        int                     `json:"lastSignal"` // Signal strength in percent, 0 if it hasn't been seen.
+	LastSignalTime    time.Time               `json:"lastSignalTime"`
+	ConnectedTime     time.Duration           `json:"connectedTime"`
+}
+
+// OperationErrors is the errors from one of the operations run by the service.
+type OperationErrors struct {
+	Count     int       `json:"count"`
+	LastError string    `json:"lastError"`
+	LastTime  time.Time `json:"lastTime"`
+}
+
+// ServiceErrors is the errors the service has had since it started.
+type ServiceErrors struct {
+	LastError         string    `json:"lastError"`
+	LastErrorTime     time.Time `json:"lastErrorTime"`
+	ConsecutiveErrors int       `json:"consecutiveErrors"`
+	// RetryAt is when the service will next try to recover, zero if the service isn't in the error state.
+	RetryAt    time.Time                  `json:"retryAt"`
+	Operations map[string]OperationErrors `json:"operations"`
+}
+
 const (
 	DbusInterface = "org.cacophony.RPiNetManager"
 	DbusPath      = "/org/cacophony/RPiNetManager"
@@ -92,6 +164,180 @@ func CheckState() error {
 	return err
 }
 
+// Policy is the timing and fallback policy used by the state machine.
+// A duration of 0 means that timeout is disabled.
+type Policy struct {
+	ScanConnectTimeout     time.Duration `json:"scanConnectTimeout"`
+	HotspotFallback        bool          `json:"hotspotFallback"`
+	HotspotFallbackDelay   time.Duration `json:"hotspotFallbackDelay"`
+	HotspotTimeout         time.Duration `json:"hotspotTimeout"`
+	HumanInteractionCutoff time.Duration `json:"humanInteractionCutoff"`
+	OnShutdown             string        `json:"onShutdown"`
+}
+
+// GetPolicy will get the timing and fallback policy the service is using.
+func GetPolicy() (Policy, error) {
+	policy := Policy{}
+	data, err := eventsDbusCall("GetPolicy")
+	if err != nil {
+		return policy, err
+	}
+	if len(data) != 1 {
+		return policy, errors.New("error getting policy")
+	}
+	policyStr, ok := data[0].(string)
+	if !ok {
+		return policy, errors.New("error reading policy")
+	}
+	if err := json.Unmarshal([]byte(policyStr), &policy); err != nil {
+		return policy, fmt.Errorf("failed to parse policy: %v", err)
+	}
+	return policy, nil
+}
+
+// GetBushnetNetworks will get the IDs of the saved networks the service manages, the bushnet networks from
+// its config and its hotspot. These can't be changed by the user.
+func GetBushnetNetworks() ([]string, error) {
+	data, err := eventsDbusCall("GetBushnetNetworks")
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 1 {
+		return nil, errors.New("error getting bushnet networks")
+	}
+	ids, ok := data[0].([]string)
+	if !ok {
+		return nil, errors.New("error reading bushnet networks")
+	}
+	return ids, nil
+}
+
+// GetStateHistory will get the recent state transitions of the service, oldest first.
+func GetStateHistory() ([]StateTransition, error) {
+	data, err := eventsDbusCall("GetStateHistory")
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 1 {
+		return nil, errors.New("error getting state history")
+	}
+	historyStr, ok := data[0].(string)
+	if !ok {
+		return nil, errors.New("error reading state history")
+	}
+	history := []StateTransition{}
+	if err := json.Unmarshal([]byte(historyStr), &history); err != nil {
+		return nil, fmt.Errorf("failed to parse state history: %v", err)
+	}
+	return history, nil
+}
+
+// GetNetworkFailures will get the failed connection attempts of each saved network, by connection ID.
+// Networks that have connected since they last failed are not included.
+func GetNetworkFailures() (map[string]NetworkFailure, error) {
+	data, err := eventsDbusCall("GetNetworkFailures")
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 1 {
+		return nil, errors.New("error getting network failures")
+	}
+	failuresStr, ok := data[0].(string)
+	if !ok {
+		return nil, errors.New("error reading network failures")
+	}
+	failures := map[string]NetworkFailure{}
+	if err := json.Unmarshal([]byte(failuresStr), &failures); err != nil {
+		return nil, fmt.Errorf("failed to parse network failures: %v", err)
+	}
+	return failures, nil
+}
+
+// GetNetworkStats will get the connection statistics of each saved network, by connection ID.
+func GetNetworkStats() (map[string]NetworkStats, error) {
+	data, err := eventsDbusCall("GetNetworkStats")
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 1 {
+		return nil, errors.New("error getting network stats")
+	}
+	statsStr, ok := data[0].(string)
+	if !ok {
+		return nil, errors.New("error reading network stats")
+	}
+	stats := map[string]NetworkStats{}
+	if err := json.Unmarshal([]byte(statsStr), &stats); err != nil {
+		return nil, fmt.Errorf("failed to parse network stats: %v", err)
+	}
+	return stats, nil
+}
+
+// GetErrors will get the errors the service has had, and when it will next try to recover if it is in the error state.
+func GetErrors() (ServiceErrors, error) {
+	errs := ServiceErrors{}
+	data, err := eventsDbusCall("GetErrors")
+	if err != nil {
+		return errs, err
+	}
+	if len(data) != 1 {
+		return errs, errors.New("error getting service errors")
+	}
+	errsStr, ok := data[0].(string)
+	if !ok {
+		return errs, errors.New("error reading service errors")
+	}
+	if err := json.Unmarshal([]byte(errsStr), &errs); err != nil {
+		return errs, fmt.Errorf("failed to parse service errors: %v", err)
+	}
+	return errs, nil
+}
+
+// Saved wifi networks are connected to in order of their priority, highest first.
+// The bushnet networks have a priority of BushnetPriority, and user networks are kept below it so the bushnet
+// networks are always preferred.
+const (
+	MinWifiNetworkPriority = -999
+	MaxWifiNetworkPriority = BushnetPriority - 1
+	BushnetPriority        = 10
+)
+
+// CheckWifiNetworkPriority checks that the priority is one a user network can have, from what NetworkManager
+// accepts up to below the bushnet networks.
+func CheckWifiNetworkPriority(priority int) error {
+	if priority < MinWifiNetworkPriority || priority > MaxWifiNetworkPriority {
+		return ErrInvalidPriority
+	}
+	return nil
+}
+
+// SetWifiNetworkPriority will set the priority of a saved network, networks with a higher priority are connected to first.
+// The priority can be at most MaxWifiNetworkPriority, so the bushnet networks are still preferred.
+func SetWifiNetworkPriority(id string, priority int) error {
+	if err := CheckWifiNetworkPriority(priority); err != nil {
+		return err
+	}
+	if err := checkIfBushnetNetwork(id); err != nil {
+		return err
+	}
+	_, err := eventsDbusCall("SetWifiNetworkPriority", id, int32(priority))
+	return err
+}
+
+// ReorderWifiNetworks will set the priorities of the saved networks so they are connected to in the given order.
+// All the saved networks, apart from the bushnet networks, need to be given. The bushnet networks are still preferred.
+func ReorderWifiNetworks(ids []string) error {
+	_, err := eventsDbusCall("ReorderWifiNetworks", ids)
+	return err
+}
+
+// ReloadConfig will make the service read its config file again.
+// An error is returned if the new config is invalid, in which case the service keeps using the old config.
+func ReloadConfig() error {
+	_, err := eventsDbusCall("ReloadConfig")
+	return err
+}
+
 func CheckIfDBusAvailable() bool {
 	conn, err := dbus.SystemBus()
 	if err != nil {
@@ -149,6 +395,10 @@ func GetStateChanges() (chan NetworkState, chan<- struct{}, error) {
 		for {
 			select {
 			case v := <-c:
+				// Other signals from the service, such as ScanResultsUpdated, aren't state changes.
+				if v.Name != DbusInterface+".NewNetworkState" {
+					continue
+				}
 				if len(v.Body) > 0 {
 					str, ok := v.Body[0].(string)
 					if !ok {
@@ -173,44 +423,37 @@ func GetStateChanges() (chan NetworkState, chan<- struct{}, error) {
 }
 
 type WiFiNetwork struct {
-	SSID               string
+	SSID               string // The display form of the SSID.
+	RawSSID            SSID
 	Quality            string
+	Security           WifiSecurity // The security of the network, or of the strongest access point for scan results.
 	ID                 string
 	InUse              bool
+	Hidden             bool // If the network doesn't broadcast its SSID. Only set for saved networks.
 	AuthFailed         bool
+	Priority           int
+	FailureReason      ConnectionFailureReason // Why the last attempt to connect failed, if it did.
 	LastConnectionTime time.Time
+	Stats              NetworkStats    // Empty if the service isn't running.
+	IP                 NetworkIPConfig // Only set for saved networks.
 }
 
+// ScanWiFiNetworks lists each access point found by scanning, ScanWifiNetworkGroups groups them by network.
 func ScanWiFiNetworks() ([]WiFiNetwork, error) {
-	// TODO do we need to add '--escape no' to the nmcli command?
-	out, err := exec.Command("nmcli", "--terse", "--fields", "IN-USE,SIGNAL,SSID", "device", "wifi", "list", "--rescan", "yes").CombinedOutput()
+	aps, err := ScanAccessPoints()
 	if err != nil {
-		return nil, fmt.Errorf("failed to list wifi networks: %v, output: %s", err, out)
+		return nil, err
 	}
-
-	lines := strings.Split(string(out), "\n")
-
 	var networks []WiFiNetwork
-	for _, line := range lines {
-		if line == "" {
-			continue
-		}
-		parts := strings.Split(line, ":")
-
-		if len(parts) >= 3 {
-			// The SSID may contain ':' so join all parts beyond the second with ':'
-			ssid := strings.Join(parts[2:], ":")
-
-			networks = append(networks, WiFiNetwork{
-				SSID:    ssid,
-				Quality: parts[1],
-				InUse:   parts[0] == "*",
-			})
-		} else {
-			return nil, fmt.Errorf("failed to parse line: %s", line)
-		}
+	for _, ap := range aps {
+		networks = append(networks, WiFiNetwork{
+			SSID:     ap.SSID,
+			RawSSID:  ap.RawSSID,
+			Quality:  strconv.Itoa(ap.Signal),
+			Security: ap.Security,
+			InUse:    ap.InUse,
+		})
 	}
-
 	return networks, nil
 }
 
@@ -219,16 +462,18 @@ func ListUserSavedWifiNetworks() ([]WiFiNetwork, error) {
 	if err != nil {
 		return nil, err
 	}
+	bushnet := bushnetNetworks()
 	userNetworks := []WiFiNetwork{}
 	for _, network := range networks {
-		if checkIfBushnetNetwork(network.SSID) == nil {
+		if bushnet.check(network.ID) == nil {
 			userNetworks = append(userNetworks, network)
 		}
 	}
 	return userNetworks, nil
 }
 
-// FindNetworkBySSID searches for a network by SSID in the list of WiFi networks
+// FindNetworkBySSID searches for a network by SSID in the list of WiFi networks, the SSID can be the bytes
+// of the SSID or its display form.
 func FindNetworkBySSID(ssid string) (WiFiNetwork, bool) {
 	networks, err := ListUserSavedWifiNetworks()
 	if err != nil {
@@ -236,75 +481,158 @@ func FindNetworkBySSID(ssid string) (WiFiNetwork, bool) {
 		return WiFiNetwork{}, false
 	}
 	for _, network := range networks {
-		if network.SSID == ssid {
+		if network.SSID == ssid || string(network.RawSSID) == ssid {
 			return network, true
 		}
 	}
 	return WiFiNetwork{}, false
 }
+
+// FindSavedNetworksBySSID finds the saved networks with exactly the bytes of the SSID.
+func FindSavedNetworksBySSID(ssid SSID) ([]WiFiNetwork, error) {
+	networks, err := ListSavedWifiNetworks()
+	if err != nil {
+		return nil, err
+	}
+	found := []WiFiNetwork{}
+	for _, network := range networks {
+		if network.RawSSID.Equal(ssid) {
+			found = append(found, network)
+		}
+	}
+	return found, nil
+}
+
+// ListSavedWifiNetworks lists the saved networks, with their connection statistics and why they failed to connect
+// from the service if it is running.
 func ListSavedWifiNetworks() ([]WiFiNetwork, error) {
-	out, err := exec.Command("nmcli", "--terse", "--escape", "no", "--fields", "TYPE,NAME", "connection", "show").CombinedOutput()
+	networks, err := savedWifiNetworks()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := GetNetworkStats()
+	if err != nil {
+		log.Debugf("Failed to get network stats from the service: %v", err)
+	}
+	for i := range networks {
+		networks[i].Stats = stats[networks[i].ID]
+	}
+	// The service knows why connections failed. If it isn't running fall back to auth-retries.
+	failures, err := GetNetworkFailures()
+	if err != nil {
+		log.Debugf("Failed to get network failures from the service: %v", err)
+		return networks, nil
+	}
+	for i := range networks {
+		networks[i].FailureReason = failures[networks[i].ID].Reason
+		networks[i].AuthFailed = networks[i].FailureReason == FAILURE_BAD_SECRETS
+	}
+	return networks, nil
+}
+
+// savedWifiIDs lists the IDs of the saved wifi networks.
+func savedWifiIDs() ([]string, error) {
+	out, err := exec.Command("nmcli", "--terse", "--fields", "NAME,TYPE", "connection", "show").CombinedOutput()
 	if err != nil {
 		return nil, fmt.Errorf("failed to list saved networks: %v, output: %s", err, out)
 	}
+	rows, err := nmcli.ParseRows(string(out), 2)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse saved networks: %v", err)
+	}
+	ids := []string{}
+	for _, row := range rows {
+		if row[1] == "802-11-wireless" {
+			ids = append(ids, row[0])
+		}
+	}
+	return ids, nil
+}
 
-	lines := strings.Split(string(out), "\n")
+// savedWifiNetworks lists the saved networks from NetworkManager. It doesn't call the service, so it can be
+// used from code the service runs, such as importing the networks it finds when provisioning.
+func savedWifiNetworks() ([]WiFiNetwork, error) {
+	ids, err := savedWifiIDs()
+	if err != nil {
+		return nil, err
+	}
+	// Read the SSIDs from NetworkManager so SSIDs that aren't UTF-8 are kept, nmcli is only used if that fails.
+	ssids, err := savedWifiSSIDs()
+	if err != nil {
+		log.Debugf("Failed to get SSIDs from NetworkManager: %v", err)
+	}
 
 	var networks []WiFiNetwork
-	for _, line := range lines {
-		if line == "" {
-			continue
+	for _, connName := range ids {
+		props := []string{"connection.auth-retries", "connection.autoconnect-priority", "connection.timestamp", "802-11-wireless.ssid", "802-11-wireless.hidden", "802-11-wireless-security.key-mgmt", "802-11-wireless-security.pmf"}
+		propMap, err := getConnectionProperties(connName, append(props, ipConfigProperties...))
+		if err != nil {
+			return nil, err
 		}
-		parts := strings.Split(line, ":")
-
-		if len(parts) >= 2 {
-			connType := parts[0]
-			// The SSID may contain ':' so join all parts beyond the first with ':'
-			connName := strings.Join(parts[1:], ":")
-			if connType == "802-11-wireless" {
-				propMap, err := getConnectionProperties(connName, []string{"connection.auth-retries", "connection.timestamp", "802-11-wireless.ssid"})
-				if err != nil {
-					return nil, err
-				}
 
-				sec, err := strconv.ParseInt(propMap["connection.timestamp"], 10, 64)
-				if err != nil {
-					log.Printf("Failed to part time '%s'", err)
-					return nil, err
-				}
-				// if auth-retries is 1, last time the connection failed.
-				authFailed := propMap["connection.auth-retries"] == "1"
-
-				networks = append(networks, WiFiNetwork{
-					ID:                 connName,
-					SSID:               propMap["802-11-wireless.ssid"],
-					AuthFailed:         authFailed,
-					LastConnectionTime: time.Unix(sec, 0),
-				})
-			}
-
-		} else {
-			return nil, fmt.Errorf("failed to parse line: %s", line)
+		sec, err := strconv.ParseInt(propMap["connection.timestamp"], 10, 64)
+		if err != nil {
+			log.Printf("Failed to part time '%s'", err)
+			return nil, err
 		}
-	}
-
+		priority, err := strconv.Atoi(propMap["connection.autoconnect-priority"])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse priority of '%s': %v", connName, err)
+		}
+		rawSSID, ok := ssids[connName]
+		if !ok {
+			rawSSID = SSID(propMap["802-11-wireless.ssid"])
+		}
+		// if auth-retries is 1, last time the connection failed with the wrong password.
+		authFailed := propMap["connection.auth-retries"] == "1"
+
+		networks = append(networks, WiFiNetwork{
+			ID:                 connName,
+			SSID:               rawSSID.String(),
+			RawSSID:            rawSSID,
+			AuthFailed:         authFailed,
+			Priority:           priority,
+			Hidden:             propMap["802-11-wireless.hidden"] == "yes",
+			Security:           securityFromSettings(propMap["802-11-wireless-security.key-mgmt"], propMap["802-11-wireless-security.pmf"]),
+			LastConnectionTime: time.Unix(sec, 0),
+			IP:                 ipConfigFromProperties(propMap),
+		})
+	}
+
+	// List the networks in the order they will be connected to.
+	sort.SliceStable(networks, func(i, j int) bool {
+		return networks[i].Priority > networks[j].Priority
+	})
 	return networks, nil
 }
 
 func getConnectionProperties(connection string, properties []string) (map[string]string, error) {
-	out, err := exec.Command("nmcli", "-f", strings.Join(properties, ","), "-t", "connection", "show", connection).CombinedOutput()
+	return connectionProperties(connection, properties, false)
+}
+
+// getConnectionSecrets is the same as getConnectionProperties but includes secrets, such as the PSK.
+// Only root can read the secrets.
+func getConnectionSecrets(connection string, properties []string) (map[string]string, error) {
+	return connectionProperties(connection, properties, true)
+}
+
+func connectionProperties(connection string, properties []string, secrets bool) (map[string]string, error) {
+	args := []string{"-f", strings.Join(properties, ","), "-t"}
+	if secrets {
+		args = append(args, "--show-secrets")
+	}
+	args = append(args, "connection", "show", connection)
+	out, err := exec.Command("nmcli", args...).CombinedOutput()
+	if err != nil {
+		return nil, err
+	}
+	fields, err := nmcli.ParseMultiline(string(out))
 	if err != nil {
 		return nil, err
 	}
 	propMap := map[string]string{}
-	for _, line := range strings.Split(string(out), "\n") {
-		if line == "" {
-			continue
-		}
-		parts := strings.Split(line, ":")
-		if len(parts) >= 2 {
-			propMap[parts[0]] = strings.Join(parts[1:], ":")
-		}
+	for _, field := range fields {
+		propMap[field.Name] = field.Value
 	}
 	return propMap, nil
 }
@@ -321,27 +649,54 @@ var (
 	ErrNetworkAlreadyExists = InputError{Message: "a network with the given SSID already exists"}
 	ErrPSKTooShort          = InputError{Message: "the given PSK is too short, must be at least 8 characters long"}
 	ErrBushnetNetwork       = InputError{Message: "the given SSID is a Bushnet network so can't be modified"}
+	ErrInvalidPriority      = InputError{Message: fmt.Sprintf("priority must be between %d and %d", MinWifiNetworkPriority, MaxWifiNetworkPriority)}
 )
 
-func checkIfBushnetNetwork(ssid string) error {
-	ssid = strings.ToLower(ssid)
-	if ssid == "bushnet" || ssid == "bushnethotspot" {
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// defaultBushnetNetworks are the networks the service manages when it is using the default config.
+var defaultBushnetNetworks = bushnetIDs{"bushnet", "BushnetHotspot"}
+
+// bushnetIDs are the IDs of the saved networks the service manages.
+type bushnetIDs []string
+
+// check returns ErrBushnetNetwork if the ID is one of the bushnet networks. IDs are matched ignoring case
+// so a network can't get around the check by being saved as "BUSHNET".
+func (b bushnetIDs) check(id string) error {
+	if slices.ContainsFunc(b, func(bushnetID string) bool { return strings.EqualFold(bushnetID, id) }) {
 		return ErrBushnetNetwork
 	}
 	return nil
 }
 
+// bushnetNetworks gets the bushnet networks from the service, so they match its config.
+// The defaults are used if the service isn't running.
+func bushnetNetworks() bushnetIDs {
+	ids, err := GetBushnetNetworks()
+	if err != nil {
+		log.Debugf("Failed to get bushnet networks from the service: %v", err)
+		return defaultBushnetNetworks
+	}
+	return ids
+}
+
+func checkIfBushnetNetwork(ssid string) error {
+	return bushnetNetworks().check(ssid)
+}
+
 func CheckIfNetworkExists(id string) (bool, error) {
-	networks, err := ListSavedWifiNetworks()
+	ids, err := savedWifiIDs()
 	if err != nil {
 		return false, err
 	}
-	for _, network := range networks {
-		if network.ID == id {
-			return true, nil
-		}
-	}
-	return false, nil
+	return slices.Contains(ids, id), nil
 }
 
 // Connects to an existing network
@@ -349,22 +704,30 @@ func ConnectWifiNetwork(ssid string) error {
 	if err := checkIfBushnetNetwork(ssid); err != nil {
 		return err
 	}
-	out, err := exec.Command("nmcli", "connection", "up", ssid).CombinedOutput()
+	out, err := exec.Command("nmcli", "connection", "up", connectionID(ssid)).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("failed to connect to network: %v, output: %s", err, out)
 	}
 	return nil
 }
 
+// ModifyWifiNetwork changes the PSK of a saved network. The PSK is checked against the security the network
+// was saved with, so open and enterprise networks can't be given one.
 func ModifyWifiNetwork(ssid, psk string) error {
-	if len(psk) < 8 {
-		return ErrPSKTooShort
-	}
 	if err := checkIfBushnetNetwork(ssid); err != nil {
 		return err
 	}
+	id := connectionID(ssid)
+	propMap, err := getConnectionProperties(id, []string{"802-11-wireless-security.key-mgmt", "802-11-wireless-security.pmf"})
+	if err != nil {
+		return fmt.Errorf("failed to get network '%s': %v", id, err)
+	}
+	security := securityFromSettings(propMap["802-11-wireless-security.key-mgmt"], propMap["802-11-wireless-security.pmf"])
+	if err := checkModifyPSK(security, psk); err != nil {
+		return err
+	}
 	out, err := exec.Command(
-		"nmcli", "connection", "modify", ssid,
+		"nmcli", "connection", "modify", id,
 		"wifi-sec.psk", psk).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("failed to modify network: %v, output: %s", err, out)
@@ -372,50 +735,105 @@ func ModifyWifiNetwork(ssid, psk string) error {
 	return nil
 }
 
+// AddWifiNetwork adds a WPA2 network.
 func AddWifiNetwork(ssid, psk string) error {
-	alreadyExists, err := CheckIfNetworkExists(ssid)
+	return AddWifiNetworkWithSecurity(ssid, psk, SECURITY_WPA2_PSK)
+}
+
+// SetWifiNetworkHidden sets if a saved network is hidden. Hidden networks don't broadcast their SSID so
+// are probed for by the service while it is scanning.
+func SetWifiNetworkHidden(id string, hidden bool) error {
+	if err := checkIfBushnetNetwork(id); err != nil {
+		return err
+	}
+	if err := ModifyNetworkConfig(id, map[string]string{"802-11-wireless.hidden": nmBool(hidden)}); err != nil {
+		return fmt.Errorf("failed to modify network: %v", err)
+	}
+	return nil
+}
+
+func nmBool(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// AddWifiNetworkWithSecurity adds a network with the given security type. The PSK has to be empty for open networks.
+// The network is saved with the display form of the SSID as its ID.
+func AddWifiNetworkWithSecurity(ssid, psk string, security WifiSecurity) error {
+	return addWifiNetwork(connectionID(ssid), ssid, psk, security, nil, bushnetNetworks())
+}
+
+// AddHiddenWifiNetwork adds a network that doesn't broadcast its SSID.
+func AddHiddenWifiNetwork(ssid, psk string, security WifiSecurity) error {
+	return addWifiNetwork(connectionID(ssid), ssid, psk, security, map[string]string{"802-11-wireless.hidden": nmBool(true)}, bushnetNetworks())
+}
+
+// addWifiNetwork adds a network with the given connection ID. Any extra properties, such as the
+// priority or IP config, are set when the network is added.
+func addWifiNetwork(id, ssid, psk string, security WifiSecurity, extra map[string]string, bushnet bushnetIDs) error {
+	alreadyExists, err := CheckIfNetworkExists(id)
 	if err != nil {
 		return err
 	}
 	if alreadyExists {
 		return ErrNetworkAlreadyExists
 	}
-	if len(psk) < 8 {
-		return ErrPSKTooShort
+	if err := checkSSID(ssid); err != nil {
+		return err
 	}
-	if err := checkIfBushnetNetwork(ssid); err != nil {
+	if err := CheckWifiSecurity(security, psk); err != nil {
+		return err
+	}
+	if err := bushnet.check(ssid); err != nil {
+		return err
+	}
+	if err := bushnet.check(id); err != nil {
 		return err
 	}
 
-	c := map[string]string{
-		"connection.type":         "802-11-wireless",
-		"connection.auth-retries": "2",
-		"wifi-sec.key-mgmt":       "wpa-psk",
-		"connection.id":           ssid,
-		"ipv4.route-metric":       "10", // To make wifi preferable over the USB (modem) connection
-		"ipv6.route-metric":       "10",
-		"wifi.ssid":               ssid,
-		"wifi-sec.psk":            psk,
+	c := newWifiConnectionConfig(id, ssid)
+	for k, v := range securityConfig(security, psk) {
+		c[k] = v
+	}
+	for k, v := range extra {
+		c[k] = v
 	}
 	//"connection.autoconnect-retries", "2", //TODO look into this option more.
 
-	if err := ModifyNetworkConfig(ssid, c); err != nil {
+	if err := ModifyNetworkConfig(id, c); err != nil {
 		return fmt.Errorf("failed to add network: %v", err)
 	}
 	return nil
 }
 
+// newWifiConnectionConfig is the config every new wifi network is added with.
+func newWifiConnectionConfig(id, ssid string) map[string]string {
+	return map[string]string{
+		"connection.type":         "802-11-wireless",
+		"connection.auth-retries": "2",
+		"connection.id":           id,
+		"ipv4.route-metric":       "10", // To make wifi preferable over the USB (modem) connection
+		"ipv6.route-metric":       "10",
+		"wifi.ssid":               ssid,
+		"802-11-wireless.hidden":  nmBool(false),
+	}
+}
+
+// RemoveWifiNetwork removes a saved network by its ID. The SSID of a network that was added with its SSID
+// as the ID can also be given.
 func RemoveWifiNetwork(ssid string, disconnect bool, startHotspot bool) error {
 	if err := checkIfBushnetNetwork(ssid); err != nil {
 		return err
 	}
-	out, err := exec.Command("nmcli", "connection", "delete", ssid).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to remove network: %v, output: %s", err, out)
+	id := connectionID(ssid)
+	if err := removeWifiNetwork(id); err != nil {
+		return err
 	}
 
 	if disconnect {
-		out, err = exec.Command("nmcli", "connection", "down", ssid).CombinedOutput()
+		out, err := exec.Command("nmcli", "connection", "down", id).CombinedOutput()
 		if err != nil {
 			return fmt.Errorf("failed to disconnect network: %v, output: %s", err, out)
 		}
@@ -427,11 +845,21 @@ func RemoveWifiNetwork(ssid string, disconnect bool, startHotspot bool) error {
 	return nil
 }
 
+// removeWifiNetwork removes the saved network and its CA certificate, without checking if it is a bushnet network.
+func removeWifiNetwork(id string) error {
+	out, err := exec.Command("nmcli", "connection", "delete", id).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to remove network: %v, output: %s", err, out)
+	}
+	removeCACert(id)
+	return nil
+}
+
 func DisconnectWifiNetwork(ssid string, startHotspot bool) error {
 	if err := checkIfBushnetNetwork(ssid); err != nil {
 		return err
 	}
-	out, err := exec.Command("nmcli", "connection", "down", ssid).CombinedOutput()
+	out, err := exec.Command("nmcli", "connection", "down", connectionID(ssid)).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("failed to forget network: %v, output: %s", err, out)
 	}
@@ -449,11 +877,14 @@ func ModifyNetworkConfig(id string, c map[string]string) error {
 		return err
 	}
 	if exists {
-		for k, v := range c {
-			out, err := exec.Command("nmcli", "connection", "modify", id, k, v).CombinedOutput()
-			if err != nil {
-				return fmt.Errorf("failed to modify network: %v, output: %s", err, out)
-			}
+		// Modify all the properties at once as some depend on each other, such as ipv4.method and ipv4.addresses.
+		args := []string{"connection", "modify", id}
+		for _, k := range sortedKeys(c) {
+			args = append(args, k, c[k])
+		}
+		out, err := exec.Command("nmcli", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to modify network: %v, output: %s", err, out)
 		}
 		return nil
 	}
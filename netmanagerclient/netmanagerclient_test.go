@@ -0,0 +1,29 @@
+package netmanagerclient
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckBushnetIDs(t *testing.T) {
+	for _, id := range []string{"bushnet", "Bushnet", "BUSHNET", "BushnetHotspot", "bushnethotspot", "BUSHNETHOTSPOT"} {
+		assert.Equal(t, ErrBushnetNetwork, defaultBushnetNetworks.check(id), id)
+	}
+	for _, id := range []string{"bushnet2", "home", ""} {
+		assert.NoError(t, defaultBushnetNetworks.check(id), id)
+	}
+
+	// The configured networks are matched ignoring case too.
+	configured := bushnetIDs{"fieldnet", "BushnetHotspot"}
+	assert.Equal(t, ErrBushnetNetwork, configured.check("FieldNet"))
+	assert.NoError(t, configured.check("bushnet"))
+
+	// Networks in a bundle can't be imported over a bushnet network by changing the case.
+	networks := []ExportedNetwork{
+		{ID: "BUSHNET", SSID: "BUSHNET", Security: SECURITY_WPA2_PSK, PSK: "feathers", IP: DefaultIPConfig()},
+		{ID: "home", SSID: "bushnethotspot", Security: SECURITY_OPEN, IP: DefaultIPConfig()},
+	}
+	results := planImport(networks, nil, defaultBushnetNetworks, CONFLICT_RENAME)
+	assert.Equal(t, []ImportAction{IMPORT_SKIPPED, IMPORT_SKIPPED}, actions(results))
+}
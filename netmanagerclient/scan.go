@@ -0,0 +1,347 @@
+package netmanagerclient
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/rpi-net-manager/nmcli"
+	"github.com/godbus/dbus/v5"
+)
+
+// WifiBand is the frequency band an access point is on.
+type WifiBand string
+
+const (
+	BAND_2_4GHZ  WifiBand = "2.4GHz"
+	BAND_5GHZ    WifiBand = "5GHz"
+	BAND_6GHZ    WifiBand = "6GHz"
+	BAND_UNKNOWN WifiBand = "unknown"
+)
+
+// AccessPoint is an access point found in a scan. A network can have many access points with the same SSID.
+type AccessPoint struct {
+	BSSID         string       `json:"bssid"`
+	SSID          string       `json:"ssid"`    // The display form of the SSID, empty for hidden networks.
+	RawSSID       SSID         `json:"ssidHex"` // The bytes of the SSID, given as hex in JSON.
+	Channel       int          `json:"channel"`
+	Band          WifiBand     `json:"band"`
+	Frequency     int          `json:"frequency"` // MHz
+	Security      WifiSecurity `json:"security"`
+	SecurityFlags []string     `json:"securityFlags"` // What the access point supports, e.g. WPA2 WPA3.
+	MaxBitrate    int          `json:"maxBitrate"`    // Mbit/s
+	Signal        int          `json:"signal"`        // 0 to 100
+	InUse         bool         `json:"inUse"`
+}
+
+// ScannedNetwork is the access points found in a scan that have the same SSID.
+// The summary fields are from the best access point.
+type ScannedNetwork struct {
+	SSID         string        `json:"ssid"` // The display form of the SSID.
+	RawSSID      SSID          `json:"ssidHex"`
+	Security     WifiSecurity  `json:"security"`
+	Signal       int           `json:"signal"`
+	InUse        bool          `json:"inUse"`        // If connected to any of the access points.
+	Saved        bool          `json:"saved"`        // If there is a saved network with this SSID.
+	AccessPoints []AccessPoint `json:"accessPoints"` // Best signal first.
+}
+
+// ScanSort is how to order scanned networks.
+type ScanSort string
+
+const (
+	SCAN_SORT_SIGNAL  ScanSort = "signal"  // Strongest signal first.
+	SCAN_SORT_SSID    ScanSort = "ssid"    // Alphabetically by SSID.
+	SCAN_SORT_CHANNEL ScanSort = "channel" // By the channel of the best access point.
+)
+
+var ErrUnknownScanSort = InputError{Message: fmt.Sprintf("sort must be '%s', '%s' or '%s'", SCAN_SORT_SIGNAL, SCAN_SORT_SSID, SCAN_SORT_CHANNEL)}
+
+var ErrUnknownScanBand = InputError{Message: fmt.Sprintf("band must be '%s', '%s' or '%s'", BAND_2_4GHZ, BAND_5GHZ, BAND_6GHZ)}
+
+// ScanFilter picks which access points to keep from a scan. Fields left empty don't filter anything.
+type ScanFilter struct {
+	SSID      string   // Part of the SSID, not case sensitive.
+	Band      WifiBand // Only access points on this band.
+	MinSignal int      // Only access points with at least this signal.
+	Saved     bool     // Only networks that are saved.
+}
+
+// Validate checks the filter, so a band that doesn't exist isn't used to filter out every access point.
+func (f ScanFilter) Validate() error {
+	switch f.Band {
+	case "", BAND_2_4GHZ, BAND_5GHZ, BAND_6GHZ:
+		return nil
+	default:
+		return ErrUnknownScanBand
+	}
+}
+
+// ScanResults is the access points found by the last scan the service did.
+type ScanResults struct {
+	ScannedAt    time.Time     `json:"scannedAt"` // Zero if the service hasn't scanned yet.
+	Age          time.Duration `json:"age"`
+	AccessPoints []AccessPoint `json:"accessPoints"`
+	// Scanning is set when the service has started a new scan, ScanResultsUpdated is sent when it finishes.
+	Scanning bool `json:"scanning"`
+}
+
+// DefaultScanMaxAge is how old scan results can be before a new scan is needed when scanning for networks.
+const DefaultScanMaxAge = 30 * time.Second
+
+// scanWaitTimeout is how long to wait for the service to finish a scan.
+const scanWaitTimeout = 15 * time.Second
+
+// GetScanResults gets the access points from the last scan the service did. If the results are older than
+// maxAge the service scans again, and this waits for that scan to finish. The service won't scan while it is
+// connecting to a network or running the hotspot, then the older results are returned and the service scans
+// once it can.
+func GetScanResults(maxAge time.Duration) (*ScanResults, error) {
+	// Listen for the signal before asking for the results so it can't be missed.
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to System Bus: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.AddMatchSignal(dbus.WithMatchInterface(DbusInterface), dbus.WithMatchMember("ScanResultsUpdated")); err != nil {
+		return nil, err
+	}
+	signals := make(chan *dbus.Signal, 10)
+	conn.Signal(signals)
+
+	results, err := getScanResults(maxAge)
+	if err != nil || !results.Scanning {
+		return results, err
+	}
+	select {
+	case <-signals:
+	case <-time.After(scanWaitTimeout):
+		log.Println("Timed out waiting for the service to scan")
+		return results, nil
+	}
+	// The new results are fresh, so this won't start another scan.
+	return getScanResults(maxAge + scanWaitTimeout)
+}
+
+func getScanResults(maxAge time.Duration) (*ScanResults, error) {
+	data, err := eventsDbusCall("GetScanResults", int(maxAge.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 1 {
+		return nil, errors.New("error getting scan results")
+	}
+	resultsStr, ok := data[0].(string)
+	if !ok {
+		return nil, errors.New("error reading scan results")
+	}
+	results := &ScanResults{}
+	if err := json.Unmarshal([]byte(resultsStr), results); err != nil {
+		return nil, fmt.Errorf("failed to parse scan results: %v", err)
+	}
+	return results, nil
+}
+
+// ScanAccessPoints gets every access point found by the service's scans, scanning again if the results
+// are older than DefaultScanMaxAge. If the service isn't running nmcli is used to scan.
+func ScanAccessPoints() ([]AccessPoint, error) {
+	results, err := GetScanResults(DefaultScanMaxAge)
+	if err != nil {
+		log.Debugf("Failed to get scan results from the service, scanning with nmcli: %v", err)
+		return NmcliAccessPoints("", true)
+	}
+	return results.AccessPoints, nil
+}
+
+// NmcliAccessPoints lists the access points nmcli knows of on the interface, or on all interfaces if ifname is empty.
+// With rescan it waits for a new scan, which has to be run as root.
+func NmcliAccessPoints(ifname string, rescan bool) ([]AccessPoint, error) {
+	// SSID-HEX is used instead of SSID as nmcli changes the bytes of SSIDs that aren't UTF-8.
+	args := []string{"--terse", "--fields", "IN-USE,BSSID,CHAN,FREQ,RATE,SIGNAL,SECURITY,SSID-HEX", "device", "wifi", "list"}
+	if ifname != "" {
+		args = append(args, "ifname", ifname)
+	}
+	args = append(args, "--rescan", nmBool(rescan))
+	out, err := exec.Command("nmcli", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list wifi networks: %v, output: %s", err, out)
+	}
+	return parseAccessPoints(string(out))
+}
+
+// ScanWifiNetworkGroups scans for wifi networks and groups the access points by SSID, strongest network first.
+// Access points of hidden networks are left out as they can't be told apart.
+func ScanWifiNetworkGroups() ([]ScannedNetwork, error) {
+	aps, err := ScanAccessPoints()
+	if err != nil {
+		return nil, err
+	}
+	saved, err := ListSavedWifiNetworks()
+	if err != nil {
+		return nil, err
+	}
+	savedSSIDs := map[string]bool{}
+	for _, network := range saved {
+		savedSSIDs[string(network.RawSSID)] = true
+	}
+	return groupAccessPoints(aps, savedSSIDs), nil
+}
+
+func parseAccessPoints(out string) ([]AccessPoint, error) {
+	rows, err := nmcli.ParseRows(out, 8)
+	if err != nil {
+		return nil, err
+	}
+	aps := []AccessPoint{}
+	for _, parts := range rows {
+		ap := AccessPoint{
+			InUse: parts[0] == "*",
+			BSSID: parts[1],
+		}
+		// Hidden networks have no SSID.
+		if parts[7] != "" && parts[7] != "--" {
+			if ap.RawSSID, err = ParseSSIDHex(parts[7]); err != nil {
+				return nil, fmt.Errorf("failed to parse SSID of '%s': %v", ap.BSSID, err)
+			}
+			ap.SSID = ap.RawSSID.String()
+		}
+		if ap.Channel, err = strconv.Atoi(parts[2]); err != nil {
+			return nil, fmt.Errorf("failed to parse channel of '%s': %v", ap.BSSID, err)
+		}
+		if ap.Frequency, err = strconv.Atoi(withoutUnit(parts[3])); err != nil {
+			return nil, fmt.Errorf("failed to parse frequency of '%s': %v", ap.BSSID, err)
+		}
+		if ap.MaxBitrate, err = strconv.Atoi(withoutUnit(parts[4])); err != nil {
+			return nil, fmt.Errorf("failed to parse rate of '%s': %v", ap.BSSID, err)
+		}
+		if ap.Signal, err = strconv.Atoi(parts[5]); err != nil {
+			return nil, fmt.Errorf("failed to parse signal of '%s': %v", ap.BSSID, err)
+		}
+		ap.Band = BandFromFrequency(ap.Frequency)
+		ap.Security = SecurityFromScan(parts[6])
+		if flags := strings.Fields(parts[6]); len(flags) > 0 && parts[6] != "--" {
+			ap.SecurityFlags = flags
+		}
+		aps = append(aps, ap)
+	}
+	return aps, nil
+}
+
+// withoutUnit removes the unit nmcli shows after a number, e.g. "2437 MHz".
+func withoutUnit(s string) string {
+	number, _, _ := strings.Cut(s, " ")
+	return number
+}
+
+// BandFromFrequency gets the band from the frequency, in MHz, of an access point.
+func BandFromFrequency(freq int) WifiBand {
+	switch {
+	case freq >= 2400 && freq < 2500:
+		return BAND_2_4GHZ
+	case freq >= 5150 && freq < 5950:
+		return BAND_5GHZ
+	case freq >= 5950 && freq <= 7125:
+		return BAND_6GHZ
+	default:
+		return BAND_UNKNOWN
+	}
+}
+
+// groupAccessPoints groups the access points by the raw bytes of their SSID, with the best access point first
+// in each group and the strongest network first. savedSSIDs is keyed by the raw bytes too.
+func groupAccessPoints(aps []AccessPoint, savedSSIDs map[string]bool) []ScannedNetwork {
+	groups := map[string][]AccessPoint{}
+	ssids := []string{}
+	for _, ap := range aps {
+		ssid := string(ap.RawSSID)
+		if ssid == "" {
+			continue
+		}
+		if _, ok := groups[ssid]; !ok {
+			ssids = append(ssids, ssid)
+		}
+		groups[ssid] = append(groups[ssid], ap)
+	}
+	networks := []ScannedNetwork{}
+	for _, ssid := range ssids {
+		networks = append(networks, newScannedNetwork(SSID(ssid), groups[ssid], savedSSIDs[ssid]))
+	}
+	_ = SortScannedNetworks(networks, SCAN_SORT_SIGNAL)
+	return networks
+}
+
+func newScannedNetwork(ssid SSID, aps []AccessPoint, saved bool) ScannedNetwork {
+	slices.SortStableFunc(aps, func(a, b AccessPoint) int {
+		return cmp.Or(
+			cmp.Compare(b.Signal, a.Signal),
+			cmp.Compare(b.MaxBitrate, a.MaxBitrate),
+			cmp.Compare(a.BSSID, b.BSSID),
+		)
+	})
+	network := ScannedNetwork{
+		SSID:         ssid.String(),
+		RawSSID:      ssid,
+		Security:     aps[0].Security,
+		Signal:       aps[0].Signal,
+		Saved:        saved,
+		AccessPoints: aps,
+	}
+	for _, ap := range aps {
+		network.InUse = network.InUse || ap.InUse
+	}
+	return network
+}
+
+// SortScannedNetworks orders the networks, networks that are equal are ordered by SSID.
+func SortScannedNetworks(networks []ScannedNetwork, by ScanSort) error {
+	var compare func(a, b ScannedNetwork) int
+	switch by {
+	case SCAN_SORT_SIGNAL:
+		compare = func(a, b ScannedNetwork) int { return cmp.Compare(b.Signal, a.Signal) }
+	case SCAN_SORT_SSID:
+		compare = func(a, b ScannedNetwork) int { return 0 }
+	case SCAN_SORT_CHANNEL:
+		compare = func(a, b ScannedNetwork) int {
+			return cmp.Compare(a.AccessPoints[0].Channel, b.AccessPoints[0].Channel)
+		}
+	default:
+		return ErrUnknownScanSort
+	}
+	slices.SortStableFunc(networks, func(a, b ScannedNetwork) int {
+		return cmp.Or(compare(a, b), cmp.Compare(a.SSID, b.SSID))
+	})
+	return nil
+}
+
+// FilterScannedNetworks keeps the access points that match the filter. Networks with none
+// left are removed, and the others are updated to be about their best access point left.
+func FilterScannedNetworks(networks []ScannedNetwork, filter ScanFilter) ([]ScannedNetwork, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	filtered := []ScannedNetwork{}
+	for _, network := range networks {
+		if filter.Saved && !network.Saved {
+			continue
+		}
+		if filter.SSID != "" && !strings.Contains(strings.ToLower(network.SSID), strings.ToLower(filter.SSID)) {
+			continue
+		}
+		aps := []AccessPoint{}
+		for _, ap := range network.AccessPoints {
+			if (filter.Band == "" || ap.Band == filter.Band) && ap.Signal >= filter.MinSignal {
+				aps = append(aps, ap)
+			}
+		}
+		if len(aps) > 0 {
+			filtered = append(filtered, newScannedNetwork(network.RawSSID, aps, network.Saved))
+		}
+	}
+	return filtered, nil
+}
@@ -0,0 +1,143 @@
+package netmanagerclient
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The SSIDs are home, 'cafe: free' and new, the last access point is hidden.
+const scanOutput = ` :AA\:BB\:CC\:00\:00\:01:6:2437 MHz:130 Mbit/s:72:WPA2:686F6D65
+*:AA\:BB\:CC\:00\:00\:02:36:5180 MHz:540 Mbit/s:65:WPA2 WPA3:686F6D65
+ :AA\:BB\:CC\:00\:00\:03:1:2412 MHz:54 Mbit/s:80::636166653A2066726565
+ :AA\:BB\:CC\:00\:00\:04:5:5975 MHz:1201 Mbit/s:40:WPA3:6E6577
+ :AA\:BB\:CC\:00\:00\:05:11:2462 MHz:65 Mbit/s:72:WPA2:686F6D65
+ :AA\:BB\:CC\:00\:00\:06:11:2462 MHz:65 Mbit/s:30:WPA2:
+`
+
+func TestParseAccessPoints(t *testing.T) {
+	aps, err := parseAccessPoints(scanOutput)
+	require.NoError(t, err)
+	require.Len(t, aps, 6)
+	assert.Equal(t, AccessPoint{
+		BSSID:         "AA:BB:CC:00:00:02",
+		SSID:          "home",
+		RawSSID:       SSID("home"),
+		Channel:       36,
+		Band:          BAND_5GHZ,
+		Frequency:     5180,
+		Security:      SECURITY_WPA2_WPA3,
+		SecurityFlags: []string{"WPA2", "WPA3"},
+		MaxBitrate:    540,
+		Signal:        65,
+		InUse:         true,
+	}, aps[1])
+	assert.Equal(t, AccessPoint{
+		BSSID:      "AA:BB:CC:00:00:03",
+		SSID:       "cafe: free",
+		RawSSID:    SSID("cafe: free"),
+		Channel:    1,
+		Band:       BAND_2_4GHZ,
+		Frequency:  2412,
+		Security:   SECURITY_OPEN,
+		MaxBitrate: 54,
+		Signal:     80,
+	}, aps[2])
+	assert.Equal(t, BAND_6GHZ, aps[3].Band)
+	assert.Equal(t, "", aps[5].SSID)
+	assert.Empty(t, aps[5].RawSSID)
+
+	// SSIDs that aren't UTF-8 keep their bytes.
+	aps, err = parseAccessPoints(" :AA\\:BB:6:2437 MHz:130 Mbit/s:72:WPA2:436166E9\n")
+	require.NoError(t, err)
+	assert.Equal(t, SSID("Caf\xe9"), aps[0].RawSSID)
+	assert.Equal(t, `Caf\xe9`, aps[0].SSID)
+
+	_, err = parseAccessPoints(" :AA\\:BB:6:2437 MHz:130 Mbit/s:72:WPA2\n")
+	assert.Error(t, err)
+	_, err = parseAccessPoints(" :AA\\:BB:six:2437 MHz:130 Mbit/s:72:WPA2:686F6D65\n")
+	assert.Error(t, err)
+	_, err = parseAccessPoints(" :AA\\:BB:6:2437 MHz:130 Mbit/s:72:WPA2:home\n")
+	assert.Error(t, err)
+}
+
+func TestGroupAccessPoints(t *testing.T) {
+	aps, err := parseAccessPoints(scanOutput)
+	require.NoError(t, err)
+	networks := groupAccessPoints(aps, map[string]bool{"home": true})
+
+	ssids := []string{}
+	for _, network := range networks {
+		ssids = append(ssids, network.SSID)
+	}
+	// Strongest first, and the hidden access point is left out.
+	assert.Equal(t, []string{"cafe: free", "home", "new"}, ssids)
+
+	home := networks[1]
+	assert.True(t, home.Saved)
+	assert.True(t, home.InUse)
+	assert.Equal(t, 72, home.Signal)
+	assert.Equal(t, SECURITY_WPA2_PSK, home.Security)
+	// Equal signal is ordered by the faster access point.
+	bssids := []string{}
+	for _, ap := range home.AccessPoints {
+		bssids = append(bssids, ap.BSSID)
+	}
+	assert.Equal(t, []string{"AA:BB:CC:00:00:01", "AA:BB:CC:00:00:05", "AA:BB:CC:00:00:02"}, bssids)
+	assert.False(t, networks[0].Saved)
+	assert.False(t, networks[0].InUse)
+}
+
+func TestSortScannedNetworks(t *testing.T) {
+	aps, err := parseAccessPoints(scanOutput)
+	require.NoError(t, err)
+	networks := groupAccessPoints(aps, nil)
+	ssids := func() []string {
+		s := []string{}
+		for _, network := range networks {
+			s = append(s, network.SSID)
+		}
+		return s
+	}
+
+	require.NoError(t, SortScannedNetworks(networks, SCAN_SORT_SSID))
+	assert.Equal(t, []string{"cafe: free", "home", "new"}, ssids())
+	require.NoError(t, SortScannedNetworks(networks, SCAN_SORT_CHANNEL))
+	assert.Equal(t, []string{"cafe: free", "new", "home"}, ssids())
+	require.NoError(t, SortScannedNetworks(networks, SCAN_SORT_SIGNAL))
+	assert.Equal(t, []string{"cafe: free", "home", "new"}, ssids())
+	assert.Equal(t, ErrUnknownScanSort, SortScannedNetworks(networks, "bssid"))
+}
+
+func TestFilterScannedNetworks(t *testing.T) {
+	aps, err := parseAccessPoints(scanOutput)
+	require.NoError(t, err)
+	networks := groupAccessPoints(aps, map[string]bool{"home": true})
+
+	filter := func(f ScanFilter) []ScannedNetwork {
+		filtered, err := FilterScannedNetworks(networks, f)
+		require.NoError(t, err)
+		return filtered
+	}
+	filtered := filter(ScanFilter{Band: BAND_5GHZ})
+	require.Len(t, filtered, 1)
+	// The summary is from the best access point left.
+	assert.Equal(t, "home", filtered[0].SSID)
+	assert.Equal(t, 65, filtered[0].Signal)
+	assert.Equal(t, SECURITY_WPA2_WPA3, filtered[0].Security)
+	assert.Len(t, filtered[0].AccessPoints, 1)
+
+	assert.Len(t, filter(ScanFilter{}), 3)
+	assert.Len(t, filter(ScanFilter{Saved: true}), 1)
+	assert.Len(t, filter(ScanFilter{SSID: "CAFE"}), 1)
+	assert.Len(t, filter(ScanFilter{MinSignal: 70}), 2)
+	assert.Empty(t, filter(ScanFilter{SSID: "home", MinSignal: 90}))
+	// Filtering doesn't change the networks it was given.
+	assert.Len(t, networks[1].AccessPoints, 3)
+
+	for _, band := range []WifiBand{"5", "5ghz", "2.4", BAND_UNKNOWN} {
+		_, err := FilterScannedNetworks(networks, ScanFilter{Band: band})
+		assert.Equal(t, ErrUnknownScanBand, err, band)
+	}
+}
@@ -0,0 +1,155 @@
+package netmanagerclient
+
+import (
+	"encoding/hex"
+	"slices"
+	"strings"
+)
+
+// WifiSecurity is the type of security a wifi network uses.
+type WifiSecurity string
+
+const (
+	SECURITY_OPEN      WifiSecurity = "open"      // No password.
+	SECURITY_WPA2_PSK  WifiSecurity = "wpa2-psk"  // WPA2 personal, also used for WPA1.
+	SECURITY_WPA3_SAE  WifiSecurity = "wpa3-sae"  // WPA3 personal.
+	SECURITY_WPA2_WPA3 WifiSecurity = "wpa2-wpa3" // WPA2/WPA3 transition mode, uses WPA3 when the access point supports it.
+	SECURITY_WPA2_EAP  WifiSecurity = "wpa2-eap"  // WPA2 enterprise (802.1X).
+	SECURITY_WPA3_EAP  WifiSecurity = "wpa3-eap"  // WPA3 enterprise (802.1X).
+	SECURITY_UNKNOWN   WifiSecurity = "unknown"   // A security type that isn't supported, such as WEP.
+)
+
+var (
+	ErrPSKTooLong      = InputError{Message: "the given PSK is too long, must be at most 63 characters long or 64 hex digits"}
+	ErrPSKInvalid      = InputError{Message: "the given PSK can only contain printable ASCII characters"}
+	ErrPSKRequired     = InputError{Message: "a PSK is required for the security type"}
+	ErrPSKNotAllowed   = InputError{Message: "an open network can't have a PSK"}
+	ErrUnknownSecurity = InputError{Message: "unknown security type"}
+	ErrNeedsEnterprise = InputError{Message: "enterprise networks need an identity, use AddEnterpriseWifiNetwork"}
+	ErrNoPSK           = InputError{Message: "the network doesn't use a PSK"}
+)
+
+// CheckWifiSecurity checks the PSK is valid for the security type.
+func CheckWifiSecurity(security WifiSecurity, psk string) error {
+	switch security {
+	case SECURITY_OPEN:
+		if psk != "" {
+			return ErrPSKNotAllowed
+		}
+	case SECURITY_WPA2_PSK, SECURITY_WPA2_WPA3:
+		// WPA2 needs a passphrase of 8 to 63 ASCII characters, or the key as 64 hex digits.
+		if len(psk) == 64 {
+			if _, err := hex.DecodeString(psk); err != nil {
+				return ErrPSKTooLong
+			}
+			return nil
+		}
+		if len(psk) < 8 {
+			return ErrPSKTooShort
+		}
+		if len(psk) > 63 {
+			return ErrPSKTooLong
+		}
+		for _, c := range psk {
+			if c < ' ' || c > '~' {
+				return ErrPSKInvalid
+			}
+		}
+	case SECURITY_WPA3_SAE:
+		// SAE passwords don't have the length limits of WPA2.
+		if psk == "" {
+			return ErrPSKRequired
+		}
+	case SECURITY_WPA2_EAP, SECURITY_WPA3_EAP:
+		return ErrNeedsEnterprise
+	default:
+		return ErrUnknownSecurity
+	}
+	return nil
+}
+
+// checkModifyPSK checks the PSK can be set as the new PSK of a saved network with the security type.
+// Open and enterprise networks don't have a PSK to change.
+func checkModifyPSK(security WifiSecurity, psk string) error {
+	switch security {
+	case SECURITY_OPEN, SECURITY_WPA2_EAP, SECURITY_WPA3_EAP:
+		return ErrNoPSK
+	}
+	return CheckWifiSecurity(security, psk)
+}
+
+// securityConfig is the NetworkManager config for a network with the security type.
+func securityConfig(security WifiSecurity, psk string) map[string]string {
+	switch security {
+	case SECURITY_WPA2_PSK:
+		return map[string]string{
+			"wifi-sec.key-mgmt": "wpa-psk",
+			"wifi-sec.psk":      psk,
+		}
+	case SECURITY_WPA3_SAE:
+		return map[string]string{
+			"wifi-sec.key-mgmt": "sae",
+			"wifi-sec.psk":      psk,
+			"wifi-sec.pmf":      "required", // WPA3 requires protected management frames.
+		}
+	case SECURITY_WPA2_WPA3:
+		// With wpa-psk NetworkManager will also use SAE if the access point supports it.
+		return map[string]string{
+			"wifi-sec.key-mgmt": "wpa-psk",
+			"wifi-sec.psk":      psk,
+			"wifi-sec.pmf":      "optional",
+		}
+	default:
+		return map[string]string{}
+	}
+}
+
+// securityFromSettings gets the security type from the key-mgmt and pmf settings of a saved network.
+// nmcli can show pmf as the name or the number of the value.
+func securityFromSettings(keyMgmt, pmf string) WifiSecurity {
+	pmfRequired := pmf == "required" || pmf == "3"
+	switch keyMgmt {
+	case "":
+		return SECURITY_OPEN
+	case "wpa-psk":
+		if pmf == "optional" || pmf == "2" {
+			return SECURITY_WPA2_WPA3
+		}
+		return SECURITY_WPA2_PSK
+	case "sae":
+		return SECURITY_WPA3_SAE
+	case "wpa-eap":
+		if pmfRequired {
+			return SECURITY_WPA3_EAP
+		}
+		return SECURITY_WPA2_EAP
+	default:
+		return SECURITY_UNKNOWN
+	}
+}
+
+// SecurityFromScan gets the security type from the security flags of an access point, as nmcli shows them, e.g. "WPA1 WPA2".
+func SecurityFromScan(flags string) WifiSecurity {
+	fields := strings.Fields(flags)
+	has := func(flag string) bool {
+		return slices.Contains(fields, flag)
+	}
+	switch {
+	case len(fields) == 0 || flags == "--":
+		return SECURITY_OPEN
+	case has("802.1X") && has("WPA3"):
+		return SECURITY_WPA3_EAP
+	case has("802.1X"):
+		return SECURITY_WPA2_EAP
+	case has("WEP") || has("OWE"):
+		return SECURITY_UNKNOWN
+	case has("WPA3") && (has("WPA2") || has("WPA1")):
+		return SECURITY_WPA2_WPA3
+	case has("WPA3"):
+		return SECURITY_WPA3_SAE
+	case has("WPA2") || has("WPA1"):
+		return SECURITY_WPA2_PSK
+	default:
+		return SECURITY_UNKNOWN
+	}
+}
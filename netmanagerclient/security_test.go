@@ -0,0 +1,95 @@
+package netmanagerclient
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckWifiSecurity(t *testing.T) {
+	tests := []struct {
+		security WifiSecurity
+		psk      string
+		err      error
+	}{
+		{SECURITY_OPEN, "", nil},
+		{SECURITY_OPEN, "password", ErrPSKNotAllowed},
+		{SECURITY_WPA2_PSK, "password", nil},
+		{SECURITY_WPA2_PSK, "short", ErrPSKTooShort},
+		{SECURITY_WPA2_PSK, strings.Repeat("a", 63), nil},
+		{SECURITY_WPA2_PSK, strings.Repeat("a", 65), ErrPSKTooLong},
+		{SECURITY_WPA2_PSK, strings.Repeat("0f", 32), nil},
+		{SECURITY_WPA2_PSK, strings.Repeat("g", 64), ErrPSKTooLong},
+		{SECURITY_WPA2_PSK, "pässword", ErrPSKInvalid},
+		{SECURITY_WPA2_WPA3, "short", ErrPSKTooShort},
+		{SECURITY_WPA2_WPA3, "password", nil},
+		{SECURITY_WPA3_SAE, "short", nil},
+		{SECURITY_WPA3_SAE, strings.Repeat("a", 100), nil},
+		{SECURITY_WPA3_SAE, "", ErrPSKRequired},
+		{SECURITY_WPA2_EAP, "password", ErrNeedsEnterprise},
+		{SECURITY_UNKNOWN, "password", ErrUnknownSecurity},
+		{"wep", "password", ErrUnknownSecurity},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.err, CheckWifiSecurity(tt.security, tt.psk), "%s '%s'", tt.security, tt.psk)
+	}
+}
+
+func TestCheckModifyPSK(t *testing.T) {
+	tests := []struct {
+		security WifiSecurity
+		psk      string
+		err      error
+	}{
+		{SECURITY_WPA2_PSK, "password", nil},
+		{SECURITY_WPA2_PSK, "short", ErrPSKTooShort},
+		{SECURITY_WPA2_WPA3, "short", ErrPSKTooShort},
+		{SECURITY_WPA3_SAE, "short", nil},
+		{SECURITY_WPA3_SAE, "", ErrPSKRequired},
+		{SECURITY_OPEN, "password", ErrNoPSK},
+		{SECURITY_OPEN, "", ErrNoPSK},
+		{SECURITY_WPA2_EAP, "password", ErrNoPSK},
+		{SECURITY_WPA3_EAP, "password", ErrNoPSK},
+		{SECURITY_UNKNOWN, "password", ErrUnknownSecurity},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.err, checkModifyPSK(tt.security, tt.psk), "%s '%s'", tt.security, tt.psk)
+	}
+}
+
+func TestSecurityFromScan(t *testing.T) {
+	tests := map[string]WifiSecurity{
+		"":            SECURITY_OPEN,
+		"--":          SECURITY_OPEN,
+		"WPA2":        SECURITY_WPA2_PSK,
+		"WPA1 WPA2":   SECURITY_WPA2_PSK,
+		"WPA3":        SECURITY_WPA3_SAE,
+		"WPA2 WPA3":   SECURITY_WPA2_WPA3,
+		"WPA2 802.1X": SECURITY_WPA2_EAP,
+		"WPA3 802.1X": SECURITY_WPA3_EAP,
+		"WEP":         SECURITY_UNKNOWN,
+		"OWE":         SECURITY_UNKNOWN,
+	}
+	for flags, want := range tests {
+		assert.Equal(t, want, SecurityFromScan(flags), flags)
+	}
+}
+
+func TestSecurityFromSettings(t *testing.T) {
+	tests := []struct {
+		keyMgmt, pmf string
+		security     WifiSecurity
+	}{
+		{"", "", SECURITY_OPEN},
+		{"wpa-psk", "0", SECURITY_WPA2_PSK},
+		{"wpa-psk", "optional", SECURITY_WPA2_WPA3},
+		{"sae", "3", SECURITY_WPA3_SAE},
+		{"wpa-eap", "default", SECURITY_WPA2_EAP},
+		{"wpa-eap", "required", SECURITY_WPA3_EAP},
+		{"owe", "", SECURITY_UNKNOWN},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.security, securityFromSettings(test.keyMgmt, test.pmf), "%s %s", test.keyMgmt, test.pmf)
+	}
+}
@@ -0,0 +1,141 @@
+package netmanagerclient
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// SSID is the name of a wifi network as the bytes the access point sends. It can be up to 32 bytes and doesn't
+// have to be UTF-8, older access points use legacy encodings and some names are binary.
+// Functions that take an SSID as a string take these bytes, e.g. string(ssid).
+type SSID []byte
+
+// MaxSSIDLength is the most bytes an SSID can have.
+const MaxSSIDLength = 32
+
+var (
+	ErrSSIDRequired = InputError{Message: "an SSID is required"}
+	ErrSSIDTooLong  = InputError{Message: fmt.Sprintf("the SSID is longer than %d bytes", MaxSSIDLength)}
+	ErrSSIDHasNUL   = InputError{Message: "SSIDs with NUL bytes can't be added"}
+	ErrSSIDHex      = InputError{Message: "the SSID is not valid hex"}
+)
+
+// ParseSSIDHex reads the hex form of an SSID, as given by Hex or shown by nmcli in the SSID-HEX field.
+func ParseSSIDHex(s string) (SSID, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	ssid, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, ErrSSIDHex
+	}
+	return SSID(ssid), nil
+}
+
+// Validate checks the SSID is between 1 and 32 bytes.
+func (s SSID) Validate() error {
+	if len(s) == 0 {
+		return ErrSSIDRequired
+	}
+	if len(s) > MaxSSIDLength {
+		return ErrSSIDTooLong
+	}
+	return nil
+}
+
+// String is the display form of the SSID. It is the SSID itself if it is UTF-8, otherwise any bytes that aren't
+// UTF-8 are shown as '\xNN'. This is also the ID that networks are saved with.
+func (s SSID) String() string {
+	if utf8.Valid(s) {
+		return string(s)
+	}
+	var b strings.Builder
+	for rest := []byte(s); len(rest) > 0; {
+		r, size := utf8.DecodeRune(rest)
+		if r == utf8.RuneError && size == 1 {
+			fmt.Fprintf(&b, `\x%02x`, rest[0])
+		} else {
+			b.Write(rest[:size])
+		}
+		rest = rest[size:]
+	}
+	return b.String()
+}
+
+// Hex is the hex form of the SSID, the same as nmcli shows it, e.g. '686F6D65' for 'home'.
+func (s SSID) Hex() string {
+	return strings.ToUpper(hex.EncodeToString(s))
+}
+
+// IsUTF8 checks if the display form is the same as the SSID.
+func (s SSID) IsUTF8() bool {
+	return utf8.Valid(s)
+}
+
+// Equal checks if the SSIDs have the same bytes.
+func (s SSID) Equal(other SSID) bool {
+	return bytes.Equal(s, other)
+}
+
+// MarshalText gives the hex form, as JSON and D-Bus strings have to be UTF-8.
+func (s SSID) MarshalText() ([]byte, error) {
+	return []byte(s.Hex()), nil
+}
+
+func (s *SSID) UnmarshalText(text []byte) error {
+	ssid, err := ParseSSIDHex(string(text))
+	if err != nil {
+		return err
+	}
+	*s = ssid
+	return nil
+}
+
+// checkSSID checks a network can be added with the SSID. nmcli is given the SSID as an argument, so it can't
+// have NUL bytes.
+func checkSSID(ssid string) error {
+	if err := SSID(ssid).Validate(); err != nil {
+		return err
+	}
+	if strings.IndexByte(ssid, 0) >= 0 {
+		return ErrSSIDHasNUL
+	}
+	return nil
+}
+
+// connectionID is the ID of the saved network for an SSID, or the ID itself if given one.
+// IDs have to be UTF-8 so the display form is used.
+func connectionID(ssid string) string {
+	return SSID(ssid).String()
+}
+
+// savedWifiSSIDs gets the SSIDs of the saved wifi networks from NetworkManager, by their ID.
+// nmcli only shows SSIDs that are UTF-8, it changes the bytes of the others.
+func savedWifiSSIDs() (map[string]SSID, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	var paths []dbus.ObjectPath
+	settingsObj := conn.Object("org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager/Settings")
+	if err := settingsObj.Call("org.freedesktop.NetworkManager.Settings.ListConnections", 0).Store(&paths); err != nil {
+		return nil, fmt.Errorf("failed to list connections: %v", err)
+	}
+	ssids := map[string]SSID{}
+	for _, path := range paths {
+		var settings map[string]map[string]dbus.Variant
+		obj := conn.Object("org.freedesktop.NetworkManager", path)
+		if err := obj.Call("org.freedesktop.NetworkManager.Settings.Connection.GetSettings", 0).Store(&settings); err != nil {
+			// The connection can be removed between listing and reading it.
+			continue
+		}
+		id, _ := settings["connection"]["id"].Value().(string)
+		if ssid, ok := settings["802-11-wireless"]["ssid"].Value().([]byte); ok {
+			ssids[id] = SSID(ssid)
+		}
+	}
+	return ssids, nil
+}
@@ -0,0 +1,87 @@
+package netmanagerclient
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSIDForms(t *testing.T) {
+	tests := []struct {
+		ssid    SSID
+		display string
+		hex     string
+		utf8    bool
+	}{
+		{SSID("home"), "home", "686F6D65", true},
+		{SSID("café ☕"), "café ☕", "636166C3A920E29895", true},
+		{SSID("Caf\xe9"), `Caf\xe9`, "436166E9", false},
+		{SSID("\x00\xff\x01"), "\x00\\xff\x01", "00FF01", false},
+		{SSID("é\xc3"), `é\xc3`, "C3A9C3", false},
+		{SSID{}, "", "", true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.display, tt.ssid.String(), tt.hex)
+		assert.Equal(t, tt.hex, tt.ssid.Hex(), tt.hex)
+		assert.Equal(t, tt.utf8, tt.ssid.IsUTF8(), tt.hex)
+		ssid, err := ParseSSIDHex(tt.hex)
+		require.NoError(t, err, tt.hex)
+		assert.True(t, tt.ssid.Equal(ssid), tt.hex)
+	}
+
+	ssid, err := ParseSSIDHex("0x686f6d65")
+	require.NoError(t, err)
+	assert.Equal(t, SSID("home"), ssid)
+	for _, s := range []string{"686F6D6", "home", "68 6F"} {
+		_, err := ParseSSIDHex(s)
+		assert.Equal(t, ErrSSIDHex, err, s)
+	}
+}
+
+func TestSSIDValidate(t *testing.T) {
+	assert.NoError(t, SSID("home").Validate())
+	assert.NoError(t, SSID(strings.Repeat("\xff", MaxSSIDLength)).Validate())
+	assert.Equal(t, ErrSSIDRequired, SSID("").Validate())
+	assert.Equal(t, ErrSSIDTooLong, SSID(strings.Repeat("a", MaxSSIDLength+1)).Validate())
+	// 11 characters but 33 bytes.
+	assert.Equal(t, ErrSSIDTooLong, SSID(strings.Repeat("☕", 11)).Validate())
+
+	assert.NoError(t, checkSSID("Caf\xe9"))
+	assert.Equal(t, ErrSSIDHasNUL, checkSSID("a\x00b"))
+	assert.Equal(t, ErrSSIDRequired, checkSSID(""))
+
+	assert.Equal(t, "home", connectionID("home"))
+	assert.Equal(t, `Caf\xe9`, connectionID("Caf\xe9"))
+}
+
+func TestSSIDJSON(t *testing.T) {
+	ap := AccessPoint{BSSID: "AA:BB:CC:00:00:01", SSID: `Caf\xe9`, RawSSID: SSID("Caf\xe9")}
+	data, err := json.Marshal(ap)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"ssidHex":"436166E9"`)
+
+	read := AccessPoint{}
+	require.NoError(t, json.Unmarshal(data, &read))
+	assert.Equal(t, ap, read)
+	assert.Error(t, json.Unmarshal([]byte(`{"ssidHex":"not hex"}`), &read))
+}
+
+func TestGroupAccessPointsBySSIDBytes(t *testing.T) {
+	// These have the same display form but are different networks.
+	aps := []AccessPoint{
+		{BSSID: "AA:BB:CC:00:00:01", SSID: `Caf\xe9`, RawSSID: SSID("Caf\xe9"), Signal: 60},
+		{BSSID: "AA:BB:CC:00:00:02", SSID: `Caf\xe9`, RawSSID: SSID(`Caf\xe9`), Signal: 50},
+		{BSSID: "AA:BB:CC:00:00:03", SSID: `Caf\xe9`, RawSSID: SSID("Caf\xe9"), Signal: 40},
+	}
+	networks := groupAccessPoints(aps, map[string]bool{"Caf\xe9": true})
+	require.Len(t, networks, 2)
+	assert.Equal(t, SSID("Caf\xe9"), networks[0].RawSSID)
+	assert.Equal(t, `Caf\xe9`, networks[0].SSID)
+	assert.True(t, networks[0].Saved)
+	assert.Len(t, networks[0].AccessPoints, 2)
+	assert.Equal(t, SSID(`Caf\xe9`), networks[1].RawSSID)
+	assert.False(t, networks[1].Saved)
+}
@@ -0,0 +1,198 @@
+package netmanagerclient
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// WifiQR is a network from a Wi-Fi QR code, such as the ones printed on routers or shown by a phone
+// when sharing a network. The payload looks like 'WIFI:S:<ssid>;T:WPA;P:<password>;H:true;;'.
+type WifiQR struct {
+	SSID     string
+	Security WifiSecurity
+	PSK      string
+	Hidden   bool
+}
+
+const wifiQRPrefix = "WIFI:"
+
+// Characters that have to be escaped with a backslash in a payload value.
+const wifiQRSpecialChars = `\;,:"`
+
+var (
+	ErrNotWifiQR        = InputError{Message: "not a Wi-Fi QR code payload"}
+	ErrWifiQRNoSSID     = InputError{Message: "Wi-Fi QR code payload has no SSID"}
+	ErrWifiQRBadEscape  = InputError{Message: "Wi-Fi QR code payload ends with an unfinished escape"}
+	ErrWifiQRWEP        = InputError{Message: "WEP networks are not supported"}
+	ErrWifiQRUnknownSec = InputError{Message: "unknown security type in Wi-Fi QR code payload"}
+)
+
+// ParseWifiQR reads the payload of a Wi-Fi QR code. The security type is read from the T field,
+// where WPA is WPA2 and SAE is WPA3, and a missing T field or 'nopass' is an open network.
+func ParseWifiQR(payload string) (WifiQR, error) {
+	qr := WifiQR{Security: SECURITY_OPEN}
+	payload = strings.TrimSpace(payload)
+	if len(payload) < len(wifiQRPrefix) || !strings.EqualFold(payload[:len(wifiQRPrefix)], wifiQRPrefix) {
+		return qr, ErrNotWifiQR
+	}
+	fields, err := splitWifiQRFields(payload[len(wifiQRPrefix):])
+	if err != nil {
+		return qr, err
+	}
+
+	hasSSID := false
+	securityType := ""
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, ":")
+		if !ok {
+			continue
+		}
+		raw := value
+		value = unescapeWifiQRValue(value)
+		switch strings.ToUpper(key) {
+		case "S":
+			// Some generators put quotes around SSIDs that could be mistaken for hex.
+			if len(raw) >= 2 && strings.HasPrefix(raw, `"`) && strings.HasSuffix(raw, `"`) && !strings.HasSuffix(raw, `\"`) {
+				value = unescapeWifiQRValue(raw[1 : len(raw)-1])
+			}
+			qr.SSID = value
+			hasSSID = true
+		case "T":
+			securityType = value
+		case "P":
+			qr.PSK = value
+		case "H":
+			qr.Hidden = strings.EqualFold(value, "true")
+		}
+	}
+	if !hasSSID || qr.SSID == "" {
+		return qr, ErrWifiQRNoSSID
+	}
+
+	switch strings.ToUpper(securityType) {
+	case "", "NOPASS":
+		qr.Security = SECURITY_OPEN
+		qr.PSK = ""
+	case "WPA", "WPA2":
+		qr.Security = SECURITY_WPA2_PSK
+	case "SAE", "WPA3":
+		qr.Security = SECURITY_WPA3_SAE
+	case "WEP":
+		return qr, ErrWifiQRWEP
+	case "WPA2-EAP", "EAP":
+		return qr, ErrNeedsEnterprise
+	default:
+		return qr, ErrWifiQRUnknownSec
+	}
+	return qr, nil
+}
+
+// splitWifiQRFields splits the payload, after the WIFI: prefix, on the semicolons that aren't
+// escaped. The payload ends with an empty field, anything after it is ignored.
+func splitWifiQRFields(s string) ([]string, error) {
+	fields := []string{}
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 >= len(s) {
+				return nil, ErrWifiQRBadEscape
+			}
+			i++
+		case ';':
+			if i == start {
+				return fields, nil
+			}
+			fields = append(fields, s[start:i])
+			start = i + 1
+		}
+	}
+	// Be lenient with payloads that are missing the final ';;'.
+	if start < len(s) {
+		fields = append(fields, s[start:])
+	}
+	return fields, nil
+}
+
+func unescapeWifiQRValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func escapeWifiQRValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(wifiQRSpecialChars, s[i]) >= 0 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Payload makes the Wi-Fi QR code payload for the network. A WPA2/WPA3 network is given as WPA,
+// as every device that can join it supports that.
+func (qr WifiQR) Payload() (string, error) {
+	if qr.SSID == "" {
+		return "", ErrWifiQRNoSSID
+	}
+	if err := CheckWifiSecurity(qr.Security, qr.PSK); err != nil {
+		return "", err
+	}
+	var securityType string
+	switch qr.Security {
+	case SECURITY_OPEN:
+		securityType = "nopass"
+	case SECURITY_WPA2_PSK, SECURITY_WPA2_WPA3:
+		securityType = "WPA"
+	case SECURITY_WPA3_SAE:
+		securityType = "SAE"
+	default:
+		return "", fmt.Errorf("can't make a Wi-Fi QR code payload for a %s network", qr.Security)
+	}
+	payload := wifiQRPrefix + "S:" + escapeWifiQRValue(qr.SSID) + ";T:" + securityType + ";"
+	if qr.PSK != "" {
+		payload += "P:" + escapeWifiQRValue(qr.PSK) + ";"
+	}
+	if qr.Hidden {
+		payload += "H:true;"
+	}
+	return payload + ";", nil
+}
+
+// AddWifiNetworkFromQR adds the network from a Wi-Fi QR code payload, with the same checks as
+// adding it by hand.
+func AddWifiNetworkFromQR(payload string) (WifiQR, error) {
+	qr, err := ParseWifiQR(payload)
+	if err != nil {
+		return qr, err
+	}
+	if qr.Hidden {
+		return qr, AddHiddenWifiNetwork(qr.SSID, qr.PSK, qr.Security)
+	}
+	return qr, AddWifiNetworkWithSecurity(qr.SSID, qr.PSK, qr.Security)
+}
+
+// GetHotspotQRPayload gets the Wi-Fi QR code payload for joining the hotspot the device hosts,
+// so it can be shown to the user.
+func GetHotspotQRPayload() (string, error) {
+	data, err := eventsDbusCall("GetHotspotQRPayload")
+	if err != nil {
+		return "", err
+	}
+	if len(data) != 1 {
+		return "", errors.New("error getting hotspot QR payload")
+	}
+	payload, ok := data[0].(string)
+	if !ok {
+		return "", errors.New("error reading hotspot QR payload")
+	}
+	return payload, nil
+}
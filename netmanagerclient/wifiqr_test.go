@@ -0,0 +1,76 @@
+package netmanagerclient
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWifiQR(t *testing.T) {
+	tests := []struct {
+		payload string
+		qr      WifiQR
+		err     error
+	}{
+		{"WIFI:S:home;T:WPA;P:password;;", WifiQR{SSID: "home", Security: SECURITY_WPA2_PSK, PSK: "password"}, nil},
+		{"WIFI:T:WPA;P:password;S:home;H:true;;", WifiQR{SSID: "home", Security: SECURITY_WPA2_PSK, PSK: "password", Hidden: true}, nil},
+		{"wifi:s:home;t:sae;p:correct horse;h:TRUE;;", WifiQR{SSID: "home", Security: SECURITY_WPA3_SAE, PSK: "correct horse", Hidden: true}, nil},
+		{"WIFI:S:cafe;T:nopass;;", WifiQR{SSID: "cafe", Security: SECURITY_OPEN}, nil},
+		{"WIFI:S:cafe;;", WifiQR{SSID: "cafe", Security: SECURITY_OPEN}, nil},
+		{"WIFI:S:cafe;P:ignored;;", WifiQR{SSID: "cafe", Security: SECURITY_OPEN}, nil},
+		{"WIFI:S:home;T:WPA;P:password;H:false", WifiQR{SSID: "home", Security: SECURITY_WPA2_PSK, PSK: "password"}, nil},
+		{" WIFI:S:home;T:WPA2;P:password;R:1;;\n", WifiQR{SSID: "home", Security: SECURITY_WPA2_PSK, PSK: "password"}, nil},
+		{`WIFI:S:a\;b\,c\:d\\e\"f;T:WPA;P:pass\;word\\;;`, WifiQR{SSID: `a;b,c:d\e"f`, Security: SECURITY_WPA2_PSK, PSK: `pass;word\`}, nil},
+		{`WIFI:S:"012345";T:WPA;P:password;;`, WifiQR{SSID: "012345", Security: SECURITY_WPA2_PSK, PSK: "password"}, nil},
+		{`WIFI:S:\"quoted\";T:WPA;P:password;;`, WifiQR{SSID: `"quoted"`, Security: SECURITY_WPA2_PSK, PSK: "password"}, nil},
+		{"WIFI:S:home;T:WPA;P:password;;extra", WifiQR{SSID: "home", Security: SECURITY_WPA2_PSK, PSK: "password"}, nil},
+		{"home", WifiQR{Security: SECURITY_OPEN}, ErrNotWifiQR},
+		{"WIFI:T:WPA;P:password;;", WifiQR{Security: SECURITY_OPEN, PSK: "password"}, ErrWifiQRNoSSID},
+		{"WIFI:S:;T:WPA;P:password;;", WifiQR{Security: SECURITY_OPEN, PSK: "password"}, ErrWifiQRNoSSID},
+		{`WIFI:S:home;P:password\`, WifiQR{Security: SECURITY_OPEN}, ErrWifiQRBadEscape},
+		{"WIFI:S:old;T:WEP;P:12345;;", WifiQR{SSID: "old", Security: SECURITY_OPEN, PSK: "12345"}, ErrWifiQRWEP},
+		{"WIFI:S:uni;T:WPA2-EAP;E:PEAP;I:user;P:password;;", WifiQR{SSID: "uni", Security: SECURITY_OPEN, PSK: "password"}, ErrNeedsEnterprise},
+		{"WIFI:S:home;T:WPA4;P:password;;", WifiQR{SSID: "home", Security: SECURITY_OPEN, PSK: "password"}, ErrWifiQRUnknownSec},
+	}
+	for _, tt := range tests {
+		qr, err := ParseWifiQR(tt.payload)
+		assert.Equal(t, tt.err, err, tt.payload)
+		assert.Equal(t, tt.qr, qr, tt.payload)
+	}
+}
+
+func TestWifiQRPayload(t *testing.T) {
+	tests := []struct {
+		qr      WifiQR
+		payload string
+	}{
+		{WifiQR{SSID: "home", Security: SECURITY_WPA2_PSK, PSK: "password"}, "WIFI:S:home;T:WPA;P:password;;"},
+		{WifiQR{SSID: "home", Security: SECURITY_WPA2_WPA3, PSK: "password", Hidden: true}, "WIFI:S:home;T:WPA;P:password;H:true;;"},
+		{WifiQR{SSID: "home", Security: SECURITY_WPA3_SAE, PSK: "correct horse"}, "WIFI:S:home;T:SAE;P:correct horse;;"},
+		{WifiQR{SSID: "cafe", Security: SECURITY_OPEN}, "WIFI:S:cafe;T:nopass;;"},
+		{WifiQR{SSID: `a;b,c:d\e"f`, Security: SECURITY_WPA2_PSK, PSK: `pass;word\`}, `WIFI:S:a\;b\,c\:d\\e\"f;T:WPA;P:pass\;word\\;;`},
+	}
+	for _, tt := range tests {
+		payload, err := tt.qr.Payload()
+		assert.NoError(t, err)
+		assert.Equal(t, tt.payload, payload)
+
+		// The payload can be read back, though WPA2/WPA3 networks are read as WPA2.
+		qr, err := ParseWifiQR(payload)
+		assert.NoError(t, err)
+		if tt.qr.Security == SECURITY_WPA2_WPA3 {
+			tt.qr.Security = SECURITY_WPA2_PSK
+		}
+		assert.Equal(t, tt.qr, qr)
+	}
+
+	for _, qr := range []WifiQR{
+		{Security: SECURITY_WPA2_PSK, PSK: "password"},
+		{SSID: "home", Security: SECURITY_WPA2_PSK, PSK: "short"},
+		{SSID: "cafe", Security: SECURITY_OPEN, PSK: "password"},
+		{SSID: "uni", Security: SECURITY_WPA2_EAP},
+	} {
+		_, err := qr.Payload()
+		assert.Error(t, err, qr.SSID)
+	}
+}
@@ -0,0 +1,119 @@
+// Package nmcli parses the terse output of nmcli. With '--terse' fields are separated by ':', and any
+// ':' or '\' in a value is escaped with a '\'. Values are kept as the bytes nmcli printed, so SSIDs
+// that aren't valid UTF-8 aren't changed.
+package nmcli
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Field is a field from terse multiline output, e.g. 'IP4.ADDRESS[1]:192.168.1.5/24'.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// SplitFields splits a line of terse tabular output on the colons that aren't escaped, and unescapes the fields.
+func SplitFields(line string) []string {
+	fields := []string{}
+	var b strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			b.WriteByte(line[i])
+		case line[i] == ':':
+			fields = append(fields, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(line[i])
+		}
+	}
+	return append(fields, b.String())
+}
+
+// Unescape removes the escaping from a single value, such as a line of '--get-values' output.
+func Unescape(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// Escape escapes a value the same way nmcli does.
+func Escape(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == ':' || value[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// JoinFields makes a line of terse tabular output from the fields.
+func JoinFields(fields ...string) string {
+	escaped := make([]string, len(fields))
+	for i, field := range fields {
+		escaped[i] = Escape(field)
+	}
+	return strings.Join(escaped, ":")
+}
+
+// lines splits output into its lines, leaving out empty lines.
+func lines(out string) []string {
+	result := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		if line != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+// ParseRows parses terse tabular output, e.g. from 'nmcli --terse --fields TYPE,NAME connection show',
+// checking that every row has the number of fields asked for.
+func ParseRows(out string, fields int) ([][]string, error) {
+	rows := [][]string{}
+	for _, line := range lines(out) {
+		row := SplitFields(line)
+		if len(row) != fields {
+			return nil, fmt.Errorf("failed to parse line '%s': has %d fields, expected %d", line, len(row), fields)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// ParseMultiline parses terse multiline output, e.g. from 'nmcli --terse connection show <id>' or
+// 'nmcli --terse device show <ifname>'. Each line is a field name, which is never escaped, and its value.
+func ParseMultiline(out string) ([]Field, error) {
+	fields := []Field{}
+	for _, line := range lines(out) {
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("failed to parse line '%s': no field name", line)
+		}
+		fields = append(fields, Field{Name: name, Value: Unescape(value)})
+	}
+	return fields, nil
+}
+
+// ParseValues parses '--get-values' output, which has the value of each field on its own line.
+func ParseValues(out string) []string {
+	values := []string{}
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		values = append(values, Unescape(line))
+	}
+	return values
+}
@@ -0,0 +1,137 @@
+package nmcli
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitFields(t *testing.T) {
+	tests := []struct {
+		line   string
+		fields []string
+	}{
+		{"", []string{""}},
+		{"802-11-wireless:home", []string{"802-11-wireless", "home"}},
+		{`*:AA\:BB::a\\b\:c`, []string{"*", "AA:BB", "", `a\b:c`}},
+		{`802-11-wireless:cafe\: free`, []string{"802-11-wireless", "cafe: free"}},
+		{`802-11-wireless:back\\slash\\`, []string{"802-11-wireless", `back\slash\`}},
+		{"802-11-wireless:\xff\xfe\\:\xc3", []string{"802-11-wireless", "\xff\xfe:\xc3"}},
+		{"a::", []string{"a", "", ""}},
+		// nmcli never ends a line with an unfinished escape, it is kept as is.
+		{`a:b\`, []string{"a", `b\`}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.fields, SplitFields(tt.line), tt.line)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	assert.Equal(t, `cafe\: free`, Escape("cafe: free"))
+	assert.Equal(t, `a\\b`, Escape(`a\b`))
+	assert.Equal(t, "\xff", Escape("\xff"))
+	assert.Equal(t, `a\:b:c\\`, JoinFields("a:b", `c\`))
+	assert.Equal(t, "a:b", Unescape(`a\:b`))
+	assert.Equal(t, `a\b`, Unescape(`a\\b`))
+}
+
+func TestParseRows(t *testing.T) {
+	out := "802-11-wireless:home\n" +
+		"802-11-wireless:cafe\\: free\n" +
+		"\n" +
+		"ethernet:Wired connection 1\n"
+	rows, err := ParseRows(out, 2)
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"802-11-wireless", "home"},
+		{"802-11-wireless", "cafe: free"},
+		{"ethernet", "Wired connection 1"},
+	}, rows)
+
+	rows, err = ParseRows("", 2)
+	require.NoError(t, err)
+	assert.Empty(t, rows)
+
+	// Unescaped colons in a value, as with '--escape no', are caught instead of the value being cut short.
+	_, err = ParseRows("802-11-wireless:cafe: free\n", 2)
+	assert.Error(t, err)
+}
+
+func TestParseMultiline(t *testing.T) {
+	tests := []struct {
+		out    string
+		fields []Field
+	}{
+		{"", []Field{}},
+		{
+			"connection.id:home\n802-11-wireless.ssid:home\\: upstairs\nIP4.ADDRESS[1]:192.168.1.5/24\n",
+			[]Field{{"connection.id", "home"}, {"802-11-wireless.ssid", "home: upstairs"}, {"IP4.ADDRESS[1]", "192.168.1.5/24"}},
+		},
+		{
+			"ipv6.addresses:2001\\:db8\\:\\:5/64\nipv6.gateway:\n",
+			[]Field{{"ipv6.addresses", "2001:db8::5/64"}, {"ipv6.gateway", ""}},
+		},
+		{
+			"AP[1].IN-USE: \nAP[1].BSSID:70\\:A7\\:41\\:DC\\:5D\\:21\n",
+			[]Field{{"AP[1].IN-USE", " "}, {"AP[1].BSSID", "70:A7:41:DC:5D:21"}},
+		},
+		// Values that weren't escaped are still read.
+		{"  AP[5].BSSID:70:A7:41:DC:64:21\n", []Field{{"AP[5].BSSID", "70:A7:41:DC:64:21"}}},
+		{"802-11-wireless.ssid:\xff\\\\\xfe\n", []Field{{"802-11-wireless.ssid", "\xff\\\xfe"}}},
+	}
+	for _, tt := range tests {
+		fields, err := ParseMultiline(tt.out)
+		require.NoError(t, err, tt.out)
+		assert.Equal(t, tt.fields, fields, tt.out)
+	}
+
+	for _, out := range []string{"no field name\n", ":value\n"} {
+		_, err := ParseMultiline(out)
+		assert.Error(t, err, out)
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	assert.Equal(t, []string{"yes", "infrastructure", "home: upstairs"}, ParseValues("yes\ninfrastructure\nhome\\: upstairs\n"))
+	assert.Equal(t, []string{"no", "", "home"}, ParseValues("no\n\nhome\n"))
+	assert.Equal(t, []string{""}, ParseValues(""))
+}
+
+func FuzzSplitFields(f *testing.F) {
+	f.Add("home", "802-11-wireless", "")
+	f.Add("cafe: free", `a\b`, "*")
+	f.Add("\xff\xfe", `\`, ":")
+	f.Fuzz(func(t *testing.T, a, b, c string) {
+		line := JoinFields(a, b, c)
+		assert.Equal(t, []string{a, b, c}, SplitFields(line))
+		if !strings.Contains(line, "\n") && line != "" {
+			rows, err := ParseRows(line+"\n", 3)
+			require.NoError(t, err)
+			assert.Equal(t, [][]string{{a, b, c}}, rows)
+		}
+	})
+}
+
+func FuzzParseMultiline(f *testing.F) {
+	f.Add("connection.id:home\n802-11-wireless.ssid:home\\: upstairs\n")
+	f.Add("AP[1].IN-USE:*\nAP[1].BSSID:70\\:A7\\:41\\:DC\\:5D\\:21\n")
+	f.Add(":\n\\")
+	f.Fuzz(func(t *testing.T, out string) {
+		fields, err := ParseMultiline(out)
+		if err != nil {
+			return
+		}
+		// Writing the fields back out the way nmcli would gives the same fields.
+		var b strings.Builder
+		for _, field := range fields {
+			assert.NotEmpty(t, field.Name)
+			assert.NotContains(t, field.Name, ":")
+			b.WriteString(field.Name + ":" + Escape(field.Value) + "\n")
+		}
+		again, err := ParseMultiline(b.String())
+		require.NoError(t, err)
+		assert.Equal(t, fields, again)
+	})
+}